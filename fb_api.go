@@ -0,0 +1,1322 @@
+// fb_api.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lutfinasution/filebrowser/thumbnail"
+)
+
+// The JSON API served under /api/v1. Folders and files are
+// addressed by their full path in the path query parameter,
+// albums and album items by their id.
+//
+// Clients sign in with POST /api/v1/login and send the token
+// it returns as "Authorization: Bearer <token>", or keep the
+// session cookie. Folders and files need a signed in user,
+// changes to albums an admin. Albums are listed and served
+// as their visibility allows, anonymous requests included.
+//
+// Changes to the watched folders are streamed from /api/v1/events,
+// see apiGetEvents. Images are rated through /api/v1/ratings, which
+// smart albums can select on.
+
+type apiItem struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Type     string    `json:"type"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+}
+
+type apiFolder struct {
+	Path    string    `json:"path"`
+	Folders []string  `json:"folders"`
+	Items   []apiItem `json:"items"`
+	Page    int       `json:"page"`
+	PerPage int       `json:"per_page"`
+	Pages   int       `json:"pages"`
+	Total   int       `json:"total"`
+}
+
+type apiRoot struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type apiAlbum struct {
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Date        time.Time  `json:"date"`
+	Items       int64      `json:"items"`
+	Visibility  string     `json:"visibility"`
+	Rule        *SmartRule `json:"rule,omitempty"`
+	Parent      int        `json:"parent"`
+	Albums      []apiAlbum `json:"albums,omitempty"`
+}
+
+type apiAlbumItem struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Missing  bool   `json:"missing"`
+	Position int    `json:"position"`
+}
+
+type apiRelinkCandidate struct {
+	Path   string    `json:"path"`
+	ByHash bool      `json:"by_hash"`
+	Found  time.Time `json:"found"`
+}
+
+type apiRelink struct {
+	Item       int                  `json:"item"`
+	Album      int                  `json:"album"`
+	Name       string               `json:"name"`
+	Path       string               `json:"path"`
+	Candidates []apiRelinkCandidate `json:"candidates"`
+}
+
+type apiRating struct {
+	Path   string `json:"path"`
+	Rating int    `json:"rating"`
+}
+
+type apiShare struct {
+	ID       int       `json:"id"`
+	Album    int       `json:"album"`
+	Token    string    `json:"token"`
+	Path     string    `json:"path"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	Password bool      `json:"password"`
+	Revoked  bool      `json:"revoked"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiUser struct {
+	Name  string `json:"name"`
+	Admin bool   `json:"admin"`
+}
+
+type apiSession struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+	User    apiUser   `json:"user"`
+}
+
+func registerAPI(r *mux.Router) {
+	api := r.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/login", apiLogin).Methods("POST")
+	api.HandleFunc("/logout", apiLogout).Methods("POST")
+	api.HandleFunc("/me", apiGetMe).Methods("GET")
+
+	api.HandleFunc("/roots", apiGetRoots).Methods("GET")
+	api.HandleFunc("/folders", apiGetFolder).Methods("GET")
+	api.HandleFunc("/thumbnails", apiGetThumbnail).Methods("GET")
+	api.HandleFunc("/originals", apiGetOriginal).Methods("GET")
+	api.HandleFunc("/images", apiGetImage).Methods("GET")
+	api.HandleFunc("/events", apiGetEvents).Methods("GET")
+
+	api.HandleFunc("/albums", apiGetAlbums).Methods("GET")
+	api.HandleFunc("/albums", apiCreateAlbum).Methods("POST")
+	api.HandleFunc("/albums/{id:[0-9]+}", apiGetAlbum).Methods("GET")
+	api.HandleFunc("/albums/{id:[0-9]+}", apiUpdateAlbum).Methods("PUT")
+	api.HandleFunc("/albums/{id:[0-9]+}", apiDeleteAlbum).Methods("DELETE")
+	api.HandleFunc("/albums/{id:[0-9]+}/items", apiGetAlbumItems).Methods("GET")
+	api.HandleFunc("/albums/{id:[0-9]+}/items", apiAddAlbumItems).Methods("POST")
+	api.HandleFunc("/albums/{id:[0-9]+}/items/move", apiMoveAlbumItems).Methods("POST")
+	api.HandleFunc("/albums/{id:[0-9]+}/items/reverse", apiReverseAlbumItems).Methods("POST")
+	api.HandleFunc("/albums/{id:[0-9]+}/zip", apiGetAlbumZip).Methods("GET")
+	api.HandleFunc("/albums/{id:[0-9]+}/parent", apiMoveAlbum).Methods("PUT")
+	api.HandleFunc("/albums/{id:[0-9]+}/rule", apiSetAlbumRule).Methods("PUT")
+	api.HandleFunc("/albums/{id:[0-9]+}/rule", apiDeleteAlbumRule).Methods("DELETE")
+	api.HandleFunc("/albums/{id:[0-9]+}/items/{item:[0-9]+}", apiGetAlbumItem).Methods("GET")
+	api.HandleFunc("/albums/{id:[0-9]+}/items/{item:[0-9]+}", apiDeleteAlbumItem).Methods("DELETE")
+	api.HandleFunc("/albums/{id:[0-9]+}/items/{item:[0-9]+}/thumbnail", apiGetAlbumItemThumbnail).Methods("GET")
+	api.HandleFunc("/albums/{id:[0-9]+}/items/{item:[0-9]+}/original", apiGetAlbumItemOriginal).Methods("GET")
+	api.HandleFunc("/albums/{id:[0-9]+}/items/{item:[0-9]+}/image", apiGetAlbumItemImage).Methods("GET")
+
+	api.HandleFunc("/ratings", apiGetRating).Methods("GET")
+	api.HandleFunc("/ratings", apiSetRating).Methods("PUT")
+
+	api.HandleFunc("/relinks", apiGetRelinks).Methods("GET")
+	api.HandleFunc("/relinks", apiRunRelink).Methods("POST")
+	api.HandleFunc("/relinks/{item:[0-9]+}", apiConfirmRelink).Methods("POST")
+	api.HandleFunc("/relinks/{item:[0-9]+}", apiDismissRelink).Methods("DELETE")
+
+	api.HandleFunc("/albums/{id:[0-9]+}/shares", apiGetShares).Methods("GET")
+	api.HandleFunc("/albums/{id:[0-9]+}/shares", apiCreateShare).Methods("POST")
+	api.HandleFunc("/albums/{id:[0-9]+}/shares/{share:[0-9]+}", apiRevokeShare).Methods("DELETE")
+}
+
+func apiWrite(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiFail(w http.ResponseWriter, status int, msg string) {
+	apiWrite(w, status, apiError{Error: msg})
+}
+
+// Returns the {id} and, if present, the {item} route variables.
+func apiIDs(r *http.Request) (id int, item int) {
+	vars := mux.Vars(r)
+	id, _ = strconv.Atoi(vars["id"])
+	item, _ = strconv.Atoi(vars["item"])
+	return id, item
+}
+
+func apiToAlbum(v *FileInfo) apiAlbum {
+	return apiAlbum{ID: v.index, Name: v.Name, Description: v.URL, Date: v.Modified, Items: v.Size,
+		Visibility: v.visibility.String(), Rule: v.smart, Parent: v.indexParent}
+}
+
+// Returns the album of n with the items of its sub-albums counted in,
+// and its sub-albums depth levels down, all of them if depth is -1.
+// Parent is the album it is listed under, which differs from its own
+// when that one can't be seen.
+func apiToAlbumNode(n *albumNode, depth int) apiAlbum {
+	res := apiToAlbum(n.album)
+	res.Items = n.total
+	res.Parent = 0
+	if n.parent != nil {
+		res.Parent = n.parent.album.index
+	}
+	if depth != 0 {
+		for _, c := range n.children {
+			res.Albums = append(res.Albums, apiToAlbumNode(c, depth-1))
+		}
+	}
+	return res
+}
+
+func apiToAlbumItem(v *FileInfo) apiAlbumItem {
+	return apiAlbumItem{ID: v.index, Name: v.Name, Path: filepath.Join(v.URL, v.Name), Width: v.Width, Height: v.Height,
+		Missing: v.missing, Position: v.position}
+}
+
+// Lets the album view catch up with changes made through the API.
+func apiAlbumsChanged() {
+	if Mw.albumView == nil {
+		return
+	}
+	Mw.Synchronize(func() {
+		Mw.albumView.RunAlbum()
+	})
+}
+
+//------------------------------------------------
+// SESSIONS
+//------------------------------------------------
+
+// Returns the signed in user of the request, having
+// written the error response if there is none.
+func apiRequireUser(w http.ResponseWriter, r *http.Request) *webUser {
+	u := requestUser(r)
+	if u == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="GoImageBrowser"`)
+		apiFail(w, http.StatusUnauthorized, "sign in required")
+	}
+	return u
+}
+
+// Reports whether the request is from an admin, having
+// written the error response if it isn't.
+func apiRequireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	u := apiRequireUser(w, r)
+	if u == nil {
+		return false
+	}
+	if !u.Admin {
+		apiFail(w, http.StatusForbidden, "admin required")
+		return false
+	}
+	return true
+}
+
+// POST /api/v1/login {"name": "", "password": ""}
+func apiLogin(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		apiFail(w, http.StatusBadRequest, "expected a name and password")
+		return
+	}
+	u, err := authLogin(in.Name, in.Password)
+	if err == ErrBadLogin {
+		apiFail(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	token, err := authNewSession(u)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	authSetCookie(w, r, token, int(sessionLifetime/time.Second))
+	apiWrite(w, http.StatusOK, apiSession{Token: token, Expires: time.Now().Add(sessionLifetime),
+		User: apiUser{Name: u.Name, Admin: u.Admin}})
+}
+
+// POST /api/v1/logout
+func apiLogout(w http.ResponseWriter, r *http.Request) {
+	if token := authRequestToken(r); token != "" {
+		if err := authEndSession(token); err != nil {
+			apiFail(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	authSetCookie(w, r, "", -1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v1/me
+func apiGetMe(w http.ResponseWriter, r *http.Request) {
+	if u := apiRequireUser(w, r); u != nil {
+		apiWrite(w, http.StatusOK, apiUser{Name: u.Name, Admin: u.Admin})
+	}
+}
+
+//------------------------------------------------
+// FOLDERS AND FILES
+//------------------------------------------------
+
+// GET /api/v1/roots
+func apiGetRoots(w http.ResponseWriter, r *http.Request) {
+	if apiRequireUser(w, r) == nil {
+		return
+	}
+	res := []apiRoot{}
+	for i, v := range ServeRoots {
+		res = append(res, apiRoot{ID: i, Name: filepath.Base(v), Path: v})
+	}
+	apiWrite(w, http.StatusOK, res)
+}
+
+// GET /api/v1/folders?path=&page=&per_page=
+func apiGetFolder(w http.ResponseWriter, r *http.Request) {
+	if apiRequireUser(w, r) == nil {
+		return
+	}
+	q := r.URL.Query()
+
+	dirPath := q.Get("path")
+	if dirPath == "" {
+		apiFail(w, http.StatusBadRequest, "missing path")
+		return
+	}
+	page, _ := strconv.Atoi(q.Get("page"))
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+
+	dirPath, err := sandboxPath(dirPath)
+	if err != nil {
+		apiFail(w, sandboxStatus(err), err.Error())
+		return
+	}
+
+	f, err := serveListFolder(dirPath, page, perPage)
+	if err != nil {
+		if os.IsNotExist(err) {
+			apiFail(w, http.StatusNotFound, "folder not found")
+		} else {
+			apiFail(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	res := apiFolder{Path: f.Path, Folders: f.Folders, Items: []apiItem{},
+		Page: f.Page, PerPage: f.PerPage, Pages: f.Pages(), Total: f.Total}
+	for _, v := range f.Items {
+		res.Items = append(res.Items, apiItem{
+			Name:     v.Name,
+			Path:     filepath.Join(v.URL, v.Name),
+			Type:     v.Type,
+			Size:     v.Size,
+			Modified: v.Modified,
+			Width:    v.Width,
+			Height:   v.Height,
+		})
+	}
+	apiWrite(w, http.StatusOK, res)
+}
+
+// GET /api/v1/thumbnails?path=&size=small|medium|large
+func apiGetThumbnail(w http.ResponseWriter, r *http.Request) {
+	if apiRequireUser(w, r) == nil {
+		return
+	}
+	name := r.URL.Query().Get("path")
+	if name == "" {
+		apiFail(w, http.StatusBadRequest, "missing path")
+		return
+	}
+	name, err := sandboxPath(name)
+	if err != nil {
+		apiFail(w, sandboxStatus(err), err.Error())
+		return
+	}
+
+	tier := thumbnail.TierMedium
+	if s := r.URL.Query().Get("size"); s != "" {
+		var ok bool
+		if tier, ok = thumbnail.ParseTier(s); !ok {
+			apiFail(w, http.StatusBadRequest, "size must be small, medium or large")
+			return
+		}
+	}
+
+	th, modified, err := serveThumbnail(name, tier)
+	if err != nil {
+		apiFileFail(w, err)
+		return
+	}
+	serveThumbData(w, r, th.Data, modified)
+}
+
+// GET /api/v1/originals?path=
+func apiGetOriginal(w http.ResponseWriter, r *http.Request) {
+	if apiRequireUser(w, r) == nil {
+		return
+	}
+	name := r.URL.Query().Get("path")
+	if name == "" {
+		apiFail(w, http.StatusBadRequest, "missing path")
+		return
+	}
+	apiServeImage(w, r, name, sandboxPath)
+}
+
+// GET /api/v1/images?path=&width=&height=&fit=&quality=&format=
+func apiGetImage(w http.ResponseWriter, r *http.Request) {
+	if apiRequireUser(w, r) == nil {
+		return
+	}
+	name := r.URL.Query().Get("path")
+	if name == "" {
+		apiFail(w, http.StatusBadRequest, "missing path")
+		return
+	}
+	apiServeVariant(w, r, name, sandboxPath)
+}
+
+// Writes the image file name resized as the query parameters ask,
+// see parseVariant, or as is if they don't ask for a size. name is
+// resolved with resolve, sandboxPath or sandboxAlbumPath.
+func apiServeVariant(w http.ResponseWriter, r *http.Request, name string, resolve func(string) (string, error)) {
+	spec, resize, err := parseVariant(r.URL.Query())
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !resize {
+		apiServeImage(w, r, name, resolve)
+		return
+	}
+	name, err = resolve(name)
+	if err != nil {
+		apiFail(w, sandboxStatus(err), err.Error())
+		return
+	}
+	if !thumbnail.Supported(filepath.Ext(name)) {
+		apiFileFail(w, thumbnail.ErrUnsupported)
+		return
+	}
+	if err = serveVariant(w, r, name, spec); err != nil {
+		apiFileFail(w, err)
+	}
+}
+
+// Writes the image file name as is, resolved with resolve.
+func apiServeImage(w http.ResponseWriter, r *http.Request, name string, resolve func(string) (string, error)) {
+	name, err := resolve(name)
+	if err != nil {
+		apiFail(w, sandboxStatus(err), err.Error())
+		return
+	}
+	if !thumbnail.Supported(filepath.Ext(name)) {
+		apiFileFail(w, thumbnail.ErrUnsupported)
+		return
+	}
+	if err = serveImageFile(w, r, name); err != nil {
+		apiFileFail(w, err)
+	}
+}
+
+func apiFileFail(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		apiFail(w, http.StatusNotFound, "file not found")
+	case err == thumbnail.ErrUnsupported:
+		apiFail(w, http.StatusUnsupportedMediaType, err.Error())
+	default:
+		apiFail(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+//------------------------------------------------
+// ALBUMS
+//------------------------------------------------
+
+// GET /api/v1/albums?tree=
+// lists the albums, parents before their sub-albums, or with tree=1
+// the top albums with their sub-albums nested in albums. The items
+// of an album include those of its sub-albums.
+func apiGetAlbums(w http.ResponseWriter, r *http.Request) {
+	top, _, err := visibleAlbumTree(requestUser(r))
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	res := []apiAlbum{}
+	if tree, _ := strconv.ParseBool(r.URL.Query().Get("tree")); tree {
+		for _, n := range top {
+			res = append(res, apiToAlbumNode(n, -1))
+		}
+	} else {
+		for _, n := range albumTreeList(top) {
+			res = append(res, apiToAlbumNode(n, 0))
+		}
+	}
+	apiWrite(w, http.StatusOK, res)
+}
+
+// Returns the album of the request, having written the error
+// response if there is none. Albums the user may not see are
+// reported as not found.
+func apiLookupAlbum(w http.ResponseWriter, r *http.Request) *FileInfo {
+	id, _ := apiIDs(r)
+
+	v, err := Mw.albumView.AlbumDBGetAlbum(id)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	if v == nil || !albumVisible(requestUser(r), v.visibility) {
+		apiFail(w, http.StatusNotFound, "album not found")
+		return nil
+	}
+	return v
+}
+
+// GET /api/v1/albums/{id}
+// returns the album with its sub-albums one level down.
+func apiGetAlbum(w http.ResponseWriter, r *http.Request) {
+	v := apiLookupAlbum(w, r)
+	if v == nil {
+		return
+	}
+	_, nodes, err := visibleAlbumTree(requestUser(r))
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n := nodes[v.index]; n != nil {
+		apiWrite(w, http.StatusOK, apiToAlbumNode(n, 1))
+	} else {
+		apiWrite(w, http.StatusOK, apiToAlbum(v))
+	}
+}
+
+// Reads the name, description, visibility and rule of an album
+// from the request. A missing visibility is left empty.
+func apiReadAlbum(w http.ResponseWriter, r *http.Request) (*apiAlbum, bool) {
+	var in apiAlbum
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		apiFail(w, http.StatusBadRequest, "invalid album: "+err.Error())
+		return nil, false
+	}
+	if in.Name == "" {
+		apiFail(w, http.StatusBadRequest, "missing album name")
+		return nil, false
+	}
+	if _, ok := ParseVisibility(in.Visibility); in.Visibility != "" && !ok {
+		apiFail(w, http.StatusBadRequest, "visibility must be private, shared or public")
+		return nil, false
+	}
+	if in.Rule != nil && !apiCheckRule(w, in.Rule) {
+		return nil, false
+	}
+	return &in, true
+}
+
+// Checks the rule of a smart album, having written the error
+// response if it is invalid. Over http the rule must have a
+// folder in the ServeRoots. Smart albums are filled from cache.db,
+// so none can be made while caching is off.
+func apiCheckRule(w http.ResponseWriter, rule *SmartRule) bool {
+	if !Mw.thumbView.doCache {
+		apiFail(w, http.StatusServiceUnavailable, errSmartNoCache.Error())
+		return false
+	}
+	if rule.Folder == "" {
+		apiFail(w, http.StatusBadRequest, "a rule needs a folder")
+		return false
+	}
+	real, err := sandboxPath(rule.Folder)
+	if err != nil {
+		apiFail(w, sandboxStatus(err), rule.Folder+": "+err.Error())
+		return false
+	}
+	rule.Folder = real
+	if err = rule.normalize(); err != nil {
+		apiFail(w, http.StatusBadRequest, "invalid rule: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// POST /api/v1/albums {"name": "", "description": "", "visibility": "", "rule": {}, "parent": 0}
+// With a rule the album is a smart album, see SmartRule. With
+// a parent it is made a sub-album of that album.
+func apiCreateAlbum(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	in, ok := apiReadAlbum(w, r)
+	if !ok {
+		return
+	}
+	if in.Parent != 0 {
+		if parent, err := Mw.albumView.AlbumDBGetAlbum(in.Parent); err != nil {
+			apiFail(w, http.StatusInternalServerError, err.Error())
+			return
+		} else if parent == nil {
+			apiFail(w, http.StatusBadRequest, errNoParent.Error())
+			return
+		}
+	}
+	vis, _ := ParseVisibility(in.Visibility)
+	info := FileInfo{index: -1, indexParent: in.Parent, Name: in.Name, URL: in.Description, visibility: vis, smart: in.Rule}
+	if _, err := Mw.albumView.AlbumDBUpdateAlbum(&info); err == ErrAlbumTaken {
+		apiFail(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if info.smart != nil {
+		// a smart album that couldn't be filled isn't kept,
+		// or a retry would find its name taken.
+		if _, _, err := Mw.albumView.AlbumDBRefreshSmart(info.index); err != nil {
+			if _, derr := Mw.albumView.AlbumDBDeleteAlbum(info.index); derr != nil {
+				log.Println("apiCreateAlbum", info.Name, derr)
+			}
+			apiFail(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	v, err := Mw.albumView.AlbumDBGetAlbum(info.index)
+	if err != nil || v == nil {
+		apiFail(w, http.StatusInternalServerError, "album not created")
+		return
+	}
+	apiAlbumsChanged()
+	apiWrite(w, http.StatusCreated, apiToAlbum(v))
+}
+
+// PUT /api/v1/albums/{id} {"name": "", "description": "", "visibility": ""}
+// The rule is changed with PUT /api/v1/albums/{id}/rule.
+func apiUpdateAlbum(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	id, _ := apiIDs(r)
+
+	in, ok := apiReadAlbum(w, r)
+	if !ok {
+		return
+	}
+
+	n, err := Mw.albumView.AlbumDBRenameAlbum(id, in.Name, in.Description)
+	if err == ErrAlbumTaken {
+		apiFail(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n == 0 {
+		apiFail(w, http.StatusNotFound, "album not found")
+		return
+	}
+	if vis, ok := ParseVisibility(in.Visibility); ok {
+		if _, err := Mw.albumView.AlbumDBSetVisibility(id, vis); err != nil {
+			apiFail(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	apiAlbumsChanged()
+	apiGetAlbum(w, r)
+}
+
+// DELETE /api/v1/albums/{id}
+func apiDeleteAlbum(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	id, _ := apiIDs(r)
+
+	n, err := Mw.albumView.AlbumDBDeleteAlbum(id)
+	switch {
+	case err == ErrAlbumTaken:
+		apiFail(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	case n == 0:
+		apiFail(w, http.StatusNotFound, "album not found")
+		return
+	}
+	apiAlbumsChanged()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PUT /api/v1/albums/{id}/parent {"parent": 0}
+// puts the album in the album parent, 0 moving it to the top.
+func apiMoveAlbum(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	id, _ := apiIDs(r)
+
+	var in struct {
+		Parent int `json:"parent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		apiFail(w, http.StatusBadRequest, "expected a parent album id")
+		return
+	}
+	n, err := Mw.albumView.AlbumDBMoveAlbum(id, in.Parent)
+	switch {
+	case err == ErrAlbumTaken:
+		apiFail(w, http.StatusConflict, err.Error())
+		return
+	case err == ErrAlbumCycle || err == errNoParent:
+		apiFail(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	case n == 0:
+		apiFail(w, http.StatusNotFound, "album not found")
+		return
+	}
+	apiAlbumsChanged()
+	apiGetAlbum(w, r)
+}
+
+// PUT /api/v1/albums/{id}/rule {"folder": "", "extensions": [""], ...}
+// makes the album a smart album, or changes its rule, replacing
+// its items with the files matching the rule.
+func apiSetAlbumRule(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	id, _ := apiIDs(r)
+
+	var rule SmartRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		apiFail(w, http.StatusBadRequest, "invalid rule: "+err.Error())
+		return
+	}
+	if !apiCheckRule(w, &rule) {
+		return
+	}
+	n, err := Mw.albumView.AlbumDBSetSmartRule(id, &rule)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n == 0 {
+		apiFail(w, http.StatusNotFound, "album not found")
+		return
+	}
+	if _, _, err = Mw.albumView.AlbumDBRefreshSmart(id); err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiAlbumsChanged()
+	apiGetAlbum(w, r)
+}
+
+// DELETE /api/v1/albums/{id}/rule makes a smart
+// album a plain one, keeping the items it has.
+func apiDeleteAlbumRule(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	id, _ := apiIDs(r)
+
+	n, err := Mw.albumView.AlbumDBSetSmartRule(id, nil)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n == 0 {
+		apiFail(w, http.StatusNotFound, "album not found")
+		return
+	}
+	apiAlbumsChanged()
+	apiGetAlbum(w, r)
+}
+
+//------------------------------------------------
+// ALBUM ITEMS
+//------------------------------------------------
+
+// GET /api/v1/albums/{id}/items
+func apiGetAlbumItems(w http.ResponseWriter, r *http.Request) {
+	if v := apiLookupAlbum(w, r); v != nil {
+		apiWriteAlbumItems(w, http.StatusOK, v.index)
+	}
+}
+
+func apiWriteAlbumItems(w http.ResponseWriter, status int, id int) {
+	items, err := Mw.albumView.AlbumDBEnumItems(id)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	res := []apiAlbumItem{}
+	for _, v := range items {
+		res = append(res, apiToAlbumItem(v))
+	}
+	apiWrite(w, status, res)
+}
+
+// POST /api/v1/albums/{id}/items {"paths": [""], "position": 0}
+// adds the files at position, or at the end without one.
+func apiAddAlbumItems(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	id, _ := apiIDs(r)
+
+	var in struct {
+		Paths    []string `json:"paths"`
+		Position *int     `json:"position"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || len(in.Paths) == 0 {
+		apiFail(w, http.StatusBadRequest, "expected a list of paths")
+		return
+	}
+
+	album := apiLookupAlbum(w, r)
+	if album == nil {
+		return
+	}
+	if album.smart != nil {
+		apiFail(w, http.StatusConflict, ErrSmartAlbum.Error())
+		return
+	}
+
+	var items []*FileInfo
+	for _, name := range in.Paths {
+		real, err := sandboxPath(name)
+		if err != nil {
+			apiFail(w, sandboxStatus(err), name+": "+err.Error())
+			return
+		}
+		v, err := apiNewAlbumItem(real)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, name+": "+err.Error())
+			return
+		}
+		items = append(items, v)
+	}
+	var err error
+	if in.Position != nil {
+		_, err = Mw.albumView.AlbumDBInsertItems(id, items, *in.Position)
+	} else {
+		_, err = Mw.albumView.AlbumDBUpdateItems(id, items)
+	}
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiAlbumsChanged()
+	apiWriteAlbumItems(w, http.StatusCreated, id)
+}
+
+// POST /api/v1/albums/{id}/items/move {"items": [0], "position": 0}
+// moves the items to position in the order given, -1 or a
+// position past the end moving them to the end.
+func apiMoveAlbumItems(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	id, _ := apiIDs(r)
+
+	var in struct {
+		Items    []int `json:"items"`
+		Position int   `json:"position"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || len(in.Items) == 0 {
+		apiFail(w, http.StatusBadRequest, "expected a list of item ids")
+		return
+	}
+	if apiLookupAlbum(w, r) == nil {
+		return
+	}
+	if err := Mw.albumView.AlbumDBMoveItems(id, in.Items, in.Position); err != nil {
+		if _, ok := err.(*DBError); ok {
+			apiFail(w, http.StatusInternalServerError, err.Error())
+		} else {
+			apiFail(w, http.StatusNotFound, err.Error())
+		}
+		return
+	}
+	apiAlbumsChanged()
+	apiWriteAlbumItems(w, http.StatusOK, id)
+}
+
+// POST /api/v1/albums/{id}/items/reverse
+func apiReverseAlbumItems(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	id, _ := apiIDs(r)
+
+	if apiLookupAlbum(w, r) == nil {
+		return
+	}
+	if err := Mw.albumView.AlbumDBReverseItems(id); err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiAlbumsChanged()
+	apiWriteAlbumItems(w, http.StatusOK, id)
+}
+
+// GET /api/v1/albums/{id}/zip?items=&resize=
+func apiGetAlbumZip(w http.ResponseWriter, r *http.Request) {
+	album := apiLookupAlbum(w, r)
+	if album == nil {
+		return
+	}
+	ids, resize, err := zipParams(r)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	items, err := Mw.albumView.AlbumDBEnumItems(album.index)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if items, err = zipSelectItems(items, ids); err != nil {
+		apiFail(w, http.StatusNotFound, err.Error())
+		return
+	}
+	serveZip(w, r, album.Name, items, resize)
+}
+
+// Returns an album item for the image file name,
+// with a thumbnail for the album view.
+func apiNewAlbumItem(name string) (*FileInfo, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	th, _, err := serveThumbnail(name, thumbnail.TierMedium)
+	if err != nil {
+		return nil, err
+	}
+	v := &FileInfo{
+		Name:      filepath.Base(name),
+		URL:       filepath.Dir(name),
+		Size:      info.Size(),
+		Modified:  info.ModTime(),
+		Imagedata: th.Data,
+	}
+	// the thumbnail's source size is that of the decoded image,
+	// which a jpeg is scaled down in, so the file is asked
+	if sz, err := GetImageInfo(name); err == nil {
+		v.Width, v.Height = sz.Width, sz.Height
+	}
+	return v, nil
+}
+
+// Returns the item of the request, having
+// written the error response if there is none.
+func apiLookupAlbumItem(w http.ResponseWriter, r *http.Request) *FileInfo {
+	if apiLookupAlbum(w, r) == nil {
+		return nil
+	}
+	id, item := apiIDs(r)
+
+	v, err := Mw.albumView.AlbumDBGetAlbumItem(id, item)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	if v == nil {
+		apiFail(w, http.StatusNotFound, "album item not found")
+	}
+	return v
+}
+
+// GET /api/v1/albums/{id}/items/{item}
+func apiGetAlbumItem(w http.ResponseWriter, r *http.Request) {
+	if v := apiLookupAlbumItem(w, r); v != nil {
+		apiWrite(w, http.StatusOK, apiToAlbumItem(v))
+	}
+}
+
+// DELETE /api/v1/albums/{id}/items/{item}
+func apiDeleteAlbumItem(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	v := apiLookupAlbumItem(w, r)
+	if v == nil {
+		return
+	}
+	if album, err := Mw.albumView.AlbumDBGetAlbum(v.indexParent); err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if album != nil && album.smart != nil {
+		apiFail(w, http.StatusConflict, ErrSmartAlbum.Error())
+		return
+	}
+	if _, err := Mw.albumView.AlbumDBDeleteItems([]*FileInfo{v}); err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiAlbumsChanged()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v1/albums/{id}/items/{item}/thumbnail
+func apiGetAlbumItemThumbnail(w http.ResponseWriter, r *http.Request) {
+	v := apiLookupAlbumItem(w, r)
+	if v == nil {
+		return
+	}
+	if len(v.Imagedata) == 0 {
+		apiFail(w, http.StatusNotFound, "album item has no thumbnail")
+		return
+	}
+	serveThumbData(w, r, v.Imagedata, v.Modified)
+}
+
+// GET /api/v1/albums/{id}/items/{item}/original
+func apiGetAlbumItemOriginal(w http.ResponseWriter, r *http.Request) {
+	if v := apiLookupAlbumItem(w, r); v != nil {
+		if albumItemMissing(v) {
+			apiFail(w, http.StatusNotFound, errItemMissing.Error())
+			return
+		}
+		apiServeImage(w, r, filepath.Join(v.URL, v.Name), sandboxAlbumPath)
+	}
+}
+
+// GET /api/v1/albums/{id}/items/{item}/image?width=&height=&fit=&quality=&format=
+func apiGetAlbumItemImage(w http.ResponseWriter, r *http.Request) {
+	if v := apiLookupAlbumItem(w, r); v != nil {
+		if albumItemMissing(v) {
+			apiFail(w, http.StatusNotFound, errItemMissing.Error())
+			return
+		}
+		apiServeVariant(w, r, filepath.Join(v.URL, v.Name), sandboxAlbumPath)
+	}
+}
+
+//------------------------------------------------
+// RATINGS
+//------------------------------------------------
+
+// GET /api/v1/ratings?path=
+func apiGetRating(w http.ResponseWriter, r *http.Request) {
+	if apiRequireUser(w, r) == nil {
+		return
+	}
+	name, err := sandboxPath(r.URL.Query().Get("path"))
+	if err != nil {
+		apiFail(w, sandboxStatus(err), err.Error())
+		return
+	}
+	rating, err := Mw.albumView.AlbumDBGetRating(name)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiWrite(w, http.StatusOK, apiRating{Path: name, Rating: rating})
+}
+
+// PUT /api/v1/ratings {"path": "", "rating": 0}
+// rates an image from 1 to 5, 0 clearing its rating.
+func apiSetRating(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	var in apiRating
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		apiFail(w, http.StatusBadRequest, "invalid rating: "+err.Error())
+		return
+	}
+	name, err := sandboxPath(in.Path)
+	if err != nil {
+		apiFail(w, sandboxStatus(err), err.Error())
+		return
+	}
+	if info, err := os.Stat(name); err != nil || info.IsDir() || !thumbnail.Supported(filepath.Ext(name)) {
+		apiFail(w, http.StatusBadRequest, "not an image file")
+		return
+	}
+	if in.Rating < 0 || in.Rating > ratingMax {
+		apiFail(w, http.StatusBadRequest, "rating must be between 0 and 5")
+		return
+	}
+	if err = Mw.albumView.AlbumDBSetRating(name, in.Rating); err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiWrite(w, http.StatusOK, apiRating{Path: name, Rating: in.Rating})
+}
+
+//------------------------------------------------
+// RELINKING
+//------------------------------------------------
+
+// GET /api/v1/relinks lists the missing album items
+// and the files they may have moved to.
+func apiGetRelinks(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	items, err := Mw.albumView.AlbumDBMissingItems()
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cands, err := Mw.albumView.AlbumDBGetRelinks()
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	res := make([]apiRelink, 0, len(items))
+	for _, v := range items {
+		rl := apiRelink{Item: v.index, Album: v.indexParent, Name: v.Name, Path: filepath.Join(v.URL, v.Name),
+			Candidates: []apiRelinkCandidate{}}
+		for _, c := range cands {
+			if c.ItemID == v.index {
+				rl.Candidates = append(rl.Candidates, apiRelinkCandidate{Path: c.Path, ByHash: c.ByHash, Found: c.Found})
+			}
+		}
+		res = append(res, rl)
+	}
+	apiWrite(w, http.StatusOK, res)
+}
+
+// POST /api/v1/relinks checks all album items and searches
+// for the missing ones, see AlbumDBRelink.
+func apiRunRelink(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	res, err := Mw.albumView.AlbumDBRelink()
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if res.Relinked > 0 {
+		apiAlbumsChanged()
+	}
+	apiWrite(w, http.StatusOK, res)
+}
+
+// POST /api/v1/relinks/{item} {"path": ""} relinks the
+// missing item to one of its candidates.
+func apiConfirmRelink(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	_, item := apiIDs(r)
+
+	var in struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		apiFail(w, http.StatusBadRequest, "invalid relink: "+err.Error())
+		return
+	}
+	cands, err := Mw.albumView.AlbumDBGetRelinks()
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	known := false
+	for _, c := range cands {
+		if c.ItemID == item && c.Path == in.Path {
+			known = true
+		}
+	}
+	if !known {
+		apiFail(w, http.StatusNotFound, "no such relink candidate")
+		return
+	}
+
+	_, err = Mw.albumView.AlbumDBRelinkItem(item, in.Path)
+	switch {
+	case err == nil:
+	case err == ErrRelinkTaken:
+		apiFail(w, http.StatusConflict, err.Error())
+		return
+	case os.IsNotExist(err):
+		apiFail(w, http.StatusNotFound, "the candidate file is gone")
+		return
+	default:
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	v, err := Mw.albumView.AlbumDBGetItem(item)
+	if err != nil || v == nil {
+		apiFail(w, http.StatusInternalServerError, "relinked item not found")
+		return
+	}
+	apiAlbumsChanged()
+	apiWrite(w, http.StatusOK, apiToAlbumItem(v))
+}
+
+// DELETE /api/v1/relinks/{item} drops the candidates of the item.
+func apiDismissRelink(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	_, item := apiIDs(r)
+	if _, err := Mw.albumView.AlbumDBDismissRelinks(item); err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//------------------------------------------------
+// SHARE LINKS
+//------------------------------------------------
+
+func apiToShare(v *albumShare) (apiShare, error) {
+	token, err := shareToken(v)
+	if err != nil {
+		return apiShare{}, err
+	}
+	return apiShare{ID: v.ID, Album: v.AlbumID, Token: token, Path: "/share/" + token,
+		Created: v.Created, Expires: v.Expires, Password: v.HasPassword(), Revoked: v.Revoked}, nil
+}
+
+// GET /api/v1/albums/{id}/shares
+func apiGetShares(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	album := apiLookupAlbum(w, r)
+	if album == nil {
+		return
+	}
+	shares, err := Mw.albumView.AlbumDBGetShares(album.index)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	res := []apiShare{}
+	for _, v := range shares {
+		sh, err := apiToShare(v)
+		if err != nil {
+			apiFail(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		res = append(res, sh)
+	}
+	apiWrite(w, http.StatusOK, res)
+}
+
+// POST /api/v1/albums/{id}/shares {"expires_in": seconds, "password": ""}
+// The link expires in a week if expires_in is left out.
+func apiCreateShare(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	album := apiLookupAlbum(w, r)
+	if album == nil {
+		return
+	}
+
+	var in struct {
+		ExpiresIn int64  `json:"expires_in"`
+		Password  string `json:"password"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			apiFail(w, http.StatusBadRequest, "invalid share: "+err.Error())
+			return
+		}
+	}
+	lifetime := shareDefaultLifetime
+	if in.ExpiresIn != 0 {
+		lifetime = time.Duration(in.ExpiresIn) * time.Second
+	}
+	if lifetime <= 0 || lifetime > shareMaxLifetime {
+		apiFail(w, http.StatusBadRequest, ErrShareLifetime.Error())
+		return
+	}
+
+	v, err := Mw.albumView.AlbumDBNewShare(album.index, time.Now().Add(lifetime), in.Password)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sh, err := apiToShare(v)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiWrite(w, http.StatusCreated, sh)
+}
+
+// DELETE /api/v1/albums/{id}/shares/{share}
+func apiRevokeShare(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireAdmin(w, r) {
+		return
+	}
+	id, _ := apiIDs(r)
+	idShare, _ := strconv.Atoi(mux.Vars(r)["share"])
+
+	n, err := Mw.albumView.AlbumDBRevokeShare(id, idShare)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n == 0 {
+		apiFail(w, http.StatusNotFound, "share not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
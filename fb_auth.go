@@ -0,0 +1,294 @@
+// fb_auth.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Who can see an album over http. Public albums are open to
+// anyone, shared albums to every signed in user and private
+// albums to admins only. Albums are private until made otherwise.
+type AlbumVisibility int
+
+const (
+	VisibilityPrivate AlbumVisibility = iota
+	VisibilityShared
+	VisibilityPublic
+)
+
+func (v AlbumVisibility) String() string {
+	switch v {
+	case VisibilityShared:
+		return "shared"
+	case VisibilityPublic:
+		return "public"
+	}
+	return "private"
+}
+
+// ParseVisibility returns the visibility called s, as
+// returned by String.
+func ParseVisibility(s string) (AlbumVisibility, bool) {
+	for _, v := range []AlbumVisibility{VisibilityPrivate, VisibilityShared, VisibilityPublic} {
+		if s == v.String() {
+			return v, true
+		}
+	}
+	return VisibilityPrivate, false
+}
+
+// ErrBadLogin is returned for an unknown user name or a wrong password,
+// without telling which.
+var ErrBadLogin = errors.New("wrong user name or password")
+
+const (
+	sessionCookie   = "session"
+	sessionLifetime = 30 * 24 * time.Hour
+)
+
+// A user of the http server, as configured with -adduser.
+type webUser struct {
+	ID    int
+	Name  string
+	Admin bool
+}
+
+// Reports whether the user u, nil when not signed in,
+// may see an album of visibility vis.
+func albumVisible(u *webUser, vis AlbumVisibility) bool {
+	switch vis {
+	case VisibilityPublic:
+		return true
+	case VisibilityShared:
+		return u != nil
+	}
+	return u != nil && u.Admin
+}
+
+// Adds the user name with password, or changes the password
+// and role of an existing one, ending all of their sessions.
+func AuthSetUser(name string, password string, admin bool) error {
+	if name == "" || password == "" {
+		return errors.New("user name and password can't be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	db, err := albumDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return albumDBError(db, "AuthSetUser", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`update webuser set passhash = ?, isadmin = ? where username = ?`, string(hash), admin, name)
+	if err != nil {
+		return albumDBError(db, "AuthSetUser", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec(`insert into webuser(username, passhash, isadmin) values(?, ?, ?)`, name, string(hash), admin)
+	} else {
+		_, err = tx.Exec(`delete from websession where iduser = (select iduser from webuser where username = ?)`, name)
+	}
+	if err != nil {
+		return albumDBError(db, "AuthSetUser", err)
+	}
+	return albumDBError(db, "AuthSetUser", tx.Commit())
+}
+
+// Removes the user name and their sessions.
+func AuthDeleteUser(name string) (rcnt int64, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, albumDBError(db, "AuthDeleteUser", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`delete from websession where iduser = (select iduser from webuser where username = ?)`, name); err != nil {
+		return 0, albumDBError(db, "AuthDeleteUser", err)
+	}
+	res, err := tx.Exec(`delete from webuser where username = ?`, name)
+	if err != nil {
+		return 0, albumDBError(db, "AuthDeleteUser", err)
+	}
+	rcnt, _ = res.RowsAffected()
+
+	if err = tx.Commit(); err != nil {
+		return 0, albumDBError(db, "AuthDeleteUser", err)
+	}
+	return rcnt, nil
+}
+
+// Returns the number of users configured.
+func AuthCountUsers() (n int, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
+	}
+	err = db.QueryRow(`select count(*) from webuser`).Scan(&n)
+	return n, albumDBError(db, "AuthCountUsers", err)
+}
+
+// Compared against when the user doesn't exist, so a
+// failed login takes as long whether or not it does.
+var authDummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Checks the password of the user name.
+func authLogin(name string, password string) (*webUser, error) {
+	db, err := albumDB()
+	if err != nil {
+		return nil, err
+	}
+
+	u := &webUser{Name: name}
+	var hash string
+	err = db.QueryRow(`select iduser, passhash, isadmin from webuser where username = ?`, name).
+		Scan(&u.ID, &hash, &u.Admin)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(authDummyHash, []byte(password))
+		return nil, ErrBadLogin
+	}
+	if err != nil {
+		return nil, albumDBError(db, "authLogin", err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, ErrBadLogin
+	}
+	return u, nil
+}
+
+func authTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Starts a session for the user u, returning its token.
+// Expired sessions of all users are dropped on the way.
+func authNewSession(u *webUser) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	db, err := albumDB()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if _, err := db.Exec(`delete from websession where expires < ?`, now.Unix()); err != nil {
+		return "", albumDBError(db, "authNewSession", err)
+	}
+	_, err = db.Exec(`insert into websession(tokenhash, iduser, expires) values(?, ?, ?)`,
+		authTokenHash(token), u.ID, now.Add(sessionLifetime).Unix())
+	if err != nil {
+		return "", albumDBError(db, "authNewSession", err)
+	}
+	return token, nil
+}
+
+// Returns the user of the session token, nil if
+// there is no such session or it has expired.
+func authSessionUser(token string) (*webUser, error) {
+	db, err := albumDB()
+	if err != nil {
+		return nil, err
+	}
+
+	u := &webUser{}
+	err = db.QueryRow(`select u.iduser, u.username, u.isadmin
+		from websession s join webuser u on u.iduser = s.iduser
+		where s.tokenhash = ? and s.expires >= ?`, authTokenHash(token), time.Now().Unix()).
+		Scan(&u.ID, &u.Name, &u.Admin)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, albumDBError(db, "authSessionUser", err)
+	}
+	return u, nil
+}
+
+func authEndSession(token string) error {
+	db, err := albumDB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`delete from websession where tokenhash = ?`, authTokenHash(token))
+	return albumDBError(db, "authEndSession", err)
+}
+
+//------------------------------------------------
+// HTTP
+//------------------------------------------------
+
+type authContextKey struct{}
+
+// Returns the session token of the request, from an
+// "Authorization: Bearer" header or the session cookie.
+func authRequestToken(r *http.Request) string {
+	if s := r.Header.Get("Authorization"); s != "" {
+		if len(s) > 7 && strings.EqualFold(s[:7], "bearer ") {
+			return strings.TrimSpace(s[7:])
+		}
+		return ""
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// Looks up the user of every request, for requestUser.
+// Requests without a valid session go on anonymously.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := authRequestToken(r); token != "" {
+			u, err := authSessionUser(token)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if u != nil {
+				r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, u))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the signed in user of the request, nil if there is none.
+func requestUser(r *http.Request) *webUser {
+	u, _ := r.Context().Value(authContextKey{}).(*webUser)
+	return u
+}
+
+func authSetCookie(w http.ResponseWriter, r *http.Request, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
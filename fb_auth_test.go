@@ -0,0 +1,196 @@
+// fb_auth_test
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Adds the user name with password to the album.db of the test.
+func testAuthUser(t *testing.T, name, password string, admin bool) *webUser {
+	if err := AuthSetUser(name, password, admin); err != nil {
+		t.Fatal(err)
+	}
+	u, err := authLogin(name, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestAuthLogin(t *testing.T) {
+	testAlbumDB(t)
+	testAuthUser(t, "ann", "correct horse", true)
+
+	if u, err := authLogin("ann", "correct horse"); err != nil || u.Name != "ann" || !u.Admin {
+		t.Errorf("right password: got %+v, %v", u, err)
+	}
+	for _, v := range []struct{ name, password string }{
+		{"ann", "wrong"},
+		{"ann", ""},
+		{"ann", "Correct horse"},
+		{"bob", "correct horse"},
+		{"", ""},
+	} {
+		if u, err := authLogin(v.name, v.password); err != ErrBadLogin {
+			t.Errorf("%q/%q: got %+v, %v, want ErrBadLogin", v.name, v.password, u, err)
+		}
+	}
+
+	for _, v := range []struct{ name, password string }{{"", "x"}, {"x", ""}} {
+		if err := AuthSetUser(v.name, v.password, false); err == nil {
+			t.Errorf("user %q with password %q: no error", v.name, v.password)
+		}
+	}
+
+	// a new password replaces the old one
+	testAuthUser(t, "ann", "battery staple", false)
+	if _, err := authLogin("ann", "correct horse"); err != ErrBadLogin {
+		t.Errorf("old password: got %v, want ErrBadLogin", err)
+	}
+	if n, err := AuthCountUsers(); err != nil || n != 1 {
+		t.Errorf("users: got %d, %v, want 1", n, err)
+	}
+}
+
+func TestAuthSession(t *testing.T) {
+	testAlbumDB(t)
+	ann := testAuthUser(t, "ann", "correct horse", false)
+
+	token, err := authNewSession(ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := authSessionUser(token); err != nil || u == nil || u.ID != ann.ID {
+		t.Fatalf("session: got %+v, %v, want ann", u, err)
+	}
+
+	// only the hash of the token is stored
+	db, err := albumDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err = db.QueryRow(`select count(*) from websession where tokenhash = ?`, token).Scan(&n); err != nil || n != 0 {
+		t.Errorf("token stored as is: %d, %v", n, err)
+	}
+	if u, _ := authSessionUser(authTokenHash(token)); u != nil {
+		t.Errorf("the stored hash works as a token")
+	}
+	if u, _ := authSessionUser("not a token"); u != nil {
+		t.Errorf("unknown token: got %+v", u)
+	}
+
+	// an expired session is refused, and dropped with the next one made
+	past := time.Now().Add(-time.Minute).Unix()
+	if _, err = db.Exec(`update websession set expires = ? where tokenhash = ?`, past, authTokenHash(token)); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := authSessionUser(token); err != nil || u != nil {
+		t.Errorf("expired session: got %+v, %v", u, err)
+	}
+	if _, err = authNewSession(ann); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow(`select count(*) from websession where expires < ?`, time.Now().Unix()).Scan(&n); err != nil || n != 0 {
+		t.Errorf("expired sessions kept: %d, %v", n, err)
+	}
+
+	// ending a session, changing the password or removing the user end it
+	ends := []func(token string) error{
+		authEndSession,
+		func(string) error { return AuthSetUser("ann", "battery staple", false) },
+		func(string) error { _, err := AuthDeleteUser("ann"); return err },
+	}
+	for i, end := range ends {
+		if token, err = authNewSession(ann); err != nil {
+			t.Fatal(err)
+		}
+		if err = end(token); err != nil {
+			t.Fatal(err)
+		}
+		if u, err := authSessionUser(token); err != nil || u != nil {
+			t.Errorf("ended session %d: got %+v, %v", i, u, err)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	testAlbumDB(t)
+	ann := testAuthUser(t, "ann", "correct horse", false)
+	token, err := authNewSession(ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *webUser
+	h := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestUser(r)
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		want   bool
+	}{
+		{"none", "", "", false},
+		{"bearer", "Bearer " + token, "", true},
+		{"bearer lower case", "bearer " + token, "", true},
+		{"bearer unknown", "Bearer 0123", "", false},
+		{"basic", "Basic " + token, "", false},
+		{"token alone", token, "", false},
+		{"cookie", "", token, true},
+		{"cookie unknown", "", "0123", false},
+		{"header before cookie", "Basic x", token, false},
+	}
+	for _, tt := range tests {
+		got = nil
+		r := httptest.NewRequest("GET", "/users/albums", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.cookie})
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if (got != nil) != tt.want || (got != nil && got.ID != ann.ID) {
+			t.Errorf("%s: got %+v, want signed in %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A sign in only goes on to local paths, anything
+// else goes to the albums.
+func TestHandleLoginRedirect(t *testing.T) {
+	testAlbumDB(t)
+	testAuthUser(t, "ann", "correct horse", false)
+
+	for _, v := range []struct{ next, want string }{
+		{"/users/albums/3", "/users/albums/3"},
+		{"/users/photos?path=x", "/users/photos?path=x"},
+		{"", "/users/albums"},
+		{"users/photos", "/users/albums"},
+		{"https://example.com/", "/users/albums"},
+		{"//example.com/", "/users/albums"},
+		{"/\\example.com/", "/users/albums"},
+		{"javascript:alert(1)", "/users/albums"},
+	} {
+		form := url.Values{"username": {"ann"}, "password": {"correct horse"}, "next": {v.next}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		HandleLogin(w, r)
+
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != v.want {
+			t.Errorf("next %q: got %d to %q, want %q", v.next, w.Code, w.Header().Get("Location"), v.want)
+		}
+		if len(w.Result().Cookies()) != 1 {
+			t.Errorf("next %q: no session cookie", v.next)
+		}
+	}
+}
@@ -3,189 +3,559 @@ package main
 
 import (
 	//"bytes"
+	"context"
 	"database/sql"
-	"fmt"
 	"hash/crc32"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/lutfinasution/filebrowser/thumbnail"
 	"github.com/lxn/walk"
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
-const sqlCreateTableCache = `CREATE TABLE IF NOT EXISTS usercache (
-    uid INTEGER PRIMARY KEY AUTOINCREMENT,
-	idpathcrc INTEGER,
-	iditemcrc INTEGER,
-	itemwidth INTEGER,
-	itemheight INTEGER,
-    itemdata BLOB,
-	UNIQUE(idpathcrc, iditemcrc)
-	);
-	`
-const sqlCreateTableAlbum = `CREATE TABLE IF NOT EXISTS useralbum (
-    idalbum INTEGER PRIMARY KEY AUTOINCREMENT,
-	albumname TEXT,
-	albumdesc TEXT,
-    albumdate DATETIME,
-    albumsize INTEGER,
-	albumcover BLOB,
-	UNIQUE(albumname, albumdesc)
-	);
-	`
-const sqlCreateTableAlbumItems = `CREATE TABLE IF NOT EXISTS useralbumitems (
-    iditem INTEGER PRIMARY KEY AUTOINCREMENT,
-	idalbum INTEGER,
-	itemname TEXT,
-	itempath TEXT,
-    itemsize INTEGER,
-    itemdate DATETIME,
-	itemw INTEGER,
-	itemh INTEGER,
-	itemdata BLOB,
-	UNIQUE(idalbum, itemname,itempath)
-	);
-	`
-
 var CacheDB, AlbumDB *sql.DB
 
+// The files CacheDB and AlbumDB were opened from.
+var cacheDBPath, albumDBPath string
+
+// cacheDBMu guards CacheDB and cacheDBPath, albumDBMu AlbumDB and
+// albumDBPath. The store functions take the database once, through
+// cacheDB or albumDB, and work on that: should it be closed in the
+// meantime their queries fail instead of crashing.
+var cacheDBMu, albumDBMu sync.Mutex
+
+// Where cache.db and album.db live, set from the command line, the
+// environment or the settings file. CacheDBName and AlbumDBName name
+// the database files, and either may be MemoryDB. Otherwise the
+// files are put in DBDir, or next to the executable in PortableMode,
+// or under the user's AppData folder.
+var (
+	CacheDBName  string
+	AlbumDBName  string
+	DBDir        string
+	PortableMode bool
+)
+
+// MemoryDB as a database name keeps the database in memory only,
+// it is gone once the app exits.
+const MemoryDB = ":memory:"
+
+// CacheBudget is the number of bytes of thumbnail data usercache
+// may hold before the least recently used rows are evicted.
+// Zero or less disables eviction.
+var CacheBudget int64 = 512 << 20
+
 func crc32FromName(name string) uint32 {
 	return crc32.ChecksumIEEE([]byte(name))
 }
 
-func checkErr(err error) {
+// DBError is the error returned by the cache and album stores.
+type DBError struct {
+	Op  string // the store function that failed
+	Err error  // the underlying database/sql or sqlite3 error
+}
+
+func (e *DBError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Corrupt reports whether the error means the database file is
+// damaged or isn't an sqlite database at all.
+func (e *DBError) Corrupt() bool {
+	if serr, ok := e.Err.(sqlite3.Error); ok {
+		return serr.Code == sqlite3.ErrCorrupt || serr.Code == sqlite3.ErrNotADB
+	}
+	return false
+}
+
+func dbError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*DBError); ok {
+		return err
+	}
+	return &DBError{Op: op, Err: err}
+}
+
+func dbCorrupt(err error) bool {
+	dberr, ok := err.(*DBError)
+	return ok && dberr.Corrupt()
+}
+
+// Reports whether the sqlite3 error err is the violation
+// of a UNIQUE constraint, a row like it exists already.
+func dbUnique(err error) bool {
+	serr, ok := err.(sqlite3.Error)
+	return ok && serr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// Returns the file the database base (cache.db, album.db) is
+// opened from when it is configured as fdbname.
+func dbPath(fdbname, base string) string {
+	switch {
+	case fdbname == MemoryDB:
+		// every connection of the pool must see the same
+		// database, so it is shared by name.
+		return "file:" + strings.TrimSuffix(base, ".db") + "?mode=memory&cache=shared"
+	case fdbname != "":
+		return fdbname
+	case DBDir != "":
+		return filepath.Join(DBDir, base)
+	case PortableMode:
+		if exe, err := os.Executable(); err == nil {
+			return filepath.Join(filepath.Dir(exe), "cache", base)
+		}
+	}
+	spath, _ := walk.AppDataPath() //C:\Users\streaming\AppData\Roaming
+	return filepath.Join(spath, "lutfinas", "GoImageBrowser", "cache", base)
+}
+
+// Opens the sqlite file fdbname and runs setup on it. A corrupt
+// file is quarantined and a fresh database created in its place.
+// fdbname may also be an sqlite "file:" URI, which is opened as is.
+func openDB(fdbname string, setup func(*sql.DB) error) (*sql.DB, error) {
+	if strings.HasPrefix(fdbname, "file:") {
+		return openDBFile(fdbname, setup)
+	}
+	if _, err := os.Stat(fdbname); err != nil {
+		if err = os.MkdirAll(filepath.Dir(fdbname), 0755); err != nil {
+			return nil, dbError("openDB", err)
+		}
+	}
+
+	db, err := openDBFile(fdbname, setup)
+	if err == nil || !dbCorrupt(err) {
+		return db, err
+	}
+	log.Println("db corrupt,", fdbname, err)
+
+	if err = quarantineDB(fdbname); err != nil {
+		return nil, err
+	}
+	return openDBFile(fdbname, setup)
+}
+
+func openDBFile(fdbname string, setup func(*sql.DB) error) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", fdbname)
 	if err != nil {
-		log.Fatal(err)
+		return nil, dbError("openDB", err)
 	}
+	if strings.HasPrefix(fdbname, "file:") {
+		// sqlite drops an in-memory database as soon as its last
+		// connection closes, which the pool may do at any time.
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			db.Close()
+			return nil, dbError("openDB", err)
+		}
+		memDBMu.Lock()
+		memDBConns[db] = conn
+		memDBMu.Unlock()
+	}
+	if err = setup(db); err != nil {
+		closeDB(db)
+		return nil, err
+	}
+	return db, nil
 }
 
-func (sv *ScrollViewer) OpenCacheDB(fdbname string) bool {
-	var err error
+// The connection held open on each database opened from a "file:"
+// URI, for the life of the database, see openDBFile.
+var (
+	memDBMu    sync.Mutex
+	memDBConns = make(map[*sql.DB]*sql.Conn)
+)
 
-	if CacheDB == nil {
-		spath, _ := walk.AppDataPath() //C:\Users\streaming\AppData\Roaming
-		fdbname = filepath.Join(spath, "lutfinas", "GoImageBrowser", "cache", "cache.db")
+// Closes db, along with the connection holding it open, if any.
+func closeDB(db *sql.DB) error {
+	memDBMu.Lock()
+	conn := memDBConns[db]
+	delete(memDBConns, db)
+	memDBMu.Unlock()
 
-		if _, err = os.Stat(fdbname); err != nil {
-			err = os.MkdirAll(filepath.Dir(fdbname), 0644)
-			if err != nil {
-				log.Println("db path create error", filepath.Dir(fdbname))
-				return false
-			}
+	if conn != nil {
+		conn.Close()
+	}
+	return db.Close()
+}
+
+// Moves the database file fdbname, and any journal left next to it,
+// out of the way under a .corrupt-<time> suffix. The file is kept
+// rather than deleted so the data can still be salvaged by hand.
+func quarantineDB(fdbname string) error {
+	suffix := ".corrupt-" + time.Now().Format("20060102-150405")
+
+	for _, ext := range []string{"", "-journal", "-wal", "-shm"} {
+		if _, err := os.Stat(fdbname + ext); err != nil {
+			continue
 		}
+		if err := os.Rename(fdbname+ext, fdbname+ext+suffix); err != nil {
+			return dbError("quarantineDB", err)
+		}
+	}
+	log.Println("db quarantined to", fdbname+suffix)
+	return nil
+}
+
+// Reports whether a cache row recorded for size, modtime and hash
+// still describes the file v. Rows written before the metadata
+// columns existed carry no metadata and are never trusted.
+func cacheRowValid(mkey string, v *FileInfo, size, modtime sql.NullInt64, hash sql.NullString) (valid bool, touched bool) {
+	if !size.Valid || !modtime.Valid {
+		return false, false
+	}
+	if size.Int64 != v.Size {
+		return false, false
+	}
+	if modtime.Int64 == v.Modified.UnixNano() {
+		return true, false
+	}
+	// same size, different mtime: the file may only have been
+	// touched or copied, let the content fingerprint decide.
+	if !hash.Valid || hash.String == "" {
+		return false, false
+	}
+	fp, err := thumbnail.Fingerprint(mkey)
+	if err != nil || fp != hash.String {
+		return false, false
+	}
+	return true, true
+}
+
+// Opens cache.db, creating or migrating usercache as needed.
+// A corrupt cache.db is quarantined and recreated. An empty
+// fdbname opens the configured CacheDBName.
+func (sv *ScrollViewer) OpenCacheDB(fdbname string) error {
+	cacheDBMu.Lock()
+	defer cacheDBMu.Unlock()
 
-		CacheDB, err = sql.Open("sqlite3", fdbname)
-		checkErr(err)
+	if CacheDB != nil {
+		return nil
+	}
+	if fdbname == "" {
+		fdbname = CacheDBName
 	}
+	fdbname = dbPath(fdbname, "cache.db")
 
-	//Create main table if not exists
-	_, err = CacheDB.Exec(sqlCreateTableCache)
-	checkErr(err)
+	db, err := openDB(fdbname, cacheDBSetup)
+	if err != nil {
+		return dbError("OpenCacheDB", err)
+	}
+	CacheDB, cacheDBPath = db, fdbname
 
 	log.Println("db opened", fdbname)
-	return true
+	return nil
+}
+
+func cacheDBSetup(db *sql.DB) error {
+	return migrateDB(db, "cache", cacheMigrations, cacheDBDetectVersion)
+}
+
+// Returns cache.db, nil when it isn't open.
+func cacheDB() *sql.DB {
+	cacheDBMu.Lock()
+	defer cacheDBMu.Unlock()
+	return CacheDB
+}
+
+// Called when a cache store operation failed: the view carries
+// on uncached, and a corrupt cache.db is closed and quarantined
+// so the next OpenCacheDB starts over with a fresh one.
+func (sv *ScrollViewer) cacheDBFailed(err error) {
+	log.Println("cache disabled,", err)
+	sv.doCache = false
+
+	if dbCorrupt(err) {
+		// the lock is held until the file is moved away,
+		// so it isn't opened again in the meantime.
+		cacheDBMu.Lock()
+		if CacheDB != nil {
+			closeDB(CacheDB)
+			CacheDB = nil
+			quarantineDB(cacheDBPath)
+		}
+		cacheDBMu.Unlock()
+	}
+	if sv.cbCached != nil {
+		sv.canvasView.Synchronize(func() {
+			sv.cbCached.SetChecked(false)
+		})
+	}
 }
 
 func (sv *ScrollViewer) CloseCacheDB() bool {
+	cacheDBMu.Lock()
+	defer cacheDBMu.Unlock()
+
 	if CacheDB != nil {
-		CacheDB.Close()
+		closeDB(CacheDB)
 		CacheDB = nil
 	}
 	log.Println("db closed")
 	return true
 }
 
-func (sv *ScrollViewer) CacheDBEnum(fpaths []string) int {
-	if !sv.doCache {
-		return 0
+func (sv *ScrollViewer) CacheDBEnum(fpaths []string) (int, error) {
+	db := cacheDB()
+	if !sv.doCache || db == nil {
+		return 0, nil
 	}
-	var sSql, idpath string
 	var tMatch float64
 
 	t := time.Now()
 
-	if len(fpaths) > 1 {
-		for i := 0; i < len(fpaths); i++ {
-			fpaths[i] = fmt.Sprint(crc32FromName(fpaths[i]))
-		}
-		idpath = "(" + strings.Join(fpaths, ",") + ")"
-
-		sSql = `select idpathcrc, iditemcrc, itemwidth,itemheight,itemdata 
-			 	from usercache where idpathcrc in ` + idpath
-	} else {
-		idpath = fmt.Sprint(crc32FromName(fpaths[0]))
-
-		sSql = `select idpathcrc, iditemcrc, itemwidth,itemheight,itemdata
-				from usercache where idpathcrc = ` + idpath
+	// dirpath matches rows written under the path keys,
+	// idpathcrc matches the rows still waiting to be adopted
+	// from the old crc32 keyed schema.
+	marks := make([]string, len(fpaths))
+	args := make([]interface{}, 0, 2*len(fpaths))
+	for i, v := range fpaths {
+		marks[i] = "?"
+		args = append(args, filepath.Clean(v))
+	}
+	for _, v := range fpaths {
+		args = append(args, crc32FromName(filepath.Clean(v)))
 	}
+	in := "(" + strings.Join(marks, ",") + ")"
+
+	sSql := `select uid, itempath, idpathcrc, iditemcrc, tier, itemwidth,itemheight,itemdata,
+			 itemsize,itemmodtime,itemhash
+			 from usercache where dirpath in ` + in + `
+			 or (itempath is null and idpathcrc in ` + in + `)`
 
-	rows, err := CacheDB.Query(sSql)
+	rows, err := db.Query(sSql, args...)
 	if err != nil {
-		sv.doCache = false
-		return 0
+		return 0, dbError("CacheDBEnum", err)
 	}
 	defer rows.Close()
 
 	tMatch = 0
 
-	// new n improved method using temp keyed map
-	// to store map items for fast record matching.
-	// the map key is set to the to be matched type.
-	matchMap := make(map[uint32]*FileInfo)
-	for k, v := range sv.ItemsMap {
-		matchMap[crc32FromName(k)] = v
-	}
+	// legacy rows are matched on the crc32 of the path.
+	// crcMap lists every key sharing a crc so collisions
+	// can be told apart from genuine matches.
+	var crcMap map[uint32][]string
+
+	var fixes cacheEnumFixes
+
+	// an item may have a row for each tier, keep the
+	// nearest to the one the current item size needs.
+	want := thumbnail.TierFor(sv.itemSize.tw, sv.itemSize.th)
+	picked := make(map[*FileInfo]bool)
 
-	i := 0
+	i, nStale := 0, 0
 	for rows.Next() {
-		var id1, id2, imgw, imgh int
+		var uid int64
+		var ipath sql.NullString
+		var pcrc, icrc sql.NullInt64
+		var itier thumbnail.Tier
+		var imgw, imgh int
 		var imgdata []byte
+		var isize, imodtime sql.NullInt64
+		var ihash sql.NullString
 
-		err = rows.Scan(&id1, &id2, &imgw, &imgh, &imgdata)
+		err = rows.Scan(&uid, &ipath, &pcrc, &icrc, &itier, &imgw, &imgh, &imgdata, &isize, &imodtime, &ihash)
 		if err != nil {
-			log.Fatal(err)
+			return i, dbError("CacheDBEnum", err)
 		}
 
 		t1 := time.Now()
-		//		for k, v := range sv.ItemsMap {
-		//			if crc32FromName(k) == uint32(id2) {
-		//				v.Imagedata = imgdata
-		//				v.thumbW = imgw
-		//				v.thumbH = imgh
-
-		//				i += 1
-		//				break
-		//			}
-		//		}
-
-		// new and improved db rec mapping to mapitems
-		// on 5000+ db rec can save 2+ seconds.
-		if v, ok := matchMap[uint32(id2)]; ok {
+
+		mkey := ipath.String
+		if !ipath.Valid {
+			if crcMap == nil {
+				crcMap = make(map[uint32][]string)
+				for k := range sv.ItemsMap {
+					crcMap[crc32FromName(k)] = append(crcMap[crc32FromName(k)], k)
+				}
+			}
+			var keys []string
+			for _, k := range crcMap[uint32(icrc.Int64)] {
+				if crc32FromName(filepath.Dir(k)) == uint32(pcrc.Int64) {
+					keys = append(keys, k)
+				}
+			}
+			switch len(keys) {
+			case 0:
+				// not one of the items on display
+				tMatch += time.Since(t1).Seconds()
+				continue
+			case 1:
+				mkey = keys[0]
+			default:
+				// crc collision, there's no telling which
+				// item this thumbnail belongs to.
+				log.Println("CacheDBEnum, crc collision", keys)
+				fixes.drop = append(fixes.drop, uid)
+				tMatch += time.Since(t1).Seconds()
+				continue
+			}
+		}
+
+		if v, ok := sv.ItemsMap[mkey]; ok {
+			valid, touch := cacheRowValid(mkey, v, isize, imodtime, ihash)
+			if !valid {
+				// stale row, leave the item to be regenerated
+				if !ipath.Valid {
+					fixes.drop = append(fixes.drop, uid)
+				}
+				nStale += 1
+				tMatch += time.Since(t1).Seconds()
+				continue
+			}
+			if touch {
+				fixes.touched = append(fixes.touched, uid)
+				fixes.modtimes = append(fixes.modtimes, v.Modified.UnixNano())
+			}
+			if !ipath.Valid {
+				fixes.adopt = append(fixes.adopt, uid)
+				fixes.adoptKeys = append(fixes.adoptKeys, mkey)
+			}
+			if picked[v] && !itier.Better(v.tier, want) {
+				tMatch += time.Since(t1).Seconds()
+				continue
+			}
+			if !picked[v] {
+				picked[v] = true
+				i += 1
+			}
 			v.Imagedata = imgdata
 			v.thumbW = imgw
 			v.thumbH = imgh
-			i += 1
+			v.tier = itier
+			v.fingerprint = ihash.String
 		}
 
 		tMatch += time.Since(t1).Seconds()
 	}
 	err = rows.Err()
 	if err != nil {
-		log.Fatal(err)
+		return i, dbError("CacheDBEnum", err)
+	}
+	rows.Close()
+
+	if !fixes.empty() {
+		sv.cacheDBApplyFixes(db, &fixes)
+	}
+	if i > 0 {
+		_, err = db.Exec(`update usercache set lastaccess = ? where dirpath in `+in,
+			append([]interface{}{time.Now().Unix()}, args[:len(fpaths)]...)...)
+		if err != nil {
+			log.Println("CacheDBEnum, lastaccess", err.Error())
+		}
 	}
 
-	log.Println("CacheDBEnum, elapsed", time.Since(t).Seconds(), "TotalMatchTime:", tMatch)
-	return i
+	log.Println("CacheDBEnum, elapsed", time.Since(t).Seconds(), "TotalMatchTime:", tMatch, "stale:", nStale,
+		"adopted:", len(fixes.adopt), "dropped:", len(fixes.drop))
+	return i, nil
 }
-func (sv *ScrollViewer) CacheDBUpdateMapItems(itmap ItmMap, fpaths []string) (resUpdated int64, reFailed int64, result bool) {
 
-	if !sv.doCache || len(itmap) == 0 {
+// Row maintenance found while enumerating, applied
+// once the enumeration query is closed.
+type cacheEnumFixes struct {
+	adopt     []int64  // legacy rows to move to path keys
+	adoptKeys []string // the paths of the adopt rows
+	drop      []int64  // colliding or stale legacy rows
+	touched   []int64  // rows accepted on their fingerprint
+	modtimes  []int64  // the new mtime of the touched rows
+}
+
+func (f *cacheEnumFixes) empty() bool {
+	return len(f.adopt)+len(f.drop)+len(f.touched) == 0
+}
+
+func (sv *ScrollViewer) cacheDBApplyFixes(db *sql.DB, f *cacheEnumFixes) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("cacheDBApplyFixes", err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	for i, uid := range f.adopt {
+		mkey := f.adoptKeys[i]
+
+		// a path keyed row may already exist for the item,
+		// it is more recent than the legacy one.
+		_, err = tx.Exec(`update or ignore usercache set itempath = ?, dirpath = ?, idpathcrc = null, iditemcrc = null
+			 where uid = ?`, mkey, filepath.Dir(mkey), uid)
+		if err == nil {
+			_, err = tx.Exec(`delete from usercache where uid = ? and itempath is null`, uid)
+		}
+		if err != nil {
+			log.Println("cacheDBApplyFixes", err.Error())
+			return
+		}
+	}
+	for _, uid := range f.drop {
+		if _, err = tx.Exec(`delete from usercache where uid = ?`, uid); err != nil {
+			log.Println("cacheDBApplyFixes", err.Error())
+			return
+		}
+	}
+	// refresh the recorded mtime of rows whose file was
+	// only touched, so the fingerprint isn't recomputed
+	// on every visit.
+	for i, uid := range f.touched {
+		if _, err = tx.Exec(`update usercache set itemmodtime = ? where uid = ?`, f.modtimes[i], uid); err != nil {
+			log.Println("cacheDBApplyFixes", err.Error())
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Println("cacheDBApplyFixes", err.Error())
+	}
+}
+
+// Returns the cached thumbnail of mkey of the nearest tier at or
+// above want, if there is a row for it that still matches v.
+func (sv *ScrollViewer) CacheDBGetTier(mkey string, v *FileInfo, want thumbnail.Tier) (*thumbnail.Thumb, thumbnail.Tier, bool) {
+	db := cacheDB()
+	if !sv.doCache || db == nil {
+		return nil, want, false
+	}
+	return cacheDBGetTier(db, mkey, v, want)
+}
+
+func cacheDBGetTier(db *sql.DB, mkey string, v *FileInfo, want thumbnail.Tier) (*thumbnail.Thumb, thumbnail.Tier, bool) {
+	sSql := `select uid, tier, itemwidth, itemheight, itemdata, itemsize, itemmodtime, itemhash
+			 from usercache where itempath = ? and tier >= ?
+			 order by tier limit 1`
+
+	var uid int64
+	var itier thumbnail.Tier
+	var imgw, imgh int
+	var imgdata []byte
+	var isize, imodtime sql.NullInt64
+	var ihash sql.NullString
+
+	err := db.QueryRow(sSql, mkey, want).Scan(&uid, &itier, &imgw, &imgh, &imgdata, &isize, &imodtime, &ihash)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("CacheDBGetTier", err.Error())
+		}
+		return nil, want, false
+	}
+	if valid, _ := cacheRowValid(mkey, v, isize, imodtime, ihash); !valid {
+		return nil, want, false
+	}
+	if _, err = db.Exec(`update usercache set lastaccess = ? where uid = ?`, time.Now().Unix(), uid); err != nil {
+		log.Println("CacheDBGetTier, lastaccess", err.Error())
+	}
+	return &thumbnail.Thumb{Data: imgdata, Width: imgw, Height: imgh, Fingerprint: ihash.String}, itier, true
+}
+
+func (sv *ScrollViewer) CacheDBUpdateMapItems(itmap ItmMap, fpaths []string) (resUpdated int64, reFailed int64, err error) {
+	db := cacheDB()
+	if !sv.doCache || db == nil || len(itmap) == 0 {
 		log.Println("CacheDBUpdateMapItems, exit !sv.doCache || len(itmap) == 0")
-		return 0, 0, false
+		return 0, 0, nil
 	}
 
 	defer func() {
@@ -194,23 +564,30 @@ func (sv *ScrollViewer) CacheDBUpdateMapItems(itmap ItmMap, fpaths []string) (re
 		}
 	}()
 
-	tx, err := CacheDB.Begin()
+	tx, err := db.Begin()
 	if err != nil {
-		log.Fatal(err)
+		return 0, 0, dbError("CacheDBUpdateMapItems", err)
 	}
+	defer tx.Rollback()
 
-	sSql := `INSERT OR REPLACE into usercache(idpathcrc, iditemcrc, itemwidth, itemheight, itemdata) 
-			 values(?, ?, ?, ?, ?);`
+	sSql := `INSERT OR REPLACE into usercache(itempath, dirpath, tier, itemwidth, itemheight, itemdata,
+			 itemsize, itemmodtime, itemhash, lastaccess, imagewidth, imageheight) 
+			 values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
 
 	stmt, err := tx.Prepare(sSql)
 	if err != nil {
-		log.Fatal(err)
+		return 0, 0, dbError("CacheDBUpdateMapItems", err)
 	}
 	defer stmt.Close()
 
 	var res sql.Result
 	var bDoit bool
 
+	// items are only flagged as synched once committed
+	var synched []*FileInfo
+
+	now := time.Now().Unix()
+
 	rcount := int64(0)
 	for k, v := range itmap {
 		if v.dbsynched {
@@ -224,7 +601,7 @@ func (sv *ScrollViewer) CacheDBUpdateMapItems(itmap ItmMap, fpaths []string) (re
 			//bDoit = (filepath.Dir(k) == fpaths)
 			bDoit = false
 			for _, vv := range fpaths {
-				if filepath.Dir(k) == vv {
+				if filepath.Dir(k) == filepath.Clean(vv) {
 					bDoit = true
 					break
 				}
@@ -237,12 +614,12 @@ func (sv *ScrollViewer) CacheDBUpdateMapItems(itmap ItmMap, fpaths []string) (re
 				log.Println("CacheDBUpdateMapItems, skip, item has no data", rcount, v.Name)
 				continue
 			}
-			res, err = stmt.Exec(crc32FromName(filepath.Dir(k)), crc32FromName(k), v.thumbW, v.thumbH, buf)
+			res, err = stmt.Exec(k, filepath.Dir(k), v.tier, v.thumbW, v.thumbH, buf,
+				v.Size, v.Modified.UnixNano(), v.fingerprint, now, v.Width, v.Height)
 			if err != nil {
-				log.Fatal(err)
+				return 0, reFailed, dbError("CacheDBUpdateMapItems", err)
 			}
-			v.Changed = false
-			v.dbsynched = true
+			synched = append(synched, v)
 
 			i, _ := res.RowsAffected()
 			resUpdated += i
@@ -251,27 +628,34 @@ func (sv *ScrollViewer) CacheDBUpdateMapItems(itmap ItmMap, fpaths []string) (re
 
 	err = tx.Commit()
 	if err != nil {
-		log.Fatal(err)
+		return 0, reFailed, dbError("CacheDBUpdateMapItems", err)
+	}
+	for _, v := range synched {
+		v.Changed = false
+		v.dbsynched = true
 	}
-	return resUpdated, reFailed, reFailed == 0
+	return resUpdated, reFailed, nil
 }
 
 func (sv *ScrollViewer) CacheDBUpdateItem(mkey string) error {
-	if !sv.doCache {
+	db := cacheDB()
+	if !sv.doCache || db == nil {
 		return nil
 	}
 
-	tx, err := CacheDB.Begin()
+	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return dbError("CacheDBUpdateItem", err)
 	}
+	defer tx.Rollback()
 
-	sSql := `INSERT OR REPLACE into usercache(idpathcrc, iditemcrc, itemwidth, itemheight, itemdata) 
-			 values(?, ?, ?, ?, ?);`
+	sSql := `INSERT OR REPLACE into usercache(itempath, dirpath, tier, itemwidth, itemheight, itemdata,
+			 itemsize, itemmodtime, itemhash, lastaccess, imagewidth, imageheight) 
+			 values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
 
 	stmt, err := tx.Prepare(sSql)
 	if err != nil {
-		return err
+		return dbError("CacheDBUpdateItem", err)
 	}
 	defer stmt.Close()
 
@@ -280,9 +664,10 @@ func (sv *ScrollViewer) CacheDBUpdateItem(mkey string) error {
 	if v, ok := sv.ItemsMap[mkey]; ok {
 		buf := v.Imagedata
 
-		res, err = stmt.Exec(crc32FromName(filepath.Dir(mkey)), crc32FromName(mkey), v.thumbW, v.thumbH, buf)
+		res, err = stmt.Exec(mkey, filepath.Dir(mkey), v.tier, v.thumbW, v.thumbH, buf,
+			v.Size, v.Modified.UnixNano(), v.fingerprint, time.Now().Unix(), v.Width, v.Height)
 		if err != nil {
-			return err
+			return dbError("CacheDBUpdateItem", err)
 		}
 		rcnt, _ := res.RowsAffected()
 		if rcnt != 0 {
@@ -291,37 +676,49 @@ func (sv *ScrollViewer) CacheDBUpdateItem(mkey string) error {
 	}
 
 	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-
-	return err
+	return dbError("CacheDBUpdateItem", err)
 }
 
 func (sv *ScrollViewer) CacheDBUpdateItemFromBuffer(mkey string, buf []byte, w int, h int) error {
-	if !sv.doCache || buf == nil {
+	db := cacheDB()
+	if !sv.doCache || db == nil || buf == nil {
 		return nil
 	}
+	return cacheDBUpdateFromBuffer(db, mkey, buf, w, h)
+}
 
-	tx, err := CacheDB.Begin()
+func cacheDBUpdateFromBuffer(db *sql.DB, mkey string, buf []byte, w int, h int) error {
+	info, err := os.Stat(mkey)
+	if err != nil {
+		return err
+	}
+	fp, err := thumbnail.Fingerprint(mkey)
 	if err != nil {
 		return err
 	}
 
-	sSql := `INSERT OR REPLACE into usercache(idpathcrc, iditemcrc, itemwidth, itemheight, itemdata) 
-		     values(?, ?, ?, ?, ?);`
+	tx, err := db.Begin()
+	if err != nil {
+		return dbError("CacheDBUpdateItemFromBuffer", err)
+	}
+	defer tx.Rollback()
+
+	sSql := `INSERT OR REPLACE into usercache(itempath, dirpath, tier, itemwidth, itemheight, itemdata,
+		     itemsize, itemmodtime, itemhash, lastaccess) 
+		     values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
 
 	stmt, err := tx.Prepare(sSql)
 	if err != nil {
-		return err
+		return dbError("CacheDBUpdateItemFromBuffer", err)
 	}
 	defer stmt.Close()
 
 	var res sql.Result
 
-	res, err = stmt.Exec(crc32FromName(filepath.Dir(mkey)), crc32FromName(mkey), w, h, buf)
+	res, err = stmt.Exec(mkey, filepath.Dir(mkey), thumbnail.TierFor(w, h), w, h, buf,
+		info.Size(), info.ModTime().UnixNano(), fp, time.Now().Unix())
 	if err != nil {
-		return err
+		return dbError("CacheDBUpdateItemFromBuffer", err)
 	}
 	rcnt, _ := res.RowsAffected()
 	if rcnt != 0 {
@@ -329,338 +726,658 @@ func (sv *ScrollViewer) CacheDBUpdateItemFromBuffer(mkey string, buf []byte, w i
 	}
 
 	err = tx.Commit()
+	return dbError("CacheDBUpdateItemFromBuffer", err)
+}
+
+// Evicts the least recently used rows once the thumbnail data in
+// usercache exceeds CacheBudget, down to 90% of the budget so the
+// next few updates don't trigger another round straight away.
+// Rows that were never accessed, like the ones carried over from
+// the crc32 keyed schema, go first.
+func (sv *ScrollViewer) CacheDBEnforceBudget() (evicted int64, err error) {
+	db := cacheDB()
+	if !sv.doCache || db == nil || CacheBudget <= 0 {
+		return 0, nil
+	}
+
+	var total sql.NullInt64
+	if err = db.QueryRow(`select sum(length(itemdata)) from usercache`).Scan(&total); err != nil {
+		return 0, dbError("CacheDBEnforceBudget", err)
+	}
+	if total.Int64 <= CacheBudget {
+		return 0, nil
+	}
+	excess := total.Int64 - CacheBudget*9/10
+
+	rows, err := db.Query(`select uid, length(itemdata) from usercache
+			 order by ifnull(lastaccess, 0), uid`)
 	if err != nil {
-		return err
+		return 0, dbError("CacheDBEnforceBudget", err)
 	}
+	var uids []int64
+	for freed := int64(0); freed < excess && rows.Next(); {
+		var uid int64
+		var size sql.NullInt64
+		if err = rows.Scan(&uid, &size); err != nil {
+			rows.Close()
+			return 0, dbError("CacheDBEnforceBudget", err)
+		}
+		uids = append(uids, uid)
+		freed += size.Int64
+	}
+	rows.Close()
 
-	return err
+	evicted, err = cacheDBDeleteRows(db, uids)
+	err = dbError("CacheDBEnforceBudget", err)
+	log.Println("CacheDBEnforceBudget, total:", total.Int64, "budget:", CacheBudget, "evicted:", evicted)
+	return evicted, err
 }
 
-//------------------------------------------------
-// ALBUM DB
-//------------------------------------------------
-func OpenAlbumDB(fdbname string) bool {
-	var err error
+// Deletes the rows of items whose source file no longer exists.
+// Legacy crc32 keyed rows can't be checked, they are left to
+// CacheDBEnum or to eviction.
+func (sv *ScrollViewer) CacheDBPrune() (pruned int64, err error) {
+	db := cacheDB()
+	if !sv.doCache || db == nil {
+		return 0, nil
+	}
+
+	rows, err := db.Query(`select uid, itempath, dirpath from usercache
+			 where itempath is not null order by dirpath`)
+	if err != nil {
+		return 0, dbError("CacheDBPrune", err)
+	}
 
-	if AlbumDB == nil {
-		spath, _ := walk.AppDataPath() //C:\Users\streaming\AppData\Roaming
-		fdbname = filepath.Join(spath, "lutfinas", "GoImageBrowser", "cache", "album.db")
+	// a whole folder is dropped at once when it is gone,
+	// without stat'ing each of its items.
+	dirs := make(map[string]bool)
 
-		if _, err = os.Stat(fdbname); err != nil {
-			err = os.MkdirAll(filepath.Dir(fdbname), 0644)
-			if err != nil {
-				log.Println("album db path create error", filepath.Dir(fdbname))
-				return false
+	var uids []int64
+	for rows.Next() {
+		var uid int64
+		var ipath, dpath string
+		if err = rows.Scan(&uid, &ipath, &dpath); err != nil {
+			rows.Close()
+			return 0, dbError("CacheDBPrune", err)
+		}
+		exists, ok := dirs[dpath]
+		if !ok {
+			_, err := os.Stat(dpath)
+			exists = !os.IsNotExist(err)
+			dirs[dpath] = exists
+		}
+		if exists {
+			if _, err := os.Stat(ipath); !os.IsNotExist(err) {
+				continue
 			}
 		}
+		uids = append(uids, uid)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, dbError("CacheDBPrune", err)
+	}
+
+	pruned, err = cacheDBDeleteRows(db, uids)
+	err = dbError("CacheDBPrune", err)
+	log.Println("CacheDBPrune, folders:", len(dirs), "pruned:", pruned)
+	return pruned, err
+}
 
-		AlbumDB, err = sql.Open("sqlite3", fdbname)
-		checkErr(err)
+// Prunes the rows of missing files, enforces the size budget
+// and compacts the database file.
+func (sv *ScrollViewer) CacheDBMaintain() (pruned int64, evicted int64, err error) {
+	db := cacheDB()
+	if !sv.doCache || db == nil {
+		return 0, 0, nil
+	}
+	if pruned, err = sv.CacheDBPrune(); err != nil {
+		return pruned, 0, err
+	}
+	if evicted, err = sv.CacheDBEnforceBudget(); err != nil {
+		return pruned, evicted, err
 	}
 
-	//Create album table if not exists
-	_, err = AlbumDB.Exec(sqlCreateTableAlbum)
-	checkErr(err)
+	t := time.Now()
+	if _, err = db.Exec("VACUUM"); err != nil {
+		return pruned, evicted, dbError("CacheDBMaintain", err)
+	}
+	log.Println("CacheDBMaintain, vacuum elapsed", time.Since(t).Seconds())
+	return pruned, evicted, nil
+}
+
+func cacheDBDeleteRows(db *sql.DB, uids []int64) (int64, error) {
+	if len(uids) == 0 {
+		return 0, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`delete from usercache where uid = ?`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
 
-	//Create items table if not exists
-	_, err = AlbumDB.Exec(sqlCreateTableAlbumItems)
-	checkErr(err)
+	for _, uid := range uids {
+		if _, err = stmt.Exec(uid); err != nil {
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(uids)), nil
+}
+
+//------------------------------------------------
+// ALBUM DB
+//------------------------------------------------
+// Opens album.db, creating or migrating its tables as needed.
+// A corrupt album.db is quarantined and recreated. An empty
+// fdbname opens the configured AlbumDBName.
+func OpenAlbumDB(fdbname string) error {
+	_, err := openAlbumDB(fdbname)
+	return err
+}
+
+// Returns album.db, opening it if it isn't open yet.
+func albumDB() (*sql.DB, error) {
+	return openAlbumDB("")
+}
+
+func openAlbumDB(fdbname string) (*sql.DB, error) {
+	albumDBMu.Lock()
+	defer albumDBMu.Unlock()
+
+	if AlbumDB != nil {
+		return AlbumDB, nil
+	}
+	if fdbname == "" {
+		fdbname = AlbumDBName
+	}
+	fdbname = dbPath(fdbname, "album.db")
+
+	db, err := openDB(fdbname, albumDBSetup)
+	if err != nil {
+		return nil, dbError("OpenAlbumDB", err)
+	}
+	AlbumDB, albumDBPath = db, fdbname
 
 	log.Println("album db opened", fdbname)
-	return true
+	return db, nil
+}
+
+func albumDBSetup(db *sql.DB) error {
+	return migrateDB(db, "album", albumMigrations, albumDBDetectVersion)
+}
+
+// Like dbError, for an operation on album.db db. Should db turn out
+// to be corrupt, it is closed and quarantined, and the next albumDB
+// call starts over with a fresh album.db. The quarantined file keeps
+// the albums for salvaging.
+func albumDBError(db *sql.DB, op string, err error) error {
+	err = dbError(op, err)
+	if !dbCorrupt(err) {
+		return err
+	}
+
+	// the lock is held until the file is moved away,
+	// so it isn't opened again in the meantime.
+	albumDBMu.Lock()
+	defer albumDBMu.Unlock()
+
+	if AlbumDB == db {
+		log.Println("album db corrupt,", err)
+		closeDB(AlbumDB)
+		AlbumDB = nil
+		quarantineDB(albumDBPath)
+	}
+	return err
 }
 
 func (sv *ScrollViewer) CloseAlbumDB() bool {
+	albumDBMu.Lock()
+	defer albumDBMu.Unlock()
+
 	if AlbumDB != nil {
-		AlbumDB.Close()
+		closeDB(AlbumDB)
 		AlbumDB = nil
 	}
 	log.Println("album db closed")
 	return true
 }
 
-func (sv *ScrollViewer) AlbumDBEnum(filter string) int {
+// Adds all albums to the view, parents before their sub-albums, with
+// the items and cover of their sub-albums taken in, see albumTree.
+func (sv *ScrollViewer) AlbumDBEnum(filter string) (int, error) {
+	albums, err := sv.AlbumDBGetAlbums()
+
+	top, _ := albumTree(albums, nil)
+	for _, n := range albumTreeList(top) {
+		v := n.album
+		v.Size, v.Imagedata = n.total, n.cover
+		v.albumPath = n.path()
+		sv.itemsModel.items = append(sv.itemsModel.items, v)
+	}
+	return len(albums), err
+}
+
+// Returns all albums. Size holds the number of items of an album,
+// Imagedata its cover or, failing that, one of its items. Those of
+// its sub-albums aren't counted.
+func (sv *ScrollViewer) AlbumDBGetAlbums() ([]*FileInfo, error) {
+	return albumDBQueryAlbums("AlbumDBGetAlbums", "")
+}
+
+// Returns the album idAlbum, nil if there is none.
+func (sv *ScrollViewer) AlbumDBGetAlbum(idAlbum int) (*FileInfo, error) {
+	res, err := albumDBQueryAlbums("AlbumDBGetAlbum", "where a.idalbum = ?", idAlbum)
+	if len(res) == 0 {
+		return nil, err
+	}
+	return res[0], err
+}
+
+func albumDBQueryAlbums(op string, where string, args ...interface{}) (res []*FileInfo, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return nil, err
+	}
 
-	sSql := `select a.idalbum, a.albumname,a.albumdesc,a.albumdate, 
+	sSql := `select a.idalbum, a.idparent, a.albumname,a.albumdesc,a.albumdate, a.visibility, ifnull(a.smartrule,''),
 			 count(ai.iditem) items, ifnull(a.albumcover,min(ai.itemdata)) image 
 			 from useralbum a left join useralbumitems ai 
 			 on a.idalbum=ai.idalbum 
+			 ` + where + `
 			 group by a.idalbum;`
 
-	rows, err := AlbumDB.Query(sSql)
+	rows, err := db.Query(sSql, args...)
 	if err != nil {
-		log.Println(err.Error())
-		return 0
+		return nil, albumDBError(db, op, err)
 	}
 	defer rows.Close()
 
-	i := 0
 	for rows.Next() {
-		var id int
+		var id, idParent int
 		var data1, data2 string
 		var size int64
 		var date time.Time
+		var vis AlbumVisibility
+		var rule string
 		var imgdata []byte
 
-		err = rows.Scan(&id, &data1, &data2, &date, &size, &imgdata)
+		err = rows.Scan(&id, &idParent, &data1, &data2, &date, &vis, &rule, &size, &imgdata)
+		if err != nil {
+			return res, albumDBError(db, op, err)
+		}
+		smart, err := parseSmartRule(rule)
 		if err != nil {
-			log.Fatal(err)
+			log.Println(op, "album", id, "rule", err)
 		}
 
-		// Create or mod map item
-		sv.itemsModel.items = append(sv.itemsModel.items,
+		res = append(res,
 			&FileInfo{index: id,
-				Name:      data1,
-				URL:       data2,
-				Modified:  date,
-				Size:      size,
-				Imagedata: imgdata,
+				indexParent: idParent,
+				Name:        data1,
+				URL:         data2,
+				Modified:    date,
+				Size:        size,
+				visibility:  vis,
+				smart:       smart,
+				Imagedata:   imgdata,
 			})
-
-		i += 1
 	}
 	err = rows.Err()
-	if err != nil {
-		log.Fatal(err)
-	}
-	return i
+	return res, albumDBError(db, op, err)
 }
-func (sv *ScrollViewer) AlbumDBEnumByNameItems(albumname string) (res []*FileInfo) {
 
-	sSql := `select idalbum from useralbum where albumname='` + albumname + "'"
+// Changes the name and description of the album idAlbum,
+// leaving its cover and items alone. ErrAlbumTaken is returned
+// if its parent already has an album of that name and description.
+func (sv *ScrollViewer) AlbumDBRenameAlbum(idAlbum int, name string, desc string) (rcnt int64, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
+	}
 
-	rows, err := AlbumDB.Query(sSql)
+	res, err := db.Exec(`update useralbum set albumname = ?, albumdesc = ? where idalbum = ?`,
+		name, desc, idAlbum)
+	if dbUnique(err) {
+		return 0, ErrAlbumTaken
+	}
 	if err != nil {
-		log.Println(err.Error())
-		return res
+		return 0, albumDBError(db, "AlbumDBRenameAlbum", err)
 	}
-	defer rows.Close()
+	rcnt, _ = res.RowsAffected()
+	return rcnt, nil
+}
 
-	var id int
-	for rows.Next() {
-		err = rows.Scan(&id)
+// Sets who can see the album idAlbum over http.
+func (sv *ScrollViewer) AlbumDBSetVisibility(idAlbum int, vis AlbumVisibility) (rcnt int64, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
 	}
 
-	return sv.AlbumDBEnumItems(id)
+	res, err := db.Exec(`update useralbum set visibility = ? where idalbum = ?`, vis, idAlbum)
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBSetVisibility", err)
+	}
+	rcnt, _ = res.RowsAffected()
+	return rcnt, nil
 }
 
-func (sv *ScrollViewer) AlbumDBEnumItems(idAlbum int) (res []*FileInfo) {
+// Deletes the album idAlbum along with its items. Its sub-albums
+// move up to its parent; ErrAlbumTaken is returned if one is named
+// like an album there.
+func (sv *ScrollViewer) AlbumDBDeleteAlbum(idAlbum int) (rcnt int64, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBDeleteAlbum", err)
+	}
+	defer tx.Rollback()
 
-	sSql := `select iditem,itemname,itempath,itemw,itemh,itemdata 
-			 from useralbumitems
-			 where idalbum=` + strconv.Itoa(idAlbum)
+	if _, err = tx.Exec(`update useralbum set idparent = (select idparent from useralbum where idalbum = ?) where idparent = ?`,
+		idAlbum, idAlbum); dbUnique(err) {
+		return 0, ErrAlbumTaken
+	} else if err != nil {
+		return 0, albumDBError(db, "AlbumDBDeleteAlbum", err)
+	}
 
-	rows, err := AlbumDB.Query(sSql)
+	if _, err = tx.Exec(`delete from useralbumrelink where iditem in (select iditem from useralbumitems where idalbum = ?)`, idAlbum); err != nil {
+		return 0, albumDBError(db, "AlbumDBDeleteAlbum", err)
+	}
+	if _, err = tx.Exec(`delete from useralbumitems where idalbum = ?`, idAlbum); err != nil {
+		return 0, albumDBError(db, "AlbumDBDeleteAlbum", err)
+	}
+	if _, err = tx.Exec(`delete from useralbumshare where idalbum = ?`, idAlbum); err != nil {
+		return 0, albumDBError(db, "AlbumDBDeleteAlbum", err)
+	}
+	res, err := tx.Exec(`delete from useralbum where idalbum = ?`, idAlbum)
 	if err != nil {
-		log.Println(err.Error())
-		return res
+		return 0, albumDBError(db, "AlbumDBDeleteAlbum", err)
 	}
-	defer rows.Close()
+	rcnt, _ = res.RowsAffected()
 
-	i := 0
-	for rows.Next() {
-		var id, w, h int
-		var data1, data2 string
-		var size int64
-		var date time.Time
-		var imgdata []byte
+	if err = tx.Commit(); err != nil {
+		return 0, albumDBError(db, "AlbumDBDeleteAlbum", err)
+	}
+	return rcnt, nil
+}
 
-		//err = rows.Scan(&id, &data1, &data2, &size, &date, &w, &h, &imgdata)
-		err = rows.Scan(&id, &data1, &data2, &w, &h, &imgdata)
-		if err != nil {
-			log.Fatal(err)
-		}
+// Returns the items of the album idAlbum in order.
+func (sv *ScrollViewer) AlbumDBEnumItems(idAlbum int) (res []*FileInfo, err error) {
+	return albumDBQueryItems("AlbumDBEnumItems", "where idalbum = ?", idAlbum)
+}
 
-		// Create or mod map item
-		res = append(res,
-			&FileInfo{index: id,
-				Name:      data1,
-				URL:       data2,
-				Modified:  date,
-				Size:      size,
-				Width:     w,
-				Height:    h,
-				Imagedata: imgdata,
-			})
+// Returns the items of the album idAlbum called name. Names are
+// only unique per folder, so there may be more than one.
+func (sv *ScrollViewer) AlbumDBFindItems(idAlbum int, name string) (res []*FileInfo, err error) {
+	return albumDBQueryItems("AlbumDBFindItems", "where idalbum = ? and itemname = ?", idAlbum, name)
+}
 
-		i += 1
+// Returns the album item idItem, nil if there is none.
+// Its indexParent is the id of its album.
+func (sv *ScrollViewer) AlbumDBGetItem(idItem int) (*FileInfo, error) {
+	res, err := albumDBQueryItems("AlbumDBGetItem", "where iditem = ?", idItem)
+	if len(res) == 0 {
+		return nil, err
 	}
-	err = rows.Err()
-	if err != nil {
-		log.Fatal(err)
+	return res[0], err
+}
+
+// Returns the item idItem of the album idAlbum, nil if
+// the album has no such item.
+func (sv *ScrollViewer) AlbumDBGetAlbumItem(idAlbum int, idItem int) (*FileInfo, error) {
+	res, err := albumDBQueryItems("AlbumDBGetAlbumItem", "where idalbum = ? and iditem = ?", idAlbum, idItem)
+	if len(res) == 0 {
+		return nil, err
 	}
-	return res
+	return res[0], err
 }
-func (sv *ScrollViewer) AlbumDBGetItem(idItem string) (res *FileInfo) {
 
-	sSql := `select iditem,itemname,itempath,itemw,itemh,itemdata 
+func albumDBQueryItems(op string, where string, args ...interface{}) (res []*FileInfo, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return nil, err
+	}
+
+	sSql := `select iditem,idalbum,itemname,itempath,ifnull(itemsize,0),itemw,itemh,ifnull(itemhash,''),missing,position,itemdata 
 			 from useralbumitems
-			 where itemname='` + idItem + "'"
+			 ` + where + `
+			 order by idalbum, position, iditem`
 
-	rows, err := AlbumDB.Query(sSql)
+	rows, err := db.Query(sSql, args...)
 	if err != nil {
-		log.Println(err.Error())
-		return res
+		return nil, albumDBError(db, op, err)
 	}
 	defer rows.Close()
 
-	i := 0
 	for rows.Next() {
-		var id, w, h int
-		var data1, data2 string
+		var id, idAlbum, w, h, pos int
+		var data1, data2, hash string
 		var size int64
-		var date time.Time
+		var missing bool
 		var imgdata []byte
 
-		err = rows.Scan(&id, &data1, &data2, &w, &h, &imgdata)
+		err = rows.Scan(&id, &idAlbum, &data1, &data2, &size, &w, &h, &hash, &missing, &pos, &imgdata)
 		if err != nil {
-			log.Fatal(err)
+			return res, albumDBError(db, op, err)
 		}
 
-		// Create or mod map item
-		res = &FileInfo{index: id,
-			Name:      data1,
-			URL:       data2,
-			Modified:  date,
-			Size:      size,
-			Width:     w,
-			Height:    h,
-			Imagedata: imgdata,
-		}
-
-		i += 1
+		res = append(res,
+			&FileInfo{index: id,
+				indexParent: idAlbum,
+				Name:        data1,
+				URL:         data2,
+				Size:        size,
+				Width:       w,
+				Height:      h,
+				fingerprint: hash,
+				missing:     missing,
+				position:    pos,
+				Imagedata:   imgdata,
+			})
 	}
 	err = rows.Err()
-	if err != nil {
-		log.Fatal(err)
-	}
-	return res
+	return res, albumDBError(db, op, err)
 }
 
-// Insert or update an album in useralbum.
+// Insert or update an album in useralbum. A new album, index -1,
+// gets its id in item.index. An edit changes the name, description,
+// size and, when item has one, the cover; the date, visibility, rule
+// and parent stay, only AlbumDBSetVisibility, AlbumDBSetSmartRule and
+// AlbumDBMoveAlbum change those. ErrAlbumTaken is returned if the
+// parent already has an album of that name and description.
 func (sv *ScrollViewer) AlbumDBUpdateAlbum(item *FileInfo) (rcnt int64, err error) {
-	if AlbumDB == nil {
-		OpenAlbumDB("")
-	}
-	tx, err := AlbumDB.Begin()
+	db, err := albumDB()
 	if err != nil {
 		return 0, err
 	}
-
-	sSql := `INSERT OR REPLACE into useralbum(albumname, albumdesc, albumdate, albumsize, albumcover) 
-			 values(?, ?, ?, ?, ?);`
-
-	if item.index != -1 {
-		sSql = `INSERT OR REPLACE into useralbum(idalbum, albumname, albumdesc, albumdate, albumsize, albumcover) 
-				values(?, ?, ?, ?, ?, ?);`
-	}
-
-	stmt, err := tx.Prepare(sSql)
+	rule, err := smartRuleValue(item.smart)
 	if err != nil {
 		return 0, err
 	}
-	defer stmt.Close()
 
 	var res sql.Result
-
-	buf := item.Imagedata
-	date := time.Now()
-
 	if item.index == -1 {
-		res, err = stmt.Exec(item.Name, item.URL, date, item.Size, buf)
+		res, err = db.Exec(`insert into useralbum(albumname, albumdesc, albumdate, albumsize, albumcover, visibility, smartrule, idparent)
+				 values(?, ?, ?, ?, ?, ?, ?, ?)`,
+			item.Name, item.URL, time.Now(), item.Size, item.Imagedata, item.visibility, rule, item.indexParent)
 	} else {
-		res, err = stmt.Exec(item.index, item.Name, item.URL, date, item.Size, buf)
+		res, err = db.Exec(`update useralbum set albumname = ?, albumdesc = ?, albumsize = ?, albumcover = ifnull(?, albumcover)
+				 where idalbum = ?`,
+			item.Name, item.URL, item.Size, item.Imagedata, item.index)
+	}
+	if dbUnique(err) {
+		return 0, ErrAlbumTaken
 	}
 	if err != nil {
-		log.Println("AlbumDBUpdateItem", err.Error())
-		return 0, err
+		return 0, albumDBError(db, "AlbumDBUpdateAlbum", err)
 	}
 	rcnt, _ = res.RowsAffected()
-
-	err = tx.Commit()
-	if err != nil {
-		return 0, err
+	if item.index == -1 {
+		if id, err := res.LastInsertId(); err == nil {
+			item.index = int(id)
+		}
 	}
 
 	log.Println("album db upsert: ", rcnt)
-	return rcnt, err
+	return rcnt, nil
 }
 
 // Insert or update an album items in useralbumitems.
 func (sv *ScrollViewer) AlbumDBUpdateItems(idAlbum int, items []*FileInfo) (rcnt int64, err error) {
-	if AlbumDB == nil {
-		OpenAlbumDB("")
-	}
-	tx, err := AlbumDB.Begin()
+	db, err := albumDB()
 	if err != nil {
 		return 0, err
 	}
+	sizes, hashes := albumItemFiles(items)
 
-	sSql := `INSERT OR REPLACE into useralbumitems(idalbum, itemname, itempath, itemw, itemh, itemdata) 
-	         values(?, ?, ?, ?, ?, ?);`
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBUpdateItems", err)
+	}
+	defer tx.Rollback()
 
-	stmt, err := tx.Prepare(sSql)
+	if rcnt, err = albumDBPutItems(tx, idAlbum, items, sizes, hashes); err != nil {
+		return 0, albumDBError(db, "AlbumDBUpdateItems", err)
+	}
+	err = tx.Commit()
 	if err != nil {
-		return 0, err
+		return 0, albumDBError(db, "AlbumDBUpdateItems", err)
 	}
-	defer stmt.Close()
 
-	var res sql.Result
-	var ires int64
-	for _, v := range items {
-		res, err = stmt.Exec(idAlbum, v.Name, v.URL, v.Width, v.Height, v.Imagedata)
-		if err != nil {
-			return 0, err
+	log.Println("album items db upsert: ", rcnt)
+	return rcnt, err
+}
+
+// Returns the sizes and fingerprints of the files of items, which
+// let AlbumDBRelink find the file again should it be moved.
+func albumItemFiles(items []*FileInfo) (sizes []int64, hashes []string) {
+	sizes = make([]int64, len(items))
+	hashes = make([]string, len(items))
+	for i, v := range items {
+		fn := filepath.Join(v.URL, v.Name)
+		if info, err := os.Stat(fn); err == nil {
+			sizes[i] = info.Size()
+		}
+		if hashes[i] = v.fingerprint; hashes[i] == "" {
+			hashes[i], _ = thumbnail.Fingerprint(fn)
 		}
-		rcnt, _ = res.RowsAffected()
-		ires += rcnt
 	}
-	err = tx.Commit()
+	return sizes, hashes
+}
+
+// Writes items to the album idAlbum in tx, with the sizes and
+// hashes albumItemFiles returned for them.
+func albumDBPutItems(tx *sql.Tx, idAlbum int, items []*FileInfo, sizes []int64, hashes []string) (rcnt int64, err error) {
+	// an item already in the album is updated in place,
+	// keeping its iditem for the links made to it.
+	upd, err := tx.Prepare(`update useralbumitems set itemsize = ?, itemw = ?, itemh = ?, itemhash = ?, missing = 0, itemdata = ?
+			 where idalbum = ? and itemname = ? and itempath = ?`)
 	if err != nil {
 		return 0, err
 	}
+	defer upd.Close()
 
-	log.Println("album items db upsert: ", rcnt)
-	return ires, err
+	// new items go to the end of the album
+	ins, err := tx.Prepare(`insert into useralbumitems(idalbum, itemname, itempath, itemsize, itemw, itemh, itemhash, itemdata, position) 
+	         values(?, ?, ?, ?, ?, ?, ?, ?, (select ifnull(max(position) + 1, 0) from useralbumitems where idalbum = ?));`)
+	if err != nil {
+		return 0, err
+	}
+	defer ins.Close()
+
+	for i, v := range items {
+		res, err := upd.Exec(sizes[i], v.Width, v.Height, hashes[i], v.Imagedata, idAlbum, v.Name, v.URL)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		if n == 0 {
+			if res, err = ins.Exec(idAlbum, v.Name, v.URL, sizes[i], v.Width, v.Height, hashes[i], v.Imagedata, idAlbum); err != nil {
+				return 0, err
+			}
+			n, _ = res.RowsAffected()
+		}
+		rcnt += n
+	}
+	return rcnt, nil
 }
 
 func (sv *ScrollViewer) AlbumDBDeleteItems(items []*FileInfo) (rcnt int64, err error) {
-	if AlbumDB == nil {
-		OpenAlbumDB("")
-	}
-	tx, err := AlbumDB.Begin()
+	db, err := albumDB()
 	if err != nil {
 		return 0, err
 	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBDeleteItems", err)
+	}
+	defer tx.Rollback()
 
 	sSql := `delete from useralbumitems where iditem = ?;`
 
 	stmt, err := tx.Prepare(sSql)
 	if err != nil {
-		return 0, err
+		return 0, albumDBError(db, "AlbumDBDeleteItems", err)
 	}
 	defer stmt.Close()
 
+	relinks, err := tx.Prepare(`delete from useralbumrelink where iditem = ?;`)
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBDeleteItems", err)
+	}
+	defer relinks.Close()
+
 	var res sql.Result
 	var ires int64
+	var deleted []*FileInfo
 
 	for _, v := range items {
+		if _, err = relinks.Exec(v.index); err != nil {
+			return 0, albumDBError(db, "AlbumDBDeleteItems", err)
+		}
 		res, err = stmt.Exec(v.index)
 		if err != nil {
-			return 0, err
+			return 0, albumDBError(db, "AlbumDBDeleteItems", err)
 		}
 		rcnt, _ = res.RowsAffected()
 
 		if rcnt > 0 {
-			//change this to indicate deleted item
-			//to be processed in the source object
-			v.index = -1
+			deleted = append(deleted, v)
 		}
 		ires += rcnt
 	}
+
+	// the items behind those deleted move up
+	albums := make(map[int]bool)
+	for _, v := range deleted {
+		if v.indexParent > 0 && !albums[v.indexParent] {
+			albums[v.indexParent] = true
+			if err = albumDBCompact(tx, v.indexParent); err != nil {
+				return 0, albumDBError(db, "AlbumDBDeleteItems", err)
+			}
+		}
+	}
 	err = tx.Commit()
 	if err != nil {
-		return 0, err
+		return 0, albumDBError(db, "AlbumDBDeleteItems", err)
+	}
+	for _, v := range deleted {
+		//change this to indicate deleted item
+		//to be processed in the source object
+		v.index = -1
 	}
 
 	//log.Println("album items db delete: ", rcnt)
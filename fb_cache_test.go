@@ -0,0 +1,358 @@
+// fb_cache_test
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Opens an empty in-memory album.db for the test.
+func testAlbumDB(t *testing.T) *ScrollViewer {
+	sv := &ScrollViewer{}
+	AlbumDBName = MemoryDB
+	if err := OpenAlbumDB(""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sv.CloseAlbumDB()
+		AlbumDBName = ""
+	})
+	return sv
+}
+
+func TestMemoryDBKept(t *testing.T) {
+	sv := testAlbumDB(t)
+
+	item := &FileInfo{index: -1, Name: "kept", URL: "in memory"}
+	if _, err := sv.AlbumDBUpdateAlbum(item); err != nil {
+		t.Fatal(err)
+	}
+
+	// with no idle connections the pool closes every connection
+	// once used, the database must live on regardless.
+	AlbumDB.SetMaxIdleConns(0)
+	for i := 0; i < 3; i++ {
+		v, err := sv.AlbumDBGetAlbum(item.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == nil || v.Name != "kept" {
+			t.Fatalf("album %d lost: %v", item.index, v)
+		}
+	}
+}
+
+// Names that broke, or could abuse, the album queries
+// when they were put together by string concatenation.
+var testHostileNames = []string{
+	"Bob's trip",
+	"'; drop table useralbum; --",
+	"\" or \"1\"=\"1",
+	"100% _real_ \\ photos",
+	"Ferienhaus Müller, Köln",
+	"東京 2017 ☀",
+	"🍣 & 🍜",
+}
+
+func TestAlbumDBNames(t *testing.T) {
+	sv := testAlbumDB(t)
+
+	ids := make(map[string]int)
+	for _, name := range testHostileNames {
+		album := &FileInfo{index: -1, Name: name, URL: "about " + name}
+		if _, err := sv.AlbumDBUpdateAlbum(album); err != nil {
+			t.Fatalf("album %q: %v", name, err)
+		}
+		ids[name] = album.index
+
+		item := &FileInfo{Name: name + ".jpg", URL: filepath.Join("photos", name), Width: 4, Height: 3}
+		if _, err := sv.AlbumDBUpdateItems(album.index, []*FileInfo{item}); err != nil {
+			t.Fatalf("item of %q: %v", name, err)
+		}
+	}
+
+	albums, err := sv.AlbumDBGetAlbums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != len(testHostileNames) {
+		t.Fatalf("%d albums, want %d", len(albums), len(testHostileNames))
+	}
+	byName := make(map[string]*FileInfo)
+	for _, v := range albums {
+		byName[v.Name] = v
+	}
+
+	for _, name := range testHostileNames {
+		v := byName[name]
+		if v == nil {
+			t.Errorf("album %q not listed", name)
+			continue
+		}
+		if v.index != ids[name] || v.URL != "about "+name || v.Size != 1 {
+			t.Errorf("album %q listed as %d %q with %d items", name, v.index, v.URL, v.Size)
+		}
+
+		v, err = sv.AlbumDBGetAlbum(ids[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == nil || v.Name != name {
+			t.Errorf("album %d: got %v, want %q", ids[name], v, name)
+		}
+
+		items, err := sv.AlbumDBFindItems(ids[name], name+".jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 || items[0].URL != filepath.Join("photos", name) {
+			t.Errorf("items of %q named %q: %v", name, name+".jpg", items)
+			continue
+		}
+		if none, _ := sv.AlbumDBFindItems(ids[name], name); len(none) != 0 {
+			t.Errorf("items of %q named %q: %d, want none", name, name, len(none))
+		}
+
+		item, err := sv.AlbumDBGetItem(items[0].index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item == nil || item.Name != name+".jpg" || item.indexParent != ids[name] {
+			t.Errorf("item %d: got %v, want %q in album %d", items[0].index, item, name+".jpg", ids[name])
+		}
+	}
+}
+
+func TestAlbumDBRenameNames(t *testing.T) {
+	sv := testAlbumDB(t)
+
+	album := &FileInfo{index: -1, Name: "plain", URL: ""}
+	if _, err := sv.AlbumDBUpdateAlbum(album); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range testHostileNames {
+		if _, err := sv.AlbumDBRenameAlbum(album.index, name, name); err != nil {
+			t.Fatalf("rename to %q: %v", name, err)
+		}
+		v, err := sv.AlbumDBGetAlbum(album.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == nil || v.Name != name || v.URL != name {
+			t.Errorf("renamed to %q, got %v", name, v)
+		}
+	}
+}
+
+// Creating or renaming an album onto the name of a sibling is
+// refused, the sibling keeps its id, items and date.
+func TestAlbumDBTaken(t *testing.T) {
+	sv := testAlbumDB(t)
+
+	taken := &FileInfo{index: -1, Name: "Holidays", URL: "2017"}
+	other := &FileInfo{index: -1, Name: "Family", URL: "2017"}
+	for _, v := range []*FileInfo{taken, other} {
+		if _, err := sv.AlbumDBUpdateAlbum(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	item := &FileInfo{Name: "a.jpg", URL: "photos", Width: 4, Height: 3}
+	if _, err := sv.AlbumDBUpdateItems(taken.index, []*FileInfo{item}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := sv.AlbumDBGetAlbum(taken.index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = sv.AlbumDBUpdateAlbum(&FileInfo{index: -1, Name: "Holidays", URL: "2017"}); err != ErrAlbumTaken {
+		t.Errorf("new album: got %v, want ErrAlbumTaken", err)
+	}
+	if _, err = sv.AlbumDBUpdateAlbum(&FileInfo{index: other.index, Name: "Holidays", URL: "2017"}); err != ErrAlbumTaken {
+		t.Errorf("edited album: got %v, want ErrAlbumTaken", err)
+	}
+	if _, err = sv.AlbumDBRenameAlbum(other.index, "Holidays", "2017"); err != ErrAlbumTaken {
+		t.Errorf("renamed album: got %v, want ErrAlbumTaken", err)
+	}
+	// under another parent the name is free
+	if _, err = sv.AlbumDBUpdateAlbum(&FileInfo{index: -1, indexParent: other.index, Name: "Holidays", URL: "2017"}); err != nil {
+		t.Errorf("album of another parent: %v", err)
+	}
+
+	v, err := sv.AlbumDBGetAlbum(taken.index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == nil || v.Name != "Holidays" || !v.Modified.Equal(before.Modified) {
+		t.Errorf("album %d: got %v, want it as before", taken.index, v)
+	}
+	if items, err := sv.AlbumDBFindItems(taken.index, "a.jpg"); err != nil || len(items) != 1 {
+		t.Errorf("items of album %d: %d, %v, want 1", taken.index, len(items), err)
+	}
+	if v, _ = sv.AlbumDBGetAlbum(other.index); v == nil || v.Name != "Family" {
+		t.Errorf("album %d: got %v, want Family", other.index, v)
+	}
+}
+
+// Deleting an album whose sub-album is named like an album of its
+// parent fails with ErrAlbumTaken and leaves both where they were.
+func TestAlbumDBDeleteTaken(t *testing.T) {
+	sv := testAlbumDB(t)
+
+	taken := &FileInfo{index: -1, Name: "Holidays", URL: "2017"}
+	other := &FileInfo{index: -1, Name: "Family"}
+	for _, v := range []*FileInfo{taken, other} {
+		if _, err := sv.AlbumDBUpdateAlbum(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub := &FileInfo{index: -1, indexParent: other.index, Name: "Holidays", URL: "2017"}
+	if _, err := sv.AlbumDBUpdateAlbum(sub); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sv.AlbumDBDeleteAlbum(other.index); err != ErrAlbumTaken {
+		t.Errorf("delete album %d: got %v, want ErrAlbumTaken", other.index, err)
+	}
+	if v, _ := sv.AlbumDBGetAlbum(other.index); v == nil {
+		t.Errorf("album %d: deleted, want it kept", other.index)
+	}
+	if v, _ := sv.AlbumDBGetAlbum(sub.index); v == nil || v.indexParent != other.index {
+		t.Errorf("album %d: got %v, want it under %d", sub.index, v, other.index)
+	}
+
+	// with the name free the sub-album moves up
+	if _, err := sv.AlbumDBRenameAlbum(sub.index, "Holidays", "2018"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sv.AlbumDBDeleteAlbum(other.index); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := sv.AlbumDBGetAlbum(sub.index); v == nil || v.indexParent != 0 {
+		t.Errorf("album %d: got %v, want it at the top", sub.index, v)
+	}
+}
+
+// An edit keeps the date, visibility and parent of the album,
+// and its cover unless it brings one.
+func TestAlbumDBUpdateAlbumKeeps(t *testing.T) {
+	sv := testAlbumDB(t)
+
+	parent := &FileInfo{index: -1, Name: "Clients"}
+	if _, err := sv.AlbumDBUpdateAlbum(parent); err != nil {
+		t.Fatal(err)
+	}
+	album := &FileInfo{index: -1, indexParent: parent.index, Name: "Acme", visibility: VisibilityPublic, Imagedata: []byte("cover")}
+	if _, err := sv.AlbumDBUpdateAlbum(album); err != nil {
+		t.Fatal(err)
+	}
+	before, err := sv.AlbumDBGetAlbum(album.index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := album.index
+	if n, err := sv.AlbumDBUpdateAlbum(&FileInfo{index: id, Name: "Acme Corp", URL: "since 2017"}); err != nil || n != 1 {
+		t.Fatalf("edit: %d, %v", n, err)
+	}
+	v, err := sv.AlbumDBGetAlbum(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == nil || v.Name != "Acme Corp" || v.URL != "since 2017" {
+		t.Fatalf("album %d: got %v, want it renamed", id, v)
+	}
+	if !v.Modified.Equal(before.Modified) || v.visibility != VisibilityPublic || v.indexParent != parent.index || string(v.Imagedata) != "cover" {
+		t.Errorf("album %d: date %v, visibility %v, parent %d, cover %q, want %v, %v, %d, cover",
+			id, v.Modified, v.visibility, v.indexParent, v.Imagedata, before.Modified, VisibilityPublic, parent.index)
+	}
+
+	if _, err = sv.AlbumDBUpdateAlbum(&FileInfo{index: id, Name: "Acme Corp", Imagedata: []byte("new")}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ = sv.AlbumDBGetAlbum(id); v == nil || string(v.Imagedata) != "new" {
+		t.Errorf("album %d: cover not changed: %v", id, v)
+	}
+}
+
+func TestAlbumDBRatingPaths(t *testing.T) {
+	sv := testAlbumDB(t)
+
+	for i, name := range testHostileNames {
+		path := filepath.Join("photos", name+".jpg")
+		if err := sv.AlbumDBSetRating(path, i%ratingMax+1); err != nil {
+			t.Fatalf("rating %q: %v", path, err)
+		}
+	}
+	for i, name := range testHostileNames {
+		path := filepath.Join("photos", name+".jpg")
+		if r, err := sv.AlbumDBGetRating(path); err != nil || r != i%ratingMax+1 {
+			t.Errorf("rating of %q: %d, %v, want %d", path, r, err, i%ratingMax+1)
+		}
+	}
+}
+
+// Opens album.db in a temporary folder for the test,
+// returning the folder.
+func testAlbumDBFile(t *testing.T) (*ScrollViewer, string) {
+	sv := &ScrollViewer{}
+	dir := t.TempDir()
+	AlbumDBName = filepath.Join(dir, "album.db")
+	t.Cleanup(func() {
+		sv.CloseAlbumDB()
+		AlbumDBName = ""
+	})
+	return sv, dir
+}
+
+func TestAlbumDBCorruptOnOpen(t *testing.T) {
+	sv, dir := testAlbumDBFile(t)
+
+	if err := ioutil.WriteFile(AlbumDBName, []byte("this is not an sqlite database, not even close"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	albums, err := sv.AlbumDBGetAlbums()
+	if err != nil || len(albums) != 0 {
+		t.Fatalf("fresh album.db: %d albums, %v", len(albums), err)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "album.db.corrupt-*")); len(m) != 1 {
+		t.Errorf("quarantined files: %v", m)
+	}
+}
+
+func TestAlbumDBCorruptAtRuntime(t *testing.T) {
+	sv, dir := testAlbumDBFile(t)
+
+	if _, err := sv.AlbumDBUpdateAlbum(&FileInfo{index: -1, Name: "lost"}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := albumDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = albumDBError(db, "test", sqlite3.Error{Code: sqlite3.ErrCorrupt})
+	if !dbCorrupt(err) {
+		t.Errorf("got %v, want a corrupt DBError", err)
+	}
+	if AlbumDB != nil {
+		t.Errorf("corrupt album.db left open")
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "album.db.corrupt-*")); len(m) != 1 {
+		t.Errorf("quarantined files: %v", m)
+	}
+
+	albums, err := sv.AlbumDBGetAlbums()
+	if err != nil || len(albums) != 0 {
+		t.Fatalf("fresh album.db: %d albums, %v", len(albums), err)
+	}
+
+	// a late error from the old database leaves the new one be
+	albumDBError(db, "test", sqlite3.Error{Code: sqlite3.ErrCorrupt})
+	if AlbumDB == nil {
+		t.Errorf("fresh album.db closed for an error of the old one")
+	}
+}
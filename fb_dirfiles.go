@@ -1,6 +1,7 @@
 package main
 
 import (
+	"image"
 	"log"
 	"os"
 	"path/filepath"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/lutfinasution/filebrowser/thumbnail"
 	"github.com/lxn/walk"
 	. "github.com/lxn/walk/declarative"
 )
@@ -28,10 +30,23 @@ type FileInfo struct {
 	dbsynched      bool
 	Width, Height  int
 	thumbW, thumbH int
+	tier           thumbnail.Tier
 	ModState       string
+	fingerprint    string
+	visibility     AlbumVisibility
+	missing        bool       // album item whose file is gone
+	smart          *SmartRule // rule of a smart album
+	position       int        // of an album item, see AlbumDBMoveItems
+	albumPath      string     // parents of a sub-album, see albumNode.path
 
 	drawRect  walk.Rectangle
 	Imagedata []byte
+
+	// Imagedata resized for the item size scaledFor, kept
+	// while both stay the same, see renderImageBuffer.
+	scaled    *image.RGBA
+	scaledOf  []byte
+	scaledFor walk.Size
 }
 
 func (f FileInfo) HasData() bool {
@@ -324,6 +339,14 @@ func (dm *DirectoryMonitor) FSrenameItem(mkey string) {
 	dm.FSremoveItem(mkey, true)
 }
 
+// The LibraryEvent types of the watcher states.
+var libraryEventType = map[string]string{
+	"create": "created",
+	"modify": "modified",
+	"remove": "removed",
+	"rename": "renamed",
+}
+
 func (dm *DirectoryMonitor) processWatcher() bool {
 	var t time.Time
 	var i int64
@@ -375,6 +398,9 @@ loop:
 			case "rename":
 				dm.FSrenameItem(k)
 			}
+			if typ, ok := libraryEventType[v.ModState]; ok {
+				Events.Publish(typ, k)
+			}
 			delete(dm.watchmap, k)
 		}
 
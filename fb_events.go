@@ -0,0 +1,217 @@
+// fb_events.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventBacklog = 256 // events kept for clients catching up
+	eventQueue   = 64  // events a client may fall behind by
+	eventPing    = 30 * time.Second
+)
+
+// A change to a file of the library, as seen by the DirectoryMonitor
+// (created, modified, removed, renamed) or the ContentMonitor once it
+// has made a new thumbnail (thumbnail). A rename comes as renamed
+// for the old name and created for the new one.
+type LibraryEvent struct {
+	ID   int64     `json:"id"`
+	Type string    `json:"type"`
+	Path string    `json:"path"`
+	Dir  string    `json:"dir"`
+	Time time.Time `json:"time"`
+}
+
+// Passes LibraryEvents on to the http clients following them,
+// and to the functions watching them, see Watch.
+type eventBus struct {
+	mu     sync.Mutex
+	lastID int64
+	recent []LibraryEvent
+	subs   map[chan LibraryEvent]bool
+	funcs  []func(LibraryEvent)
+}
+
+// Events is where the monitors publish their changes.
+var Events = new(eventBus)
+
+func (b *eventBus) Publish(typ string, path string) {
+	b.mu.Lock()
+
+	b.lastID++
+	ev := LibraryEvent{ID: b.lastID, Type: typ, Path: path, Dir: filepath.Dir(path), Time: time.Now()}
+
+	b.recent = append(b.recent, ev)
+	if len(b.recent) > eventBacklog {
+		b.recent = append([]LibraryEvent(nil), b.recent[len(b.recent)-eventBacklog:]...)
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			// too slow, it can catch up from recent when it comes back
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	funcs := b.funcs
+	b.mu.Unlock()
+
+	for _, f := range funcs {
+		f(ev)
+	}
+}
+
+// Has f called with every event published from now on, on the
+// goroutine of the monitor publishing it, so f must not block.
+// Unlike subscribers it is never dropped.
+func (b *eventBus) Watch(f func(LibraryEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.funcs = append(b.funcs, f)
+}
+
+// Returns a channel receiving the events published from now on, and
+// the events after lastID that came before. complete is false when
+// some of those are no longer kept, or lastID is from before the
+// application started. The channel is closed when the subscriber
+// falls too far behind, by CloseSubscribers and by cancel, which
+// must be called when done.
+func (b *eventBus) Subscribe(lastID int64) (ch <-chan LibraryEvent, missed []LibraryEvent, complete bool, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := make(chan LibraryEvent, eventQueue)
+	if b.subs == nil {
+		b.subs = make(map[chan LibraryEvent]bool)
+	}
+	b.subs[c] = true
+
+	complete = true
+	if lastID > 0 {
+		switch {
+		case lastID > b.lastID:
+			complete = false
+		case len(b.recent) > 0 && lastID < b.recent[0].ID-1:
+			complete = false
+		default:
+			for _, v := range b.recent {
+				if v.ID > lastID {
+					missed = append(missed, v)
+				}
+			}
+		}
+	}
+
+	cancel = func() {
+		b.mu.Lock()
+		if b.subs[c] {
+			delete(b.subs, c)
+			close(c)
+		}
+		b.mu.Unlock()
+	}
+	return c, missed, complete, cancel
+}
+
+// Closes the channels of all subscribers, ending their streams.
+// Run on shutdown of the http server, which otherwise waits for them.
+func (b *eventBus) CloseSubscribers() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// GET /api/v1/events streams the LibraryEvents of the ServeRoots as
+// server-sent events, each named after its type with the event as
+// JSON data. The folders watched are those open in the application.
+// With the dir query parameter only the events of that folder are
+// sent. A client reconnecting with Last-Event-ID first gets the
+// events it missed, or a reset event when they are no longer known,
+// after which it should reload whatever it shows.
+func apiGetEvents(w http.ResponseWriter, r *http.Request) {
+	if apiRequireUser(w, r) == nil {
+		return
+	}
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		apiFail(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	dir := r.URL.Query().Get("dir")
+	if dir != "" {
+		var err error
+		if dir, err = sandboxPath(dir); err != nil {
+			apiFail(w, sandboxStatus(err), err.Error())
+			return
+		}
+	}
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	ch, missed, complete, cancel := Events.Subscribe(lastID)
+	defer cancel()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(ev LibraryEvent) error {
+		if (dir != "" && !strings.EqualFold(ev.Dir, dir)) || (dir == "" && !withinRoots(ev.Path)) {
+			return nil
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+		return err
+	}
+
+	fmt.Fprintf(w, "retry: 5000\n\n")
+	if !complete {
+		fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, v := range missed {
+		if send(v) != nil {
+			return
+		}
+	}
+	fl.Flush()
+
+	ping := time.NewTicker(eventPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if send(ev) != nil {
+				return
+			}
+		case <-ping.C:
+			// keeps proxies from dropping an idle stream
+			if _, err := fmt.Fprintf(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		fl.Flush()
+	}
+}
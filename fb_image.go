@@ -11,7 +11,6 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
-	"image/gif"
 	"image/png"
 
 	"io/ioutil"
@@ -34,12 +33,10 @@ import (
 
 import (
 	"github.com/anthonynsimon/bild/transform"
+	"github.com/lutfinasution/filebrowser/thumbnail"
 	"github.com/lxn/walk"
 	"github.com/lxn/win"
 	"github.com/pixiv/go-libjpeg/jpeg"
-	"golang.org/x/image/bmp"
-	"golang.org/x/image/tiff"
-	"golang.org/x/image/webp"
 	//"golang.org/x/image/webp/nycbcra"
 )
 
@@ -216,160 +213,94 @@ func NewProgresDrawer(progresWidget *walk.WidgetBase, maxwidth, maxval int) *Pro
 //}
 
 func getOptimalThumbSize(dstW, dstH, srcW, srcH int) (int, int) {
-	getW := func(h, ws, hs int) int { return int(math.Ceil(float64(h) / float64(hs) * float64(ws))) }
-	getH := func(w, ws, hs int) int { return int(math.Ceil(float64(w) / float64(ws) * float64(hs))) }
-
-	w := 0
-	h := 0
-	if srcW > srcH {
-		w = dstW
-		h = getH(w, srcW, srcH)
-
-		if h > dstH {
-			h = dstH
-			w = getW(h, srcW, srcH)
-		}
-	} else {
-		h = dstH
-		w = getW(h, srcW, srcH)
-		if w > dstW {
-			w = dstW
-			h = getH(w, srcW, srcH)
-		}
-	}
-
-	return w, h
+	return thumbnail.OptimalSize(dstW, dstH, srcW, srcH)
 }
 
-func processImageData(sv *ScrollViewer, mkey string, createthumb bool, imgsize *walk.Size) *image.RGBA {
+// itemsMapCache lets the thumbnailer skip items whose thumbnail
+// data is already in the viewer's ItemsMap, or in the cache db
+// at a large enough tier.
+type itemsMapCache struct {
+	sv *ScrollViewer
+}
 
-	if sv != nil {
-		v, ok := sv.ItemsMap[mkey]
-		if !ok {
-			log.Println("processImageData, invalid key", mkey)
-			return nil
-		}
-		//Skip thumb creation if ItemsMap already has data.
-		//and cache=true
-		//and changed=false
-		if createthumb && sv.doCache && v.HasData() && !v.Changed {
-			v.dbsynched = true
-			return nil
-		}
+func (c itemsMapCache) Lookup(mkey string) (*thumbnail.Thumb, bool) {
+	v, ok := c.sv.ItemsMap[mkey]
+	if !ok || !c.sv.doCache || v.Changed {
+		return nil, false
 	}
-	//log.Println("processImageData/processing: ", mkey)
+	want := c.sv.thumbTier()
 
-	//open
-	file, err := os.Open(mkey)
-	if err != nil {
-		log.Println(err.Error())
-		return nil
+	//Skip thumb creation if ItemsMap already has data
+	//of at least the needed tier
+	if v.HasData() && v.tier >= want {
+		v.dbsynched = true
+		return &thumbnail.Thumb{Data: v.Imagedata, Width: v.thumbW, Height: v.thumbH, Fingerprint: v.fingerprint}, true
 	}
-	defer file.Close()
 
-	var resW, resH int
-
-	if sv != nil {
-		//set desired scaled size
-		resW = sv.itemSize.tw
-		resH = sv.itemSize.th
+	//or the cache db has one
+	if th, tier, ok := c.sv.CacheDBGetTier(mkey, v, want); ok {
+		v.Imagedata = th.Data
+		v.thumbW, v.thumbH = th.Width, th.Height
+		v.tier = tier
+		v.fingerprint = th.Fingerprint
+		v.dbsynched = true
+		return th, true
 	}
+	return nil, false
+}
 
-	if !createthumb {
-		resW = imgsize.Width
-		resH = imgsize.Height
-	}
+// thumbTier returns the thumbnail tier needed
+// for the viewer's current item size.
+func (sv *ScrollViewer) thumbTier() thumbnail.Tier {
+	return thumbnail.TierFor(sv.itemSize.tw, sv.itemSize.th)
+}
 
-	var img image.Image
+// thumbnailer returns a thumbnailer generating thumbnails
+// of the tier needed for the viewer's current item size.
+func (sv *ScrollViewer) thumbnailer() *thumbnail.Thumbnailer {
+	opt := thumbnail.DefaultOptions()
+	opt.Width, opt.Height = sv.thumbTier().Size()
 
-	//Retrieve image dimension, etc based on type
-	switch imgType := filepath.Ext(mkey); imgType {
-	case ".bmp":
-		if img, err = bmp.Decode(file); err != nil {
-			log.Println("processImageData", err.Error())
-			return nil
-		}
-	case ".gif":
-		if img, err = gif.Decode(file); err != nil {
-			log.Println("processImageData", err.Error())
-			return nil
-		}
-	case ".jpg", ".jpeg":
-		jopt := jpeg.DecoderOptions{ScaleTarget: image.Rect(0, 0, resW, resH)}
+	return &thumbnail.Thumbnailer{Options: opt, Cache: itemsMapCache{sv}}
+}
 
-		//if img, err = jpeg.DecodeIntoRGBA(file, &jopt); err != nil {
-		//log.Println("processImageData", err.Error())
-		if img, err = jpeg.Decode(file, &jopt); err != nil {
-			log.Println("processImageData", err.Error())
-			return nil
-		}
+func processImageData(sv *ScrollViewer, mkey string, createthumb bool, imgsize *walk.Size) *image.RGBA {
 
-		//return nil
-		//}
-	case ".png":
-		if img, err = png.Decode(file); err != nil {
-			log.Println("processImageData", err.Error())
-			return nil
-		}
-	case ".tif", ".tiff":
-		if img, err = tiff.Decode(file); err != nil {
-			log.Println("processImageData", err.Error())
-			return nil
-		}
-	case ".webp":
-		if img, err = webp.Decode(file); err != nil {
+	if !createthumb {
+		mt, err := thumbnail.Scale(mkey, imgsize.Width, imgsize.Height, transform.MitchellNetravali)
+		if err != nil {
 			log.Println("processImageData", err.Error())
 			return nil
 		}
+		return mt
 	}
 
-	if img == nil {
+	v, ok := sv.ItemsMap[mkey]
+	if !ok {
+		log.Println("processImageData, invalid key", mkey)
 		return nil
 	}
+	//log.Println("processImageData/processing: ", mkey)
 
-	if img.Bounds().Dx() < 8 {
+	tier := sv.thumbTier()
+	th, err := sv.thumbnailer().Generate(mkey)
+	if err != nil {
+		log.Println("processImageData", mkey, err.Error())
 		return nil
 	}
-
-	var w, h int
-	var mt *image.RGBA
-	//Further scaling ops req to fit the src img
-	//to the desired display size.
-	if createthumb {
-		w, h = getOptimalThumbSize(sv.itemSize.tw, sv.itemSize.th, img.Bounds().Dx(), img.Bounds().Dy())
-		mt = transform.Resize(img, w, h, transform.NearestNeighbor)
-
-		if v, ok := sv.ItemsMap[mkey]; ok {
-
-			//			if imgSz, ero := GetImageInfo(mkey); ero == nil {
-			//				v.Width = imgSz.Width
-			//				v.Height = imgSz.Height
-			//			}
-
-			//Encode the scaled image & save to cache map
-			jept := jpeg.EncoderOptions{Quality: 75, OptimizeCoding: false, DCTMethod: jpeg.DCTIFast}
-			buf := new(bytes.Buffer)
-
-			err = jpeg.Encode(buf, mt, &jept)
-			if err == nil {
-				v.Imagedata = make([]byte, buf.Len())
-				buf.Read(v.Imagedata)
-
-				v.thumbW, v.thumbH = w, h
-				v.Changed = false
-			} else {
-				log.Println("processImageData, unable to encode", mkey)
-				return nil
-			}
-		} else {
-			log.Println("processImageData, invalid key", mkey)
-		}
-	} else {
-		w, h = getOptimalThumbSize(imgsize.Width, imgsize.Height, img.Bounds().Dx(), img.Bounds().Dy())
-		mt = transform.Resize(img, w, h, transform.MitchellNetravali)
+	if th.Image == nil {
+		//served from cache
+		return nil
 	}
 
-	return mt
+	//save to cache map
+	v.Imagedata = th.Data
+	v.thumbW, v.thumbH = th.Width, th.Height
+	v.tier = tier
+	v.fingerprint = th.Fingerprint
+	v.Changed = false
+
+	return th.Image
 }
 
 //func renderImageBuffer(sv *ScrollViewer, mkey string, buf []byte, dst *image.RGBA, x int, y int,
@@ -398,31 +329,42 @@ func renderImageBuffer(sv *ScrollViewer, mkey string, data *FileInfo, dst *image
 		return imgsize, nil
 	}
 
-	//decode
-	//jopt := jpeg.DecoderOptions{ScaleTarget: image.Rect(0, 0, sv.itemSize.tw, sv.itemSize.th)}
-	jopt := jpeg.DecoderOptions{DCTMethod: jpeg.DCTIFast, DisableFancyUpsampling: true, DisableBlockSmoothing: true}
+	// thumbnails come in tier sizes, resizing one to the item
+	// size on every paint would be slow, so the result is kept.
+	itemFor := walk.Size{sv.itemSize.tw, sv.itemSize.th}
+	mt := data.scaled
+	if mt == nil || data.scaledFor != itemFor || !sameBuffer(data.scaledOf, data.Imagedata) {
+		//decode
+		//jopt := jpeg.DecoderOptions{ScaleTarget: image.Rect(0, 0, sv.itemSize.tw, sv.itemSize.th)}
+		jopt := jpeg.DecoderOptions{DCTMethod: jpeg.DCTIFast, DisableFancyUpsampling: true, DisableBlockSmoothing: true}
 
-	//buff := bytes.NewBuffer(buf)
-	buff := bytes.NewBuffer(data.Imagedata)
-	img, err := jpeg.DecodeIntoRGBA(buff, &jopt)
-	if err != nil {
-		return imgsize, err
-	}
-
-	//Further scaling ops req to fit the src img
-	//to the desired display size.
-	w, h := getOptimalThumbSize(sv.itemSize.tw, sv.itemSize.th, img.Bounds().Dx(), img.Bounds().Dy())
-	mt := img
+		//buff := bytes.NewBuffer(buf)
+		buff := bytes.NewBuffer(data.Imagedata)
+		img, err := jpeg.DecodeIntoRGBA(buff, &jopt)
+		if err != nil {
+			return imgsize, err
+		}
 
-	if (img.Bounds().Dx() != w) || (img.Bounds().Dy() != h) {
-		mt = transform.Resize(img, w, h, transform.NearestNeighbor)
+		//Further scaling ops req to fit the src img
+		//to the desired display size.
+		w, h := getOptimalThumbSize(sv.itemSize.tw, sv.itemSize.th, img.Bounds().Dx(), img.Bounds().Dy())
+		mt = img
+		data.scaled, data.scaledOf = nil, nil
 
-		if sv.handleChangedItems {
-			sv.contentMonitor.submitChangedItem(mkey, data)
+		if (img.Bounds().Dx() != w) || (img.Bounds().Dy() != h) {
+			mt = transform.Resize(img, w, h, transform.NearestNeighbor)
+			data.scaled, data.scaledOf, data.scaledFor = mt, data.Imagedata, itemFor
 		}
 	}
-	imgsize.Width = mt.Bounds().Dx()
-	imgsize.Height = mt.Bounds().Dy()
+
+	//only a thumbnail of a smaller tier than needed
+	//must be replaced, larger ones just scale down.
+	if data.scaled != nil && sv.handleChangedItems && data.tier < sv.thumbTier() {
+		sv.contentMonitor.submitResizedItem(mkey, data)
+	}
+	w, h := mt.Bounds().Dx(), mt.Bounds().Dy()
+	imgsize.Width = w
+	imgsize.Height = h
 
 	//centers x,y
 	if doCentered {
@@ -433,7 +375,12 @@ func renderImageBuffer(sv *ScrollViewer, mkey string, data *FileInfo, dst *image
 	}
 	draw.Draw(dst, image.Rect(x, y, x+w, y+h), mt, mt.Bounds().Min, draw.Src)
 
-	return imgsize, err
+	return imgsize, nil
+}
+
+// Reports whether a and b are the same buffer, not just equal.
+func sameBuffer(a, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
 }
 
 func renderBorder(sv *ScrollViewer, dst *image.RGBA, xOffset, yOffset, w, h int) {
@@ -478,48 +425,11 @@ func GetImageInfo(name string) (walk.Size, error) {
 	}
 	defer file.Close()
 
-	imgType := filepath.Ext(name)
-	var imgcfg image.Config
-
 	//Retrieve image dimension, etc based on type
-	switch imgType {
-	case ".bmp":
-		imgcfg, err = bmp.DecodeConfig(file)
-		if err != nil {
-			return w, err
-		}
-	case ".gif":
-		imgcfg, err = gif.DecodeConfig(file)
-		if err != nil {
-			log.Println(err.Error())
-			return w, err
-		}
-	case ".jpg", ".jpeg":
-		imgcfg, err = jpeg.DecodeConfig(file)
-		if err != nil {
-			log.Println(err.Error())
-			return w, err
-		}
-		//log.Println(imgcfg.Width, imgcfg.Height, imgcfg.ColorModel)
-
-	case ".png":
-		imgcfg, err = png.DecodeConfig(file)
-		if err != nil {
-			log.Println(err.Error())
-			return w, err
-		}
-	case ".tif", ".tiff":
-		imgcfg, err = tiff.DecodeConfig(file)
-		if err != nil {
-			log.Println(err.Error())
-			return w, err
-		}
-	case ".webp":
-		imgcfg, err = webp.DecodeConfig(file)
-		if err != nil {
-			log.Println(err.Error())
-			return w, err
-		}
+	imgcfg, err := thumbnail.DecodeConfig(file, filepath.Ext(name))
+	if err != nil {
+		log.Println(err.Error())
+		return w, err
 	}
 
 	w.Width = imgcfg.Width
@@ -1575,7 +1485,11 @@ func drawInfocardAlbumFunc(sv *ScrollViewer, data *FileInfo) {
 
 	var textout []string
 
-	textout = append(textout, data.Name)
+	if data.albumPath != "" {
+		textout = append(textout, data.albumPath+" / "+data.Name)
+	} else {
+		textout = append(textout, data.Name)
+	}
 	textout = append(textout, data.URL)
 	textout = append(textout, data.Modified.Format("Jan 2, 2006 3:04pm"))
 	textout = append(textout, fmt.Sprintf("%d items", data.Size))
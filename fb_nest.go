@@ -0,0 +1,181 @@
+// fb_nest.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+)
+
+// Albums may be put in another album, their parent, to any depth,
+// as in client, project and delivery round. The indexParent of an
+// album is its parent, 0 at the top. The name and description of an
+// album together only need to be unique among the albums of the same
+// parent, two may share a name told apart by their descriptions.
+// An album's item count and cover, as AlbumDBEnum and the http
+// listings show them, take in its sub-albums.
+
+// ErrAlbumTaken is returned when creating, renaming or moving an
+// album, or moving up the sub-albums of a deleted one, next to one
+// with the same name and description.
+var ErrAlbumTaken = errors.New("an album with this name and description exists there")
+
+// ErrAlbumCycle is returned when moving an album
+// into itself or one of its sub-albums.
+var ErrAlbumCycle = errors.New("an album can't be moved into itself or its sub-albums")
+
+var errNoParent = errors.New("the parent album doesn't exist")
+
+// An album with its sub-albums.
+type albumNode struct {
+	album    *FileInfo
+	parent   *albumNode
+	children []*albumNode
+	total    int64  // items in it and its sub-albums
+	cover    []byte // its own, else that of its first sub-album with one
+}
+
+// Returns the path of the parents of the album, "Client / Project",
+// empty for one at the top.
+func (n *albumNode) path() string {
+	var s string
+	for p := n.parent; p != nil; p = p.parent {
+		if s == "" {
+			s = p.album.Name
+		} else {
+			s = p.album.Name + " / " + s
+		}
+	}
+	return s
+}
+
+// Builds the tree of albums, as AlbumDBGetAlbums returns them with
+// their own items and cover, and returns its top albums and all its
+// nodes by album id. keep, if not nil, leaves albums out, their sub-
+// albums going to the nearest album kept above them or to the top.
+func albumTree(albums []*FileInfo, keep func(*FileInfo) bool) (top []*albumNode, nodes map[int]*albumNode) {
+	byID := make(map[int]*FileInfo)
+	for _, v := range albums {
+		byID[v.index] = v
+	}
+	nodes = make(map[int]*albumNode)
+	for _, v := range albums {
+		if keep == nil || keep(v) {
+			nodes[v.index] = &albumNode{album: v}
+		}
+	}
+
+	for _, v := range albums {
+		n := nodes[v.index]
+		if n == nil {
+			continue
+		}
+		// the depth limit guards against a
+		// cycle, which AlbumDBMoveAlbum prevents.
+		p := byID[v.indexParent]
+		for depth := 0; p != nil && nodes[p.index] == nil && depth < len(albums); depth++ {
+			p = byID[p.indexParent]
+		}
+		if p == nil || nodes[p.index] == nil || p == v {
+			top = append(top, n)
+			continue
+		}
+		n.parent = nodes[p.index]
+		n.parent.children = append(n.parent.children, n)
+	}
+
+	var sum func(n *albumNode, depth int)
+	sum = func(n *albumNode, depth int) {
+		n.total = n.album.Size
+		n.cover = n.album.Imagedata
+		if depth > len(albums) {
+			return
+		}
+		for _, c := range n.children {
+			sum(c, depth+1)
+			n.total += c.total
+			if len(n.cover) == 0 {
+				n.cover = c.cover
+			}
+		}
+	}
+	for _, n := range top {
+		sum(n, 0)
+	}
+	return top, nodes
+}
+
+// Returns the albums of the tree top, parents before their sub-albums.
+func albumTreeList(top []*albumNode) []*albumNode {
+	var res []*albumNode
+	var add func(nodes []*albumNode)
+	add = func(nodes []*albumNode) {
+		for _, n := range nodes {
+			res = append(res, n)
+			add(n.children)
+		}
+	}
+	add(top)
+	return res
+}
+
+// Returns the tree of the albums the user u may see.
+func visibleAlbumTree(u *webUser) (top []*albumNode, nodes map[int]*albumNode, err error) {
+	albums, err := Mw.albumView.AlbumDBGetAlbums()
+	if err != nil {
+		return nil, nil, err
+	}
+	top, nodes = albumTree(albums, func(v *FileInfo) bool {
+		return albumVisible(u, v.visibility)
+	})
+	return top, nodes, nil
+}
+
+// Puts the album idAlbum in the album idParent, 0 moving it to the top.
+func (sv *ScrollViewer) AlbumDBMoveAlbum(idAlbum int, idParent int) (rcnt int64, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBMoveAlbum", err)
+	}
+	defer tx.Rollback()
+
+	// the parents of idParent up to the top mustn't include idAlbum
+	for p, depth := idParent, 0; p != 0; depth++ {
+		if p == idAlbum || depth > 1000 {
+			return 0, ErrAlbumCycle
+		}
+		err = tx.QueryRow(`select idparent from useralbum where idalbum = ?`, p).Scan(&p)
+		if err == sql.ErrNoRows {
+			return 0, errNoParent
+		}
+		if err != nil {
+			return 0, albumDBError(db, "AlbumDBMoveAlbum", err)
+		}
+	}
+
+	var n int
+	err = tx.QueryRow(`select count(*) from useralbum a join useralbum b
+			 on a.albumname = b.albumname and a.albumdesc = b.albumdesc
+			 where a.idalbum = ? and b.idparent = ? and b.idalbum <> a.idalbum`, idAlbum, idParent).Scan(&n)
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBMoveAlbum", err)
+	}
+	if n > 0 {
+		return 0, ErrAlbumTaken
+	}
+
+	res, err := tx.Exec(`update useralbum set idparent = ? where idalbum = ?`, idParent, idAlbum)
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBMoveAlbum", err)
+	}
+	rcnt, _ = res.RowsAffected()
+	if err = tx.Commit(); err != nil {
+		return 0, albumDBError(db, "AlbumDBMoveAlbum", err)
+	}
+	log.Println("AlbumDBMoveAlbum", idAlbum, "to", idParent)
+	return rcnt, nil
+}
@@ -0,0 +1,125 @@
+// fb_nest_test
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Makes the albums Client > Project > Round in an empty
+// album.db, and Other at the top, returning them in that order.
+func testAlbumNest(t *testing.T) (*ScrollViewer, []*FileInfo) {
+	sv := testAlbumDB(t)
+
+	var albums []*FileInfo
+	parent := 0
+	for _, name := range []string{"Client", "Project", "Round"} {
+		v := &FileInfo{index: -1, indexParent: parent, Name: name}
+		if _, err := sv.AlbumDBUpdateAlbum(v); err != nil {
+			t.Fatal(err)
+		}
+		albums = append(albums, v)
+		parent = v.index
+	}
+	other := &FileInfo{index: -1, Name: "Other"}
+	if _, err := sv.AlbumDBUpdateAlbum(other); err != nil {
+		t.Fatal(err)
+	}
+	return sv, append(albums, other)
+}
+
+func TestAlbumDBMoveAlbum(t *testing.T) {
+	sv, albums := testAlbumNest(t)
+	client, project, round, other := albums[0], albums[1], albums[2], albums[3]
+
+	// a top album named like a sub-album of Client
+	if _, err := sv.AlbumDBUpdateAlbum(&FileInfo{index: -1, Name: "Project"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		album  int
+		parent int
+		want   error
+	}{
+		{"into itself", client.index, client.index, ErrAlbumCycle},
+		{"into its sub-album", client.index, project.index, ErrAlbumCycle},
+		{"into a deeper sub-album", client.index, round.index, ErrAlbumCycle},
+		{"onto a sibling's name", project.index, 0, ErrAlbumTaken},
+		{"into a missing album", round.index, other.index + 100, errNoParent},
+	}
+	for _, tt := range tests {
+		if n, err := sv.AlbumDBMoveAlbum(tt.album, tt.parent); err != tt.want || n != 0 {
+			t.Errorf("%s: got %d, %v, want %v", tt.name, n, err, tt.want)
+		}
+	}
+
+	// none of them moved anything
+	for _, v := range albums {
+		got, err := sv.AlbumDBGetAlbum(v.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || got.indexParent != v.indexParent {
+			t.Errorf("album %s: got %v, want parent %d", v.Name, got, v.indexParent)
+		}
+	}
+
+	if _, err := sv.AlbumDBMoveAlbum(round.index, other.index); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := sv.AlbumDBGetAlbum(round.index); got == nil || got.indexParent != other.index {
+		t.Errorf("album Round: got %v, want parent %d", got, other.index)
+	}
+}
+
+func TestAlbumTree(t *testing.T) {
+	sv, albums := testAlbumNest(t)
+	client, project, round := albums[0], albums[1], albums[2]
+
+	items := map[*FileInfo][]*FileInfo{
+		client:  {{Name: "c.jpg", URL: "photos"}},
+		project: {{Name: "p1.jpg", URL: "photos", Imagedata: []byte("project")}, {Name: "p2.jpg", URL: "photos"}},
+		round:   {{Name: "r1.jpg", URL: "photos", Imagedata: []byte("round")}, {Name: "r2.jpg", URL: "photos"}, {Name: "r3.jpg", URL: "photos"}},
+	}
+	for album, v := range items {
+		if _, err := sv.AlbumDBUpdateItems(album.index, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := sv.AlbumDBGetAlbums()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top, nodes := albumTree(all, nil)
+	if len(top) != 2 {
+		t.Fatalf("top albums: got %d, want 2", len(top))
+	}
+	if n := nodes[client.index]; n.total != 6 || !bytes.Equal(n.cover, []byte("project")) {
+		t.Errorf("Client: got %d items, cover %q, want 6 and Project's", n.total, n.cover)
+	}
+	if n := nodes[round.index]; n.parent != nodes[project.index] || n.path() != "Client / Project" {
+		t.Errorf("Round: got path %q, want Client / Project", n.path())
+	}
+
+	// with Project hidden Round goes up to Client, which counts
+	// what it can see and takes Round's cover
+	top, nodes = albumTree(all, func(v *FileInfo) bool {
+		return v.index != project.index
+	})
+	if len(top) != 2 || nodes[project.index] != nil {
+		t.Fatalf("top albums: got %d, want 2 with Project left out", len(top))
+	}
+	c := nodes[client.index]
+	if len(c.children) != 1 || c.children[0] != nodes[round.index] {
+		t.Fatalf("Client: got %d sub-albums, want Round alone", len(c.children))
+	}
+	if c.total != 4 || !bytes.Equal(c.cover, []byte("round")) {
+		t.Errorf("Client: got %d items, cover %q, want 4 and Round's", c.total, c.cover)
+	}
+	if p := nodes[round.index].path(); p != "Client" {
+		t.Errorf("Round: got path %q, want Client", p)
+	}
+}
@@ -2,16 +2,27 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lutfinasution/filebrowser/thumbnail"
 )
 
+// The size the web pages link images at, a lot
+// lighter on phones than the originals.
+const netViewSize = "width=1920&height=1920"
+
 //func indexHandler(w http.ResponseWriter, req *http.Request) {
 func HandleDirRequest(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
@@ -21,30 +32,126 @@ func HandleDirRequest(w http.ResponseWriter, req *http.Request) {
 
 	switch name {
 	case "photos":
-		fmt.Fprintf(w, "<!DOCTYPE html>")
-		fmt.Fprintf(w, "<body>")
-		for k, _ := range Mw.thumbView.ItemsMap {
-			k = url.PathEscape(k)
-			fmt.Fprintf(w, "<a href='/users/photos/%s'><img src='/users/photos/%s' alt=Image />", k, k)
-		}
-		fmt.Fprintf(w, "</body>")
-		fmt.Fprintf(w, "</html>")
+		if netRequireUser(w, req) == nil {
+			return
+		}
+		HandlePhotosRequest(w, req)
 	case "albums":
-		Mw.albumView.AlbumDBEnum("")
+		// the top albums, the others are listed in their parents
+		u := requestUser(req)
+		top, _, err := visibleAlbumTree(u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var list []netAlbum
+		for _, n := range top {
+			list = append(list, netAlbumOfNode(n))
+		}
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		pager, first, last := netPaging(page, servePerPage, len(list), func(n int) string {
+			return "/users/albums?page=" + strconv.Itoa(n)
+		})
+
+		netRender(w, http.StatusOK, "albums", struct {
+			netPage
+			Albums []netAlbum
+			Pager  netPager
+		}{netPage{Title: "Albums", User: u}, list[first:last], pager})
+	}
+}
+
+// Returns the album v as the pages show it.
+func netAlbumOf(v *FileInfo) netAlbum {
+	ks := strconv.Itoa(v.index)
+	return netAlbum{
+		Name:        v.Name,
+		Description: v.URL,
+		Date:        v.Modified,
+		Items:       v.Size,
+		Cover:       "/users/album-image/" + ks,
+		URL:         "/users/albums/" + ks,
+	}
+}
+
+// Returns the album of n with the items of its sub-albums counted in.
+func netAlbumOfNode(n *albumNode) netAlbum {
+	a := netAlbumOf(n.album)
+	a.Items = n.total
+	return a
+}
+
+// Browses the ServeRoots: /users/photos lists the roots,
+// /users/photos?path=&page= a page of one of their folders.
+func HandlePhotosRequest(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	dirPath := q.Get("path")
 
-		fmt.Fprintf(w, "<!DOCTYPE html>")
-		fmt.Fprintf(w, "<header>")
-		fmt.Fprintf(w, "<h2>ALBUMS:</h2>")
-		fmt.Fprintf(w, "</header>")
-		fmt.Fprintf(w, "<body>")
-		for k, _ := range Mw.albumView.ItemsMap {
-			ks := url.PathEscape(k)
-			fmt.Fprintf(w, "<a href='/users/albums/%s'><img src='/users/album-image/%s' alt=Image <h4>   %s</h4><br/>", ks, ks, k)
+	if dirPath == "" {
+		var roots []netLink
+		for _, v := range ServeRoots {
+			roots = append(roots, netLink{filepath.Base(v), "/users/photos?path=" + url.QueryEscape(v)})
 		}
-		fmt.Fprintf(w, "</body>")
-		fmt.Fprintf(w, "</html>")
+		netRender(w, http.StatusOK, "folders", struct {
+			netPage
+			Folders []netLink
+		}{netPage{Title: "Folders", User: requestUser(req)}, roots})
+		return
 	}
+
+	page, _ := strconv.Atoi(q.Get("page"))
+
+	dirPath, err := sandboxPath(dirPath)
+	if err != nil {
+		http.Error(w, err.Error(), sandboxStatus(err))
+		return
+	}
+	f, err := serveListFolder(dirPath, page, servePerPage)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	dirq := url.QueryEscape(f.Path)
+
+	// the roots themselves go up to the list of roots
+	up := "/users/photos?path=" + url.QueryEscape(filepath.Dir(f.Path))
+	for _, v := range ServeRoots {
+		if strings.EqualFold(v, f.Path) {
+			up = "/users/photos"
+		}
+	}
+	var folders []netLink
+	for _, v := range f.Folders {
+		folders = append(folders, netLink{v, "/users/photos?path=" + url.QueryEscape(filepath.Join(f.Path, v))})
+	}
+	images := make([]netImage, 0, len(f.Items))
+	for _, v := range f.Items {
+		kq := url.QueryEscape(filepath.Join(v.URL, v.Name))
+		images = append(images, netImage{
+			Name:     v.Name,
+			Thumb:    "/api/v1/thumbnails?path=" + kq,
+			View:     "/api/v1/images?path=" + kq + "&" + netViewSize,
+			Original: "/api/v1/images?path=" + kq,
+		})
+	}
+	pager, _, _ := netPaging(f.Page, f.PerPage, f.Total, func(n int) string {
+		return "/users/photos?path=" + dirq + "&page=" + strconv.Itoa(n)
+	})
+
+	netRender(w, http.StatusOK, "folder", struct {
+		netPage
+		Up      string
+		Folders []netLink
+		Items   []netImage
+		Pager   netPager
+	}{netPage{Title: f.Path, User: requestUser(req)}, up, folders, images, pager})
 }
+
+// Serves the photos thumbnails by path, and the albums by id:
+// albums/{id} the album page, album-image/{id} its cover,
+// albums-zip/{id} its items as a ZIP archive. Album items are
+// served by their own id, albums-thumb/{id} and albums-image/{id}.
 func HandleItemRequest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
@@ -53,80 +160,414 @@ func HandleItemRequest(w http.ResponseWriter, r *http.Request) {
 
 	switch name {
 	case "photos":
+		if requestUser(r) == nil {
+			http.Error(w, "sign in required", http.StatusUnauthorized)
+			return
+		}
 		if item != "" {
-			if v, ok := Mw.thumbView.ItemsMap[item]; ok {
-				w.Header().Set("Content-Type", "image/jpeg")
-				w.Header().Set("Content-Length", fmt.Sprintf("%d", len(v.Imagedata)))
-				w.Write(v.Imagedata)
+			real, err := sandboxPath(item)
+			if err != nil {
+				http.Error(w, err.Error(), sandboxStatus(err))
+				return
+			}
+			th, modified, err := serveThumbnail(real, thumbnail.TierMedium)
+			switch {
+			case err == nil:
+				serveThumbData(w, r, th.Data, modified)
+			case os.IsNotExist(err):
+				http.NotFound(w, r)
+			case err == thumbnail.ErrUnsupported:
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 			}
 		}
 	case "album-image":
 		//useralbum imagedata
 		if item != "" {
-			if v, ok := Mw.albumView.ItemsMap[item]; ok {
-				w.Header().Set("Content-Type", "image/jpeg")
-				w.Header().Set("Content-Length", fmt.Sprintf("%d", len(v.Imagedata)))
-				w.Write(v.Imagedata)
+			u := requestUser(r)
+			v, err := netGetAlbum(u, item)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if v != nil && !v.HasData() {
+				// without items of its own, a sub-album's cover
+				if _, nodes, err := visibleAlbumTree(u); err == nil && nodes[v.index] != nil {
+					v.Imagedata = nodes[v.index].cover
+				}
+			}
+			if v != nil && v.HasData() {
+				serveThumbData(w, r, v.Imagedata, v.Modified)
+			} else {
+				http.NotFound(w, r)
 			}
 		}
 	case "albums":
 		//useralbumitems listing
 		if item != "" {
-			if fi := Mw.albumView.AlbumDBEnumByNameItems(item); fi != nil {
-
-				fmt.Fprintf(w, "<!DOCTYPE html>")
-				fmt.Fprintf(w, "<header>")
-				fmt.Fprintf(w, "<h2>ALBUM: %s</h2>", item)
-				fmt.Fprintf(w, "<h4><a href='/users/albums'>Back to Albums</h4>")
-				fmt.Fprintf(w, "</header>")
-				fmt.Fprintf(w, "<body>")
-
-				for _, v := range fi {
-					ks := url.PathEscape(v.Name)
-					fmt.Fprintf(w, "<a href='/users/albums-image/%s'><img src='/users/albums-thumb/%s' alt=Image />", ks, ks)
+			album, err := netGetAlbum(requestUser(r), item)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if album == nil {
+				http.NotFound(w, r)
+				return
+			}
+			fi, err := Mw.albumView.AlbumDBEnumItems(album.index)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ks := strconv.Itoa(album.index)
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			pager, first, last := netPaging(page, servePerPage, len(fi), func(n int) string {
+				return "/users/albums/" + ks + "?page=" + strconv.Itoa(n)
+			})
+			images := make([]netImage, 0, last-first)
+			for _, v := range fi[first:last] {
+				vs := strconv.Itoa(v.index)
+				images = append(images, netImage{
+					Name:     v.Name,
+					Thumb:    "/users/albums-thumb/" + vs,
+					View:     "/users/albums-image/" + vs + "?" + netViewSize,
+					Original: "/users/albums-image/" + vs,
+				})
+			}
+			a := netAlbumOf(album)
+			a.Items = int64(len(fi))
+
+			var subs []netAlbum
+			_, nodes, err := visibleAlbumTree(requestUser(r))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n := nodes[album.index]; n != nil {
+				for _, c := range n.children {
+					subs = append(subs, netAlbumOfNode(c))
 				}
-				fmt.Fprintf(w, "</body>")
-				fmt.Fprintf(w, "</html>")
 			}
+
+			netRender(w, http.StatusOK, "album", struct {
+				netPage
+				Album   netAlbum
+				Albums  []netAlbum
+				Items   []netImage
+				Pager   netPager
+				ZipURL  string
+				Expires time.Time
+			}{netPage{Title: album.Name, User: requestUser(r)}, a, subs, images, pager, "/users/albums-zip/" + ks, time.Time{}})
+		}
+	case "albums-zip":
+		//useralbumitems as a zip archive
+		if item != "" {
+			album, err := netGetAlbum(requestUser(r), item)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if album == nil {
+				http.NotFound(w, r)
+				return
+			}
+			netServeAlbumZip(w, r, album)
 		}
 	case "albums-thumb":
 		//useralbumitems imagedata
 		if item != "" {
-			if v := Mw.albumView.AlbumDBGetItem(item); v != nil {
-				w.Header().Set("Content-Type", "image/jpeg")
-				w.Header().Set("Content-Length", fmt.Sprintf("%d", len(v.Imagedata)))
-				w.Write(v.Imagedata)
+			v, err := netGetAlbumItem(requestUser(r), item)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if v != nil && v.HasData() {
+				serveThumbData(w, r, v.Imagedata, v.Modified)
+			} else {
+				http.NotFound(w, r)
 			}
 		}
 	case "albums-image":
 		//useralbumitems full image from filesystem
 		if item != "" {
-			if v := Mw.albumView.AlbumDBGetItem(item); v != nil {
-				fn := filepath.Join(v.URL, v.Name)
+			v, err := netGetAlbumItem(requestUser(r), item)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if v == nil {
+				http.NotFound(w, r)
+				return
+			}
+			if albumItemMissing(v) {
+				http.Error(w, errItemMissing.Error(), http.StatusNotFound)
+				return
+			}
+			netServeImage(w, r, filepath.Join(v.URL, v.Name))
+		}
+	}
 
-				if f, err := os.Open(fn); err == nil {
-					defer f.Close()
+}
 
-					info, _ := f.Stat()
-					buff := make([]byte, info.Size())
-					nLen, _ := f.Read(buff)
+// Writes the image file name of an album item, resized if the
+// request has width or height query parameters (see parseVariant).
+func netServeImage(w http.ResponseWriter, r *http.Request, name string) {
+	spec, resize, err := parseVariant(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fn, err := sandboxAlbumPath(name)
+	if err != nil {
+		http.Error(w, err.Error(), sandboxStatus(err))
+		return
+	}
+	if resize {
+		err = serveVariant(w, r, fn, spec)
+	} else {
+		err = serveImageFile(w, r, fn)
+	}
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		http.NotFound(w, r)
+	case err == thumbnail.ErrUnsupported:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-					w.Header().Set("Content-Type", "image/jpeg")
-					w.Header().Set("Content-Length", fmt.Sprintf("%d", nLen))
-					w.Write(buff)
-				}
+// Streams the items of album, or those of the items
+// query parameter, as a ZIP archive.
+func netServeAlbumZip(w http.ResponseWriter, r *http.Request, album *FileInfo) {
+	ids, resize, err := zipParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items, err := Mw.albumView.AlbumDBEnumItems(album.index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if items, err = zipSelectItems(items, ids); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	serveZip(w, r, album.Name, items, resize)
+}
+
+// Returns the album of the id in the path element s if the
+// user u may see it, nil if there is none.
+func netGetAlbum(u *webUser, s string) (*FileInfo, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, nil
+	}
+	v, err := Mw.albumView.AlbumDBGetAlbum(id)
+	if err != nil || v == nil || !albumVisible(u, v.visibility) {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Returns the album item of the id in the path element s if
+// the user u may see its album, nil if there is none.
+func netGetAlbumItem(u *webUser, s string) (*FileInfo, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, nil
+	}
+	v, err := Mw.albumView.AlbumDBGetItem(id)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	album, err := Mw.albumView.AlbumDBGetAlbum(v.indexParent)
+	if err != nil || album == nil || !albumVisible(u, album.visibility) {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Returns the signed in user of the request. Without one
+// the request is sent to the sign in page and nil returned.
+func netRequireUser(w http.ResponseWriter, req *http.Request) *webUser {
+	u := requestUser(req)
+	if u == nil {
+		http.Redirect(w, req, "/login?next="+url.QueryEscape(req.URL.RequestURI()), http.StatusSeeOther)
+	}
+	return u
+}
+
+// GET /login shows the sign in form, POST /login signs
+// in and goes on to the page in next.
+func HandleLogin(w http.ResponseWriter, req *http.Request) {
+	next := req.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/users/albums"
+	}
+
+	status, msg := http.StatusOK, ""
+	if req.Method == "POST" {
+		u, err := authLogin(req.PostFormValue("username"), req.PostFormValue("password"))
+		if err == nil {
+			var token string
+			if token, err = authNewSession(u); err == nil {
+				authSetCookie(w, req, token, int(sessionLifetime/time.Second))
+				http.Redirect(w, req, next, http.StatusSeeOther)
+				return
 			}
 		}
+		if err != ErrBadLogin {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status, msg = http.StatusUnauthorized, err.Error()
 	}
 
+	netRender(w, status, "login", struct {
+		netPage
+		Next    string
+		Message string
+	}{netPage{Title: "Sign in", User: requestUser(req)}, next, msg})
 }
-func StartNet() bool {
+
+// POST /logout ends the session of the request.
+func HandleLogout(w http.ResponseWriter, req *http.Request) {
+	if token := authRequestToken(req); token != "" {
+		if err := authEndSession(token); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	authSetCookie(w, req, "", -1)
+	http.Redirect(w, req, "/login", http.StatusSeeOther)
+}
+
+// Where StartNet listens and with which certificate, set from
+// the settings and the command line. Without a certificate the
+// server speaks plain http, unless NetSelfSigned is set.
+var (
+	NetAddr       = ":8080"
+	NetCertFile   string
+	NetKeyFile    string
+	NetSelfSigned bool
+)
+
+var (
+	netMu     sync.Mutex
+	netServer *http.Server
+)
+
+// Serves the web pages and the API on NetAddr until StopNet is
+// called, returning nil then. Any other error is logged and returned.
+func StartNet() error {
 	r := mux.NewRouter()
+	r.Use(authMiddleware)
 
+	r.HandleFunc("/login", HandleLogin).Methods("GET", "POST")
+	r.HandleFunc("/logout", HandleLogout).Methods("POST")
+	r.HandleFunc("/share/{token}", HandleShareRequest).Methods("GET", "POST")
+	r.HandleFunc("/share/{token}/{kind:thumb|image}/{item:[0-9]+}", HandleShareItemRequest).Methods("GET")
+	r.HandleFunc("/share/{token}/zip", HandleShareZipRequest).Methods("GET")
 	r.HandleFunc("/users/{name}", HandleDirRequest).Methods("GET")
 	r.HandleFunc("/users/{name}/{item}", HandleItemRequest).Methods("GET")
 
-	err := http.ListenAndServe(":8080", r)
+	registerAPI(r)
+
+	if err := LoadTemplates(NetTemplateDir); err != nil {
+		log.Println("StartNet: templates in", NetTemplateDir, err, "- using the built in ones")
+		LoadTemplates("")
+	}
+	if len(ServeRoots) == 0 {
+		log.Println("no folders are served over http, only album items; set them with -serveroots or the ServeRoots setting")
+	}
+	if n, err := AuthCountUsers(); err == nil && n == 0 {
+		log.Println("no web users, only public albums are served; add one with -adduser")
+	}
+
+	certFile, keyFile := NetCertFile, NetKeyFile
+	if (certFile == "") != (keyFile == "") {
+		err := errors.New("a certificate needs both a cert and a key file")
+		log.Println("StartNet", err)
+		return err
+	}
+	if certFile == "" && NetSelfSigned {
+		var err error
+		if certFile, keyFile, err = selfSignedCert(); err != nil {
+			log.Println("StartNet", err)
+			return err
+		}
+	}
+
+	srv := &http.Server{
+		Addr:              NetAddr,
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	// the event streams never end by themselves
+	srv.RegisterOnShutdown(Events.CloseSubscribers)
 
-	return err == nil
+	netMu.Lock()
+	if netServer != nil {
+		netMu.Unlock()
+		return errors.New("StartNet: the server is already running")
+	}
+	netServer = srv
+	netMu.Unlock()
+
+	var err error
+	if certFile != "" {
+		log.Println("serving https on", NetAddr)
+		err = srv.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		log.Println("serving http on", NetAddr)
+		err = srv.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	netMu.Lock()
+	if netServer == srv {
+		netServer = nil
+	}
+	netMu.Unlock()
+
+	log.Println("StartNet", err)
+	return err
+}
+
+// Returns the http or https address other machines
+// reach the server at, for the links it hands out.
+func netBaseURL() string {
+	scheme := "http"
+	if NetCertFile != "" || NetSelfSigned {
+		scheme = "https"
+	}
+	host, port, err := net.SplitHostPort(NetAddr)
+	if err != nil {
+		host, port = "", "8080"
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host, _ = os.Hostname()
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// Stops the server started by StartNet, giving the requests
+// in progress until ctx is done to finish.
+func StopNet(ctx context.Context) error {
+	netMu.Lock()
+	srv := netServer
+	netServer = nil
+	netMu.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
 }
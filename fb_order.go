@@ -0,0 +1,187 @@
+// fb_order.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Album items have a position, 0 for the first, kept without gaps:
+// new items go to the end, and deleting items closes up behind them.
+// AlbumDBEnumItems returns the items in that order, and the custom
+// order sort mode of the thumbnail view shows them that way.
+
+// Returns the ids of the items of the album idAlbum in order.
+func albumDBOrder(tx *sql.Tx, idAlbum int) ([]int, error) {
+	rows, err := tx.Query(`select iditem from useralbumitems where idalbum = ? order by position, iditem`, idAlbum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []int
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, rows.Err()
+}
+
+// Numbers the items ids from 0 in the order given.
+func albumDBRenumber(tx *sql.Tx, ids []int) error {
+	stmt, err := tx.Prepare(`update useralbumitems set position = ? where iditem = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, id := range ids {
+		if _, err = stmt.Exec(i, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Closes up the positions of the items of the album idAlbum.
+func albumDBCompact(tx *sql.Tx, idAlbum int) error {
+	ids, err := albumDBOrder(tx, idAlbum)
+	if err != nil {
+		return err
+	}
+	return albumDBRenumber(tx, ids)
+}
+
+// Returns order with the items ids moved to position pos, in the
+// order given, the other items keeping theirs. A pos past the end,
+// or negative, moves them to the end.
+func albumMoveOrder(order []int, ids []int, pos int) ([]int, error) {
+	moving := make(map[int]bool)
+	var moved []int
+	for _, id := range ids {
+		if !moving[id] {
+			moving[id] = true
+			moved = append(moved, id)
+		}
+	}
+	var rest []int
+	for _, id := range order {
+		if moving[id] {
+			delete(moving, id)
+		} else {
+			rest = append(rest, id)
+		}
+	}
+	for id := range moving {
+		return nil, fmt.Errorf("no item %d in the album", id)
+	}
+
+	if pos < 0 || pos > len(rest) {
+		pos = len(rest)
+	}
+	return append(append(append([]int(nil), rest[:pos]...), moved...), rest[pos:]...), nil
+}
+
+// Moves the items ids of the album idAlbum to position pos,
+// see albumMoveOrder.
+func (sv *ScrollViewer) AlbumDBMoveItems(idAlbum int, ids []int, pos int) error {
+	db, err := albumDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return albumDBError(db, "AlbumDBMoveItems", err)
+	}
+	defer tx.Rollback()
+
+	order, err := albumDBOrder(tx, idAlbum)
+	if err != nil {
+		return albumDBError(db, "AlbumDBMoveItems", err)
+	}
+	if order, err = albumMoveOrder(order, ids, pos); err != nil {
+		return err
+	}
+	if err = albumDBRenumber(tx, order); err != nil {
+		return albumDBError(db, "AlbumDBMoveItems", err)
+	}
+	return albumDBError(db, "AlbumDBMoveItems", tx.Commit())
+}
+
+// Adds items to the album idAlbum like AlbumDBUpdateItems and
+// moves them to position pos, see AlbumDBMoveItems, all in one
+// transaction. Items the album has already are moved as well.
+func (sv *ScrollViewer) AlbumDBInsertItems(idAlbum int, items []*FileInfo, pos int) (rcnt int64, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
+	}
+	sizes, hashes := albumItemFiles(items)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBInsertItems", err)
+	}
+	defer tx.Rollback()
+
+	if rcnt, err = albumDBPutItems(tx, idAlbum, items, sizes, hashes); err != nil {
+		return 0, albumDBError(db, "AlbumDBInsertItems", err)
+	}
+
+	stmt, err := tx.Prepare(`select iditem from useralbumitems where idalbum = ? and itemname = ? and itempath = ?`)
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBInsertItems", err)
+	}
+	defer stmt.Close()
+
+	ids := make([]int, len(items))
+	for i, v := range items {
+		if err = stmt.QueryRow(idAlbum, v.Name, v.URL).Scan(&ids[i]); err != nil {
+			return 0, albumDBError(db, "AlbumDBInsertItems", err)
+		}
+	}
+	order, err := albumDBOrder(tx, idAlbum)
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBInsertItems", err)
+	}
+	if order, err = albumMoveOrder(order, ids, pos); err != nil {
+		return 0, err
+	}
+	if err = albumDBRenumber(tx, order); err != nil {
+		return 0, albumDBError(db, "AlbumDBInsertItems", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, albumDBError(db, "AlbumDBInsertItems", err)
+	}
+	return rcnt, nil
+}
+
+// Reverses the order of the items of the album idAlbum.
+func (sv *ScrollViewer) AlbumDBReverseItems(idAlbum int) error {
+	db, err := albumDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return albumDBError(db, "AlbumDBReverseItems", err)
+	}
+	defer tx.Rollback()
+
+	order, err := albumDBOrder(tx, idAlbum)
+	if err != nil {
+		return albumDBError(db, "AlbumDBReverseItems", err)
+	}
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	if err = albumDBRenumber(tx, order); err != nil {
+		return albumDBError(db, "AlbumDBReverseItems", err)
+	}
+	log.Println("AlbumDBReverseItems", idAlbum, len(order))
+	return albumDBError(db, "AlbumDBReverseItems", tx.Commit())
+}
@@ -0,0 +1,122 @@
+// fb_order_test
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Returns the names of the items of the album idAlbum in order.
+func testAlbumOrder(t *testing.T, sv *ScrollViewer, idAlbum int) string {
+	items, err := sv.AlbumDBEnumItems(idAlbum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range items {
+		names = append(names, strings.TrimSuffix(v.Name, ".jpg"))
+	}
+	return strings.Join(names, " ")
+}
+
+// Makes the album name of the items a to e, returning it
+// and the item ids by name.
+func testAlbumItems(t *testing.T, sv *ScrollViewer, name string) (*FileInfo, map[string]int) {
+	album := &FileInfo{index: -1, Name: name}
+	if _, err := sv.AlbumDBUpdateAlbum(album); err != nil {
+		t.Fatal(err)
+	}
+	var items []*FileInfo
+	for _, n := range []string{"a", "b", "c", "d", "e"} {
+		items = append(items, &FileInfo{Name: n + ".jpg", URL: "photos"})
+	}
+	if _, err := sv.AlbumDBUpdateItems(album.index, items); err != nil {
+		t.Fatal(err)
+	}
+	have, err := sv.AlbumDBEnumItems(album.index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]int)
+	for _, v := range have {
+		ids[strings.TrimSuffix(v.Name, ".jpg")] = v.index
+	}
+	return album, ids
+}
+
+func TestAlbumDBMoveItems(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []string
+		pos   int
+		want  string
+	}{
+		{"to the front", []string{"d"}, 0, "d a b c e"},
+		{"in the order given", []string{"e", "b"}, 1, "a e b c d"},
+		{"duplicate ids", []string{"c", "a", "c"}, 0, "c a b d e"},
+		{"to the end", []string{"a"}, 4, "b c d e a"},
+		{"past the end", []string{"b"}, 99, "a c d e b"},
+		{"negative", []string{"a", "b"}, -1, "c d e a b"},
+		{"in place", []string{"c"}, 2, "a b c d e"},
+	}
+	sv := testAlbumDB(t)
+	for _, tt := range tests {
+		album, ids := testAlbumItems(t, sv, tt.name)
+
+		var move []int
+		for _, name := range tt.items {
+			move = append(move, ids[name])
+		}
+		if err := sv.AlbumDBMoveItems(album.index, move, tt.pos); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := testAlbumOrder(t, sv, album.index); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// An id the album doesn't have fails the move, leaving the order.
+func TestAlbumDBMoveItemsUnknown(t *testing.T) {
+	sv := testAlbumDB(t)
+	album, ids := testAlbumItems(t, sv, "Ordered")
+
+	other := &FileInfo{index: -1, Name: "Other"}
+	if _, err := sv.AlbumDBUpdateAlbum(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sv.AlbumDBUpdateItems(other.index, []*FileInfo{{Name: "x.jpg", URL: "photos"}}); err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := sv.AlbumDBEnumItems(other.index)
+	if err != nil || len(foreign) != 1 {
+		t.Fatalf("album %d: %d items, %v", other.index, len(foreign), err)
+	}
+
+	for _, id := range []int{foreign[0].index, ids["e"] + 100} {
+		err := sv.AlbumDBMoveItems(album.index, []int{ids["b"], id}, 0)
+		if err == nil {
+			t.Errorf("moving item %d: no error", id)
+		} else if _, ok := err.(*DBError); ok {
+			t.Errorf("moving item %d: got %v, want it not found", id, err)
+		}
+	}
+	if got := testAlbumOrder(t, sv, album.index); got != "a b c d e" {
+		t.Errorf("got %q, want the order unchanged", got)
+	}
+}
+
+// New items and ones the album has already both go to pos.
+func TestAlbumDBInsertItems(t *testing.T) {
+	sv := testAlbumDB(t)
+	album, _ := testAlbumItems(t, sv, "Ordered")
+
+	items := []*FileInfo{{Name: "x.jpg", URL: "photos"}, {Name: "d.jpg", URL: "photos"}}
+	if _, err := sv.AlbumDBInsertItems(album.index, items, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := testAlbumOrder(t, sv, album.index); got != "a x d b c e" {
+		t.Errorf("got %q, want %q", got, "a x d b c e")
+	}
+}
@@ -23,6 +23,8 @@ type workinfo struct {
 	name     string
 	item     *FileInfo
 	skipdone bool
+	// if not nil, receives name once its thumbnail is made
+	done chan<- string
 	//	dummy1     bool
 	//	dummy2     bool
 	//	dummy3     bool
@@ -149,7 +151,10 @@ func (ip *ImageProcessor) Run(sv *ScrollViewer, jobList []*FileInfo, dirPaths []
 		t := time.Now()
 
 		//Load data from cache
-		n := sv.CacheDBEnum(dirPaths)
+		n, err := sv.CacheDBEnum(dirPaths)
+		if err != nil {
+			sv.cacheDBFailed(err)
+		}
 
 		log.Println("CacheDBEnum found", n, "in", dirPaths)
 
@@ -213,7 +218,15 @@ func (ip *ImageProcessor) Run(sv *ScrollViewer, jobList []*FileInfo, dirPaths []
 		}
 
 		//update db for items in this path only
-		cntupdated, cntfailed, _ := sv.CacheDBUpdateMapItems(sv.ItemsMap, dirPaths)
+		cntupdated, cntfailed, err := sv.CacheDBUpdateMapItems(sv.ItemsMap, dirPaths)
+		if err != nil {
+			sv.cacheDBFailed(err)
+		}
+		if cntupdated > 0 {
+			if _, err := sv.CacheDBEnforceBudget(); err != nil {
+				log.Println("ImageProcessor.Run, cache budget", err.Error())
+			}
+		}
 
 		if !ip.doCancelation {
 			sv.canvasView.Synchronize(func() {
@@ -244,6 +257,9 @@ func (ip *ImageProcessor) doRenderTasker(sv *ScrollViewer, id int, fnames chan w
 			} else {
 				if processImageData(sv, v.name, true, nil) != nil {
 					atomic.AddUint64(&ip.workCounter, 1)
+					if v.done != nil {
+						v.done <- v.name
+					}
 				}
 			}
 
@@ -288,6 +304,16 @@ func (im *ContentMonitor) removeChangedItems(cmp ItmMap) {
 	}
 }
 func (im *ContentMonitor) submitChangedItem(mkey string, cItm *FileInfo) {
+	im.submitItem(mkey, cItm, true)
+}
+
+// Submits an item whose file didn't change but whose thumbnail
+// is of a smaller tier than the current item size needs.
+func (im *ContentMonitor) submitResizedItem(mkey string, cItm *FileInfo) {
+	im.submitItem(mkey, cItm, false)
+}
+
+func (im *ContentMonitor) submitItem(mkey string, cItm *FileInfo, changed bool) {
 	if im.changeMap == nil {
 		im.changeMap = make(ItmMap)
 	}
@@ -303,7 +329,9 @@ func (im *ContentMonitor) submitChangedItem(mkey string, cItm *FileInfo) {
 		if _, ok := im.doneMap[mkey]; !ok {
 			if _, ok := im.changeMap[mkey]; !ok {
 				im.changeMap[mkey] = cItm
-				im.changeMap[mkey].Changed = true
+				if changed {
+					im.changeMap[mkey].Changed = true
+				}
 
 				log.Println("submitChangedItem: ", mkey)
 			}
@@ -337,6 +365,10 @@ func (im *ContentMonitor) processChangedItem(sv *ScrollViewer, repaint bool) {
 
 			jobStatus := NewProgresDrawer(im.statuswidget.AsWidgetBase(), 100, numItems)
 
+			// the keys whose thumbnail was made anew, room for
+			// all so that the workers never block on it
+			done := make(chan string, numItems)
+
 			if im.imageprocessor.imageWorkChan != nil {
 				im.imageprocessor.workerWaiter.Add(numItems)
 
@@ -347,7 +379,7 @@ func (im *ContentMonitor) processChangedItem(sv *ScrollViewer, repaint bool) {
 					if _, ok := im.doneMap[key]; !ok {
 
 						// send to imageWorkChan to be processed
-						im.imageprocessor.imageWorkChan[0] <- workinfo{name: key}
+						im.imageprocessor.imageWorkChan[0] <- workinfo{name: key, done: done}
 
 						// create a new done map item
 						im.itmMutex.Lock()
@@ -368,12 +400,20 @@ func (im *ContentMonitor) processChangedItem(sv *ScrollViewer, repaint bool) {
 				im.imageprocessor.workerWaiter.Wait()
 			}
 			if numItems > 0 {
-				nUpdated, nFailed, _ := sv.CacheDBUpdateMapItems(im.doneMap, []string{""})
+				nUpdated, nFailed, err := sv.CacheDBUpdateMapItems(im.doneMap, []string{""})
+				if err != nil {
+					sv.cacheDBFailed(err)
+				}
 
 				im.itmMutex.Lock()
 				im.removeChangedItems(im.changeMap)
 				im.itmMutex.Unlock()
 
+				close(done)
+				for key := range done {
+					Events.Publish("thumbnail", key)
+				}
+
 				if repaint && ires+1 > 0 {
 					if im.infofunc != nil {
 						im.infofunc()
@@ -0,0 +1,368 @@
+// fb_relink.go
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lutfinasution/filebrowser/thumbnail"
+)
+
+// Album items point at their files by folder and name, which breaks
+// as soon as the files are moved. AlbumDBRelink looks for the files
+// of missing items by name in the RelinkRoots, or the ServeRoots if
+// none are set. A single candidate of the same size and fingerprint
+// is relinked right away, other candidates are kept for a user to
+// confirm with AlbumDBRelinkItem or dismiss.
+var RelinkRoots []string
+
+// ErrRelinkTaken is returned when relinking an item to a
+// file its album has already.
+var ErrRelinkTaken = errors.New("the album has an item for that file already")
+
+// Served in place of the image of a missing album item.
+var errItemMissing = errors.New("the file of this album item is missing, it may have been moved")
+
+// The outcome of an AlbumDBRelink run.
+type RelinkResult struct {
+	Checked  int `json:"checked"`  // album items
+	Missing  int `json:"missing"`  // of those, missing before the run
+	Relinked int `json:"relinked"` // found again and relinked
+	Pending  int `json:"pending"`  // with candidates to confirm
+}
+
+// A file a missing album item may have moved to.
+type relinkCandidate struct {
+	ItemID int
+	Path   string
+	ByHash bool // same size and fingerprint
+	Found  time.Time
+}
+
+// one AlbumDBRelink at a time
+var relinkMu sync.Mutex
+
+func relinkRoots() []string {
+	if len(RelinkRoots) > 0 {
+		return RelinkRoots
+	}
+	return ServeRoots
+}
+
+// Checks the files of all album items, flags those missing and
+// searches the relink roots for them.
+func (sv *ScrollViewer) AlbumDBRelink() (res RelinkResult, err error) {
+	relinkMu.Lock()
+	defer relinkMu.Unlock()
+
+	items, err := albumDBQueryItems("AlbumDBRelink", "")
+	if err != nil {
+		return res, err
+	}
+	res.Checked = len(items)
+
+	// found are the items that are back, or were
+	// added before fingerprints were kept.
+	var missing, found []*FileInfo
+	for _, v := range items {
+		_, err := os.Stat(filepath.Join(v.URL, v.Name))
+		switch {
+		case os.IsNotExist(err):
+			missing = append(missing, v)
+		case err == nil && (v.missing || v.fingerprint == ""):
+			found = append(found, v)
+		}
+	}
+	res.Missing = len(missing)
+	if err = albumDBMarkItems(missing, found); err != nil {
+		return res, err
+	}
+
+	if len(missing) > 0 {
+		index := relinkIndex(relinkRoots(), missing)
+
+		for _, v := range missing {
+			byHash, byName := relinkMatch(v, index[strings.ToLower(v.Name)])
+			if len(byHash) == 1 {
+				_, err := sv.AlbumDBRelinkItem(v.index, byHash[0])
+				if err == nil {
+					res.Relinked++
+					continue
+				}
+				log.Println("AlbumDBRelink", v.index, byHash[0], err)
+			}
+			if len(byHash)+len(byName) == 0 {
+				continue
+			}
+			if err = albumDBAddCandidates(v.index, byHash, byName); err != nil {
+				return res, err
+			}
+			res.Pending++
+		}
+	}
+
+	// candidates of items that are no longer missing
+	db, err := albumDB()
+	if err != nil {
+		return res, err
+	}
+	_, err = db.Exec(`delete from useralbumrelink
+			 where iditem not in (select iditem from useralbumitems where missing = 1)`)
+	log.Println("AlbumDBRelink", res.Checked, "items,", res.Missing, "missing,",
+		res.Relinked, "relinked,", res.Pending, "pending")
+	return res, albumDBError(db, "AlbumDBRelink", err)
+}
+
+// Flags the items missing, and the items found as present,
+// storing the size and fingerprint of their files.
+func albumDBMarkItems(missing []*FileInfo, found []*FileInfo) error {
+	type fileSum struct {
+		size int64
+		hash string
+	}
+	sums := make([]fileSum, len(found))
+	for i, v := range found {
+		fn := filepath.Join(v.URL, v.Name)
+		if info, err := os.Stat(fn); err == nil {
+			sums[i].size = info.Size()
+		}
+		sums[i].hash, _ = thumbnail.Fingerprint(fn)
+	}
+
+	db, err := albumDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return albumDBError(db, "albumDBMarkItems", err)
+	}
+	defer tx.Rollback()
+
+	for _, v := range missing {
+		if _, err = tx.Exec(`update useralbumitems set missing = 1 where iditem = ?`, v.index); err != nil {
+			return albumDBError(db, "albumDBMarkItems", err)
+		}
+		v.missing = true
+	}
+	for i, v := range found {
+		_, err = tx.Exec(`update useralbumitems set missing = 0, itemsize = ?, itemhash = ? where iditem = ?`,
+			sums[i].size, sums[i].hash, v.index)
+		if err != nil {
+			return albumDBError(db, "albumDBMarkItems", err)
+		}
+		v.missing = false
+	}
+	return albumDBError(db, "albumDBMarkItems", tx.Commit())
+}
+
+// Returns the supported image files under roots with the names of
+// the items missing, by lower case name. Folders that can't be read
+// are left out.
+func relinkIndex(roots []string, missing []*FileInfo) map[string][]string {
+	res := make(map[string][]string)
+	for _, v := range missing {
+		res[strings.ToLower(v.Name)] = nil
+	}
+
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Println("relinkIndex", err)
+				return nil
+			}
+			name := info.Name()
+			if info.IsDir() {
+				if path != root && shouldExclude(name) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			key := strings.ToLower(name)
+			if paths, ok := res[key]; ok && thumbnail.Supported(filepath.Ext(name)) {
+				res[key] = append(paths, path)
+			}
+			return nil
+		})
+	}
+	return res
+}
+
+// Sorts the files at paths into those matching the size and
+// fingerprint of the item v and, for an item without a fingerprint,
+// those that only share its name and size.
+func relinkMatch(v *FileInfo, paths []string) (byHash []string, byName []string) {
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil || (v.Size > 0 && info.Size() != v.Size) {
+			continue
+		}
+		if v.fingerprint == "" {
+			byName = append(byName, p)
+			continue
+		}
+		if fp, err := thumbnail.Fingerprint(p); err == nil && fp == v.fingerprint {
+			byHash = append(byHash, p)
+		}
+	}
+	return byHash, byName
+}
+
+func albumDBAddCandidates(idItem int, byHash []string, byName []string) error {
+	db, err := albumDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return albumDBError(db, "albumDBAddCandidates", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE into useralbumrelink(iditem, newpath, byhash, found) values(?, ?, ?, ?)`)
+	if err != nil {
+		return albumDBError(db, "albumDBAddCandidates", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now().Unix()
+	for _, p := range byHash {
+		if _, err = stmt.Exec(idItem, p, true, now); err != nil {
+			return albumDBError(db, "albumDBAddCandidates", err)
+		}
+	}
+	for _, p := range byName {
+		if _, err = stmt.Exec(idItem, p, false, now); err != nil {
+			return albumDBError(db, "albumDBAddCandidates", err)
+		}
+	}
+	return albumDBError(db, "albumDBAddCandidates", tx.Commit())
+}
+
+// Points the album item idItem at the file path, which must exist,
+// and drops its candidates.
+func (sv *ScrollViewer) AlbumDBRelinkItem(idItem int, path string) (rcnt int64, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() {
+		return 0, &os.PathError{Op: "relink", Path: path, Err: errors.New("is a folder")}
+	}
+	hash, err := thumbnail.Fingerprint(path)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBRelinkItem", err)
+	}
+	defer tx.Rollback()
+
+	name, dir := filepath.Base(path), filepath.Dir(path)
+
+	var n int
+	err = tx.QueryRow(`select count(*) from useralbumitems
+			 where idalbum = (select idalbum from useralbumitems where iditem = ?)
+			 and itemname = ? and itempath = ? and iditem <> ?`, idItem, name, dir, idItem).Scan(&n)
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBRelinkItem", err)
+	}
+	if n > 0 {
+		return 0, ErrRelinkTaken
+	}
+
+	res, err := tx.Exec(`update useralbumitems set itemname = ?, itempath = ?, itemsize = ?, itemhash = ?, missing = 0
+			 where iditem = ?`, name, dir, info.Size(), hash, idItem)
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBRelinkItem", err)
+	}
+	rcnt, _ = res.RowsAffected()
+
+	if _, err = tx.Exec(`delete from useralbumrelink where iditem = ?`, idItem); err != nil {
+		return 0, albumDBError(db, "AlbumDBRelinkItem", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, albumDBError(db, "AlbumDBRelinkItem", err)
+	}
+	log.Println("AlbumDBRelinkItem", idItem, path)
+	return rcnt, nil
+}
+
+// Returns the album items flagged missing.
+func (sv *ScrollViewer) AlbumDBMissingItems() ([]*FileInfo, error) {
+	return albumDBQueryItems("AlbumDBMissingItems", "where missing = 1")
+}
+
+// Returns the relink candidates of all missing items, those
+// matching by fingerprint first.
+func (sv *ScrollViewer) AlbumDBGetRelinks() (res []relinkCandidate, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`select iditem, newpath, byhash, found
+			 from useralbumrelink order by iditem, byhash desc, newpath`)
+	if err != nil {
+		return nil, albumDBError(db, "AlbumDBGetRelinks", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v relinkCandidate
+		var found int64
+		if err = rows.Scan(&v.ItemID, &v.Path, &v.ByHash, &found); err != nil {
+			return nil, albumDBError(db, "AlbumDBGetRelinks", err)
+		}
+		v.Found = time.Unix(found, 0)
+		res = append(res, v)
+	}
+	err = rows.Err()
+	return res, albumDBError(db, "AlbumDBGetRelinks", err)
+}
+
+// Drops the relink candidates of the album item idItem.
+// It stays flagged missing.
+func (sv *ScrollViewer) AlbumDBDismissRelinks(idItem int) (rcnt int64, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec(`delete from useralbumrelink where iditem = ?`, idItem)
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBDismissRelinks", err)
+	}
+	rcnt, _ = res.RowsAffected()
+	return rcnt, nil
+}
+
+// Reports whether the file of the album item v is gone,
+// flagging the item missing for AlbumDBRelink if so.
+func albumItemMissing(v *FileInfo) bool {
+	if _, err := os.Stat(filepath.Join(v.URL, v.Name)); !os.IsNotExist(err) {
+		return false
+	}
+	if !v.missing {
+		db, err := albumDB()
+		if err == nil {
+			_, err = db.Exec(`update useralbumitems set missing = 1 where iditem = ?`, v.index)
+			err = albumDBError(db, "albumItemMissing", err)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		v.missing = true
+	}
+	return true
+}
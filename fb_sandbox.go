@@ -0,0 +1,114 @@
+// fb_sandbox.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutsideRoots is returned for paths that don't resolve to a
+// file or folder inside one of the ServeRoots.
+var ErrOutsideRoots = errors.New("path is outside the served folders")
+
+// Resolves the path name received over http to the real path it
+// names, following symlinks, and makes sure it lies inside one of
+// the ServeRoots. Every path the http server opens goes through
+// here, or sandboxAlbumPath, whether it came from a request or
+// from the album database.
+func sandboxPath(name string) (string, error) {
+	name, err := sandboxClean(name)
+	if err != nil {
+		return "", err
+	}
+
+	// rejected before it is resolved, so a request can't
+	// tell missing paths outside the roots from existing ones.
+	if !withinRoots(name) {
+		return "", ErrOutsideRoots
+	}
+
+	real, err := sandboxResolve(name)
+	if err != nil {
+		return "", err
+	}
+	if !withinRoots(real) {
+		return "", ErrOutsideRoots
+	}
+	return real, nil
+}
+
+// Resolves the path name of an album item like sandboxPath. With
+// no ServeRoots configured the album database is what says which
+// files may be served, as the albums were served before there
+// were roots; once roots are set they confine album items too.
+func sandboxAlbumPath(name string) (string, error) {
+	if len(ServeRoots) > 0 {
+		return sandboxPath(name)
+	}
+	name, err := sandboxClean(name)
+	if err != nil {
+		return "", err
+	}
+	return sandboxResolve(name)
+}
+
+// Returns the clean form of name, refusing relative
+// paths and those no file of a root could have.
+func sandboxClean(name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) || !filepath.IsAbs(name) {
+		return "", ErrOutsideRoots
+	}
+	// a colon past the volume name would address an
+	// NTFS alternate data stream or another device.
+	if strings.ContainsRune(name[len(filepath.VolumeName(name)):], ':') {
+		return "", ErrOutsideRoots
+	}
+	return filepath.Clean(name), nil
+}
+
+// Returns the real absolute path of name, its links followed.
+func sandboxResolve(name string) (string, error) {
+	real, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(real)
+}
+
+// Reports whether the clean absolute path name lies inside one
+// of the ServeRoots, as configured or with their links resolved.
+func withinRoots(name string) bool {
+	for _, root := range ServeRoots {
+		if pathWithin(name, root) {
+			return true
+		}
+		if rroot, err := filepath.EvalSymlinks(root); err == nil && pathWithin(name, rroot) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the clean absolute path name is root
+// or lies below it.
+func pathWithin(name, root string) bool {
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// Returns the http status for an error from sandboxPath.
+func sandboxStatus(err error) int {
+	switch {
+	case err == ErrOutsideRoots || os.IsPermission(err):
+		return http.StatusForbidden
+	case os.IsNotExist(err):
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,196 @@
+// fb_sandbox_test
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Serves a temporary folder with a.jpg for the test, next to a
+// secret.txt outside of it. Returns the served folder and the
+// folder holding both.
+func testServeRoot(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join(root, "a.jpg"), filepath.Join(dir, "secret.txt")} {
+		if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roots := ServeRoots
+	ServeRoots = []string{root}
+	t.Cleanup(func() { ServeRoots = roots })
+	return root, dir
+}
+
+func TestSandboxPath(t *testing.T) {
+	root, dir := testServeRoot(t)
+
+	name := filepath.Join(root, "a.jpg")
+	real, err := sandboxPath(name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if want, _ := filepath.EvalSymlinks(name); real != want {
+		t.Errorf("%s resolved to %s, want %s", name, real, want)
+	}
+	if _, err = sandboxPath(filepath.Join(root, "missing.jpg")); !os.IsNotExist(err) {
+		t.Errorf("missing file inside the root: got %v, want not found", err)
+	}
+
+	sep := string(filepath.Separator)
+	for _, name := range []string{
+		"",
+		"..",
+		".." + sep + "secret.txt",
+		"a.jpg",
+		dir,
+		filepath.Join(dir, "secret.txt"),
+		root + sep + ".." + sep + "secret.txt",
+		root + sep + "a.jpg" + sep + ".." + sep + ".." + sep + "secret.txt",
+		root + sep + ".." + sep + "missing.txt",
+		root + "\x00" + sep + "a.jpg",
+		name + "\x00.png",
+		name + ":stream",
+		"C:secret.txt",
+		"C:" + sep + ".." + sep + "secret.txt",
+	} {
+		if real, err := sandboxPath(name); err != ErrOutsideRoots {
+			t.Errorf("%q: got %q, %v, want ErrOutsideRoots", name, real, err)
+		}
+	}
+}
+
+func TestSandboxPathSymlinks(t *testing.T) {
+	root, dir := testServeRoot(t)
+
+	links := map[string]string{
+		"secret.jpg": filepath.Join(dir, "secret.txt"),
+		"up":         dir,
+		"b.jpg":      filepath.Join(root, "a.jpg"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skip("no symlinks here:", err)
+		}
+	}
+
+	// links out of the root are refused, whether to a file or
+	// to a folder walked through.
+	for _, name := range []string{
+		filepath.Join(root, "secret.jpg"),
+		filepath.Join(root, "up"),
+		filepath.Join(root, "up", "secret.txt"),
+	} {
+		if real, err := sandboxPath(name); err != ErrOutsideRoots {
+			t.Errorf("%s: got %q, %v, want ErrOutsideRoots", name, real, err)
+		}
+	}
+
+	// ones that end up inside resolve to their target
+	want, _ := filepath.EvalSymlinks(filepath.Join(root, "a.jpg"))
+	for _, name := range []string{
+		filepath.Join(root, "b.jpg"),
+		filepath.Join(root, "up", "root", "a.jpg"),
+	} {
+		if real, err := sandboxPath(name); err != nil || real != want {
+			t.Errorf("%s: got %q, %v, want %q", name, real, err, want)
+		}
+	}
+}
+
+// Album items are served from anywhere while no roots are set,
+// and confined to the roots once there are some.
+func TestSandboxAlbumPath(t *testing.T) {
+	root, dir := testServeRoot(t)
+	name := filepath.Join(root, "a.jpg")
+	secret := filepath.Join(dir, "secret.txt")
+
+	if real, err := sandboxAlbumPath(secret); err != ErrOutsideRoots {
+		t.Errorf("%s with roots: got %q, %v, want ErrOutsideRoots", secret, real, err)
+	}
+	if _, err := sandboxAlbumPath(name); err != nil {
+		t.Errorf("%s with roots: %v", name, err)
+	}
+
+	ServeRoots = nil
+	want, _ := filepath.EvalSymlinks(secret)
+	if real, err := sandboxAlbumPath(secret); err != nil || real != want {
+		t.Errorf("%s without roots: got %q, %v, want %q", secret, real, err, want)
+	}
+	if real, err := sandboxPath(secret); err != ErrOutsideRoots {
+		t.Errorf("%s without roots, not an album item: got %q, %v, want ErrOutsideRoots", secret, real, err)
+	}
+	for _, name := range []string{"", "secret.txt", secret + "\x00.png", secret + ":stream"} {
+		if real, err := sandboxAlbumPath(name); err != ErrOutsideRoots {
+			t.Errorf("%q without roots: got %q, %v, want ErrOutsideRoots", name, real, err)
+		}
+	}
+}
+
+// Request paths are unescaped before they are matched, the
+// item handed to sandboxPath is whatever the route lets through:
+// an escaped slash splits it and doesn't match, a backslash,
+// colon or NUL arrives as is.
+func TestSandboxPathMuxVars(t *testing.T) {
+	root, _ := testServeRoot(t)
+	sep := string(filepath.Separator)
+	windows := filepath.Separator == '\\'
+
+	var items []string
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{name}/{item}", func(w http.ResponseWriter, r *http.Request) {
+		item := mux.Vars(r)["item"]
+		items = append(items, item)
+		if _, err := sandboxPath(item); err != nil {
+			http.Error(w, err.Error(), sandboxStatus(err))
+		}
+	})
+
+	for _, v := range []struct {
+		target  string
+		reaches bool
+	}{
+		{"/users/photos/..%2f..%2fsecret.txt", false},
+		{"/users/photos/%2e%2e%2f%2e%2e%2fsecret.txt", false},
+		{"/users/photos/%2e%2e", false},
+		{"/users/photos/" + escapeAll(root+sep+".."+sep+"secret.txt"), windows},
+		{"/users/photos/%2e%2e%5c%2e%2e%5csecret.txt", true},
+		{"/users/photos/..%5csecret.txt", true},
+		{"/users/photos/" + escapeAll(root+"\\..\\secret.txt"), windows},
+		{"/users/photos/" + escapeAll(root+sep+"a.jpg") + "%00.png", windows},
+		{"/users/photos/a.jpg%00.png", true},
+		{"/users/photos/C:secret.txt", true},
+		{"/users/photos/C%3a..%5csecret.txt", true},
+	} {
+		items = items[:0]
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", v.target, nil))
+		if w.Code == http.StatusOK {
+			t.Errorf("%s: served %q", v.target, items)
+		}
+		if v.reaches && (len(items) != 1 || w.Code != http.StatusForbidden) {
+			t.Errorf("%s: status %d for %q, want %d", v.target, w.Code, items, http.StatusForbidden)
+		}
+	}
+}
+
+// Escapes every byte of s, dots and separators included.
+func escapeAll(s string) string {
+	const hex = "0123456789abcdef"
+	b := make([]byte, 0, 3*len(s))
+	for i := 0; i < len(s); i++ {
+		b = append(b, '%', hex[s[i]>>4], hex[s[i]&15])
+	}
+	return string(b)
+}
@@ -0,0 +1,428 @@
+// fb_schema.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lutfinasution/filebrowser/thumbnail"
+)
+
+// schema_version records every migration applied to a database.
+// The highest version is the one the database is at.
+const sqlCreateTableSchemaVersion = `CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER PRIMARY KEY,
+	name TEXT,
+	applied DATETIME
+	);
+	`
+
+// A schema migration. Migrations are run in order, each in its
+// own transaction, and must never change once released: a new
+// column or table is always a new migration at the end of the list.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// Runs the SQL script s as a migration.
+func migrateExec(s string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(s)
+		return err
+	}
+}
+
+// Brings db up to the last of migrations. Databases created before
+// schema_version existed are placed by detect, which returns the
+// version their tables are at, 0 for an empty database.
+func migrateDB(db *sql.DB, dbname string, migrations []migration, detect func(db *sql.DB) (int, error)) error {
+	if _, err := db.Exec(sqlCreateTableSchemaVersion); err != nil {
+		return dbError("migrateDB", err)
+	}
+
+	var cur sql.NullInt64
+	if err := db.QueryRow(`select max(version) from schema_version`).Scan(&cur); err != nil {
+		return dbError("migrateDB", err)
+	}
+	version := int(cur.Int64)
+
+	if !cur.Valid {
+		v, err := detect(db)
+		if err != nil {
+			return dbError("migrateDB", err)
+		}
+		if v > 0 {
+			_, err = db.Exec(`insert into schema_version(version, name, applied) values(?, ?, ?)`,
+				v, "detected", time.Now())
+			if err != nil {
+				return dbError("migrateDB", err)
+			}
+			log.Println(dbname, "db detected at schema version", v)
+		}
+		version = v
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if err := migrateStep(db, m); err != nil {
+			return &DBError{Op: fmt.Sprintf("migrateDB %s %d %s", dbname, m.version, m.name), Err: err}
+		}
+		version = m.version
+		log.Println(dbname, "db migrated to schema version", m.version, m.name)
+	}
+
+	if last := migrations[len(migrations)-1].version; version > last {
+		log.Println(dbname, "db schema version", version, "is newer than this build's", last)
+	}
+	return nil
+}
+
+func migrateStep(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = m.up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`insert into schema_version(version, name, applied) values(?, ?, ?)`,
+		m.version, m.name, time.Now())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Returns the column names of table, none if it doesn't exist.
+func tableColumns(db queryer, table string) (map[string]bool, error) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+
+		if err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+//------------------------------------------------
+// CACHE DB
+//------------------------------------------------
+
+// The first release: usercache keyed on the crc32 of the
+// directory and of the item name.
+const sqlCreateTableCacheV1 = `CREATE TABLE IF NOT EXISTS usercache (
+    uid INTEGER PRIMARY KEY AUTOINCREMENT,
+	idpathcrc INTEGER,
+	iditemcrc INTEGER,
+	itemwidth INTEGER,
+	itemheight INTEGER,
+    itemdata BLOB,
+	UNIQUE(idpathcrc, iditemcrc)
+	);
+	`
+
+// usercache keyed on the full item path. idpathcrc and iditemcrc
+// are only set on rows carried over from the crc32 keyed schema,
+// until CacheDBEnum adopts them under their path.
+const sqlCreateTableCacheV3 = `CREATE TABLE usercache (
+    uid INTEGER PRIMARY KEY AUTOINCREMENT,
+	itempath TEXT,
+	dirpath TEXT,
+	itemwidth INTEGER,
+	itemheight INTEGER,
+    itemdata BLOB,
+	itemsize INTEGER,
+	itemmodtime INTEGER,
+	itemhash TEXT,
+	idpathcrc INTEGER,
+	iditemcrc INTEGER,
+	UNIQUE(itempath)
+	);
+	`
+
+// usercache keyed on the full item path and the size tier of
+// the thumbnail (see thumbnail.Tier).
+const sqlCreateTableCacheV4 = `CREATE TABLE usercache (
+    uid INTEGER PRIMARY KEY AUTOINCREMENT,
+	itempath TEXT,
+	dirpath TEXT,
+	tier INTEGER,
+	itemwidth INTEGER,
+	itemheight INTEGER,
+    itemdata BLOB,
+	itemsize INTEGER,
+	itemmodtime INTEGER,
+	itemhash TEXT,
+	idpathcrc INTEGER,
+	iditemcrc INTEGER,
+	UNIQUE(itempath, tier)
+	);
+	`
+
+// The indexes are dropped along with the table on each rebuild.
+const sqlCreateIndexCache = `CREATE INDEX IF NOT EXISTS usercache_dirpath ON usercache(dirpath);
+	CREATE INDEX IF NOT EXISTS usercache_idpathcrc ON usercache(idpathcrc);
+	`
+
+// Moves the rows of the crc32 keyed usercache into the path keyed
+// table. The paths can't be recovered from the crcs, so the rows
+// keep their crcs until CacheDBEnum sees them again.
+const sqlUpgradeCacheKeys = `ALTER TABLE usercache RENAME TO usercache_crc32;
+	` + sqlCreateTableCacheV3 + `
+	INSERT INTO usercache(idpathcrc, iditemcrc, itemwidth, itemheight, itemdata, itemsize, itemmodtime, itemhash)
+	SELECT idpathcrc, iditemcrc, itemwidth, itemheight, itemdata, itemsize, itemmodtime, itemhash
+	FROM usercache_crc32;
+	DROP TABLE usercache_crc32;
+	` + sqlCreateIndexCache
+
+// Rebuilds usercache with size tiers, every row being
+// assigned the tier its thumbnail dimensions fit in.
+var sqlUpgradeCacheTiers = `ALTER TABLE usercache RENAME TO usercache_notier;
+	` + sqlCreateTableCacheV4 + `
+	INSERT INTO usercache(itempath, dirpath, tier, itemwidth, itemheight, itemdata, itemsize, itemmodtime, itemhash,
+		idpathcrc, iditemcrc)
+	SELECT itempath, dirpath, ` + sqlTierCase() + `, itemwidth, itemheight, itemdata, itemsize, itemmodtime, itemhash,
+		idpathcrc, iditemcrc
+	FROM usercache_notier;
+	DROP TABLE usercache_notier;
+	` + sqlCreateIndexCache
+
+// Returns an sql expression computing thumbnail.TierFor
+// from the itemwidth and itemheight columns.
+func sqlTierCase() string {
+	s := "CASE"
+	for _, t := range thumbnail.Tiers {
+		w, h := t.Size()
+		s += fmt.Sprintf(" WHEN itemwidth <= %d AND itemheight <= %d THEN %d", w, h, t)
+	}
+	return s + fmt.Sprintf(" ELSE %d END", thumbnail.TierLarge)
+}
+
+// The current usercache is sqlCreateTableCacheV4 plus lastaccess, and
+// imagewidth and imageheight for the size of the image itself.
+var cacheMigrations = []migration{
+	{1, "crc32 keyed usercache", migrateExec(sqlCreateTableCacheV1)},
+	{2, "file metadata columns", cacheDBAddMetadata},
+	{3, "path keys", migrateExec(sqlUpgradeCacheKeys)},
+	{4, "size tiers", migrateExec(sqlUpgradeCacheTiers)},
+	{5, "last access", migrateExec(`ALTER TABLE usercache ADD COLUMN lastaccess INTEGER;`)},
+	{6, "image dimensions", migrateExec(
+		`ALTER TABLE usercache ADD COLUMN imagewidth INTEGER;
+		ALTER TABLE usercache ADD COLUMN imageheight INTEGER;`)},
+}
+
+// Adds the size, mtime and fingerprint columns that cache rows are
+// validated against. Versions before schema_version added them one
+// at a time, so some may already be there.
+func cacheDBAddMetadata(tx *sql.Tx) error {
+	cols, err := tableColumns(tx, "usercache")
+	if err != nil {
+		return err
+	}
+	for _, v := range [][2]string{
+		{"itemsize", "INTEGER"},
+		{"itemmodtime", "INTEGER"},
+		{"itemhash", "TEXT"},
+	} {
+		if cols[v[0]] {
+			continue
+		}
+		if _, err = tx.Exec("ALTER TABLE usercache ADD COLUMN " + v[0] + " " + v[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the schema version of a cache.db written before
+// schema_version existed, judging by the usercache columns.
+func cacheDBDetectVersion(db *sql.DB) (int, error) {
+	cols, err := tableColumns(db, "usercache")
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case len(cols) == 0:
+		return 0, nil
+	case !cols["itempath"] && !cols["itemhash"]:
+		return 1, nil
+	case !cols["itempath"]:
+		return 2, nil
+	case !cols["tier"]:
+		return 3, nil
+	case !cols["lastaccess"]:
+		return 4, nil
+	}
+	return 5, nil
+}
+
+//------------------------------------------------
+// ALBUM DB
+//------------------------------------------------
+
+const sqlCreateTableAlbum = `CREATE TABLE IF NOT EXISTS useralbum (
+    idalbum INTEGER PRIMARY KEY AUTOINCREMENT,
+	albumname TEXT,
+	albumdesc TEXT,
+    albumdate DATETIME,
+    albumsize INTEGER,
+	albumcover BLOB,
+	UNIQUE(albumname, albumdesc)
+	);
+	`
+const sqlCreateTableAlbumItems = `CREATE TABLE IF NOT EXISTS useralbumitems (
+    iditem INTEGER PRIMARY KEY AUTOINCREMENT,
+	idalbum INTEGER,
+	itemname TEXT,
+	itempath TEXT,
+    itemsize INTEGER,
+    itemdate DATETIME,
+	itemw INTEGER,
+	itemh INTEGER,
+	itemdata BLOB,
+	UNIQUE(idalbum, itemname,itempath)
+	);
+	`
+
+// Web users sign in to the http server with a password, kept as a
+// bcrypt hash. A session is stored by the sha256 of its token, so
+// album.db alone can't be used to take one over.
+const sqlCreateTableWebUser = `CREATE TABLE webuser (
+    iduser INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL,
+	passhash TEXT NOT NULL,
+	isadmin INTEGER NOT NULL DEFAULT 0,
+	UNIQUE(username)
+	);
+	`
+const sqlCreateTableWebSession = `CREATE TABLE websession (
+    tokenhash TEXT PRIMARY KEY,
+	iduser INTEGER NOT NULL,
+	expires INTEGER NOT NULL
+	);
+	CREATE INDEX websession_iduser ON websession(iduser);
+	`
+
+// Links that give anyone holding them read only access to an
+// album until they expire or are revoked. The tokens are signed
+// with the websecret named "share" and not stored themselves.
+const sqlCreateTableAlbumShare = `CREATE TABLE useralbumshare (
+    idshare INTEGER PRIMARY KEY AUTOINCREMENT,
+	idalbum INTEGER NOT NULL,
+	passhash TEXT,
+	created INTEGER NOT NULL,
+	expires INTEGER NOT NULL,
+	revoked INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX useralbumshare_idalbum ON useralbumshare(idalbum);
+	`
+const sqlCreateTableWebSecret = `CREATE TABLE websecret (
+    name TEXT PRIMARY KEY,
+	secret BLOB NOT NULL
+	);
+	`
+
+// Ratings of image files from 1 to ratingMax, by full path.
+const sqlCreateTableRating = `CREATE TABLE userrating (
+    itempath TEXT PRIMARY KEY,
+	rating INTEGER NOT NULL
+	);
+	`
+
+// Where album items whose files went missing may have moved to,
+// waiting for a user to pick one. byhash is set for candidates
+// of the same size and fingerprint, see AlbumDBRelink.
+const sqlCreateTableAlbumRelink = `CREATE TABLE useralbumrelink (
+    iditem INTEGER NOT NULL,
+	newpath TEXT NOT NULL,
+	byhash INTEGER NOT NULL DEFAULT 0,
+	found INTEGER NOT NULL,
+	PRIMARY KEY(iditem, newpath)
+	);
+	`
+
+// useralbum with the parent of nested albums, names and descriptions
+// being unique among the albums of a parent only. sqlite can't change the UNIQUE
+// constraint in place, so the table is copied, and its AUTOINCREMENT
+// sequence carried over for the ids of deleted albums not to return.
+const sqlUpgradeAlbumParents = `ALTER TABLE useralbum RENAME TO useralbum_flat;
+	CREATE TABLE useralbum (
+    idalbum INTEGER PRIMARY KEY AUTOINCREMENT,
+	idparent INTEGER NOT NULL DEFAULT 0,
+	albumname TEXT,
+	albumdesc TEXT,
+    albumdate DATETIME,
+    albumsize INTEGER,
+	albumcover BLOB,
+	visibility INTEGER NOT NULL DEFAULT 0,
+	smartrule TEXT,
+	UNIQUE(idparent, albumname, albumdesc)
+	);
+	INSERT INTO useralbum(idalbum, albumname, albumdesc, albumdate, albumsize, albumcover, visibility, smartrule)
+	SELECT idalbum, albumname, albumdesc, albumdate, albumsize, albumcover, visibility, smartrule FROM useralbum_flat;
+	DELETE FROM sqlite_sequence WHERE name = 'useralbum';
+	UPDATE sqlite_sequence SET name = 'useralbum' WHERE name = 'useralbum_flat';
+	DROP TABLE useralbum_flat;
+	CREATE INDEX useralbum_idparent ON useralbum(idparent);
+	`
+
+var albumMigrations = []migration{
+	{1, "albums and album items", migrateExec(sqlCreateTableAlbum + sqlCreateTableAlbumItems)},
+	{2, "web users and album visibility", migrateExec(
+		`ALTER TABLE useralbum ADD COLUMN visibility INTEGER NOT NULL DEFAULT 0;
+		` + sqlCreateTableWebUser + sqlCreateTableWebSession)},
+	{3, "album share links", migrateExec(sqlCreateTableAlbumShare + sqlCreateTableWebSecret)},
+	{4, "album item fingerprints and relinking", migrateExec(
+		`ALTER TABLE useralbumitems ADD COLUMN itemhash TEXT;
+		ALTER TABLE useralbumitems ADD COLUMN missing INTEGER NOT NULL DEFAULT 0;
+		` + sqlCreateTableAlbumRelink)},
+	{5, "smart albums and ratings", migrateExec(
+		`ALTER TABLE useralbum ADD COLUMN smartrule TEXT;
+		` + sqlCreateTableRating)},
+	{6, "album item positions", migrateExec(
+		`ALTER TABLE useralbumitems ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+		UPDATE useralbumitems SET position = (SELECT count(*) FROM useralbumitems b
+			WHERE b.idalbum = useralbumitems.idalbum AND b.iditem < useralbumitems.iditem);
+		CREATE INDEX useralbumitems_position ON useralbumitems(idalbum, position);`)},
+	{7, "nested albums", migrateExec(sqlUpgradeAlbumParents)},
+}
+
+// Returns the schema version of an album.db written
+// before schema_version existed.
+func albumDBDetectVersion(db *sql.DB) (int, error) {
+	albums, err := tableColumns(db, "useralbum")
+	if err != nil {
+		return 0, err
+	}
+	items, err := tableColumns(db, "useralbumitems")
+	if err != nil {
+		return 0, err
+	}
+	if len(albums) == 0 || len(items) == 0 {
+		return 0, nil
+	}
+	return 1, nil
+}
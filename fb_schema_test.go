@@ -0,0 +1,284 @@
+// fb_schema_test.go
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lutfinasution/filebrowser/thumbnail"
+)
+
+// Opens an empty database file for a migration test. Fixtures are
+// made with the schema of the first release, before schema_version.
+func testSchemaDB(t *testing.T, fixture string) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err = db.Exec(fixture); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Checks that table has exactly the columns want.
+func testColumns(t *testing.T, db *sql.DB, table string, want string) {
+	cols, err := tableColumns(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for k := range cols {
+		got = append(got, k)
+	}
+	sort.Strings(got)
+	w := strings.Fields(want)
+	sort.Strings(w)
+	if strings.Join(got, " ") != strings.Join(w, " ") {
+		t.Errorf("%s columns:\n got %v\nwant %v", table, got, w)
+	}
+}
+
+// Checks that db is at the last of migrations.
+func testSchemaVersion(t *testing.T, db *sql.DB, migrations []migration) {
+	var v int
+	if err := db.QueryRow(`select max(version) from schema_version`).Scan(&v); err != nil {
+		t.Fatal(err)
+	}
+	if last := migrations[len(migrations)-1].version; v != last {
+		t.Errorf("schema version %d, want %d", v, last)
+	}
+}
+
+const testCacheColumns = `uid itempath dirpath tier itemwidth itemheight itemdata itemsize itemmodtime itemhash
+	idpathcrc iditemcrc lastaccess imagewidth imageheight`
+
+const testAlbumColumns = `idalbum idparent albumname albumdesc albumdate albumsize albumcover visibility smartrule`
+
+const testAlbumItemColumns = `iditem idalbum itemname itempath itemsize itemdate itemw itemh itemdata
+	itemhash missing position`
+
+func TestCacheMigrations(t *testing.T) {
+	db := testSchemaDB(t, sqlCreateTableCacheV1)
+
+	rows := []struct {
+		w, h int
+		tier thumbnail.Tier
+	}{
+		{120, 75, thumbnail.TierSmall},
+		{200, 100, thumbnail.TierMedium},
+		{320, 180, thumbnail.TierLarge},
+	}
+	for i, v := range rows {
+		_, err := db.Exec(`insert into usercache(idpathcrc, iditemcrc, itemwidth, itemheight, itemdata) values(?, ?, ?, ?, ?)`,
+			crc32FromName(`C:\photos`), crc32FromName(`C:\photos\`+string(rune('a'+i))+".jpg"), v.w, v.h, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrateDB(db, "cache", cacheMigrations, cacheDBDetectVersion); err != nil {
+		t.Fatal(err)
+	}
+	testColumns(t, db, "usercache", testCacheColumns)
+	testSchemaVersion(t, db, cacheMigrations)
+
+	// the rows wait, under their crcs, to be adopted by CacheDBEnum
+	for i, v := range rows {
+		var ipath sql.NullString
+		var tier thumbnail.Tier
+		var data []byte
+		err := db.QueryRow(`select itempath, tier, itemdata from usercache where iditemcrc = ? and idpathcrc = ?`,
+			crc32FromName(`C:\photos\`+string(rune('a'+i))+".jpg"), crc32FromName(`C:\photos`)).Scan(&ipath, &tier, &data)
+		if err != nil {
+			t.Fatalf("row %d: %v", i, err)
+		}
+		if ipath.Valid || tier != v.tier || len(data) != 1 || data[0] != byte(i) {
+			t.Errorf("row %d: path %v, tier %v, data %v, want no path, tier %v", i, ipath, tier, data, v.tier)
+		}
+	}
+
+	// the first release had no schema_version, it is detected
+	var name string
+	if err := db.QueryRow(`select name from schema_version where version = 1`).Scan(&name); err != nil || name != "detected" {
+		t.Errorf("version 1: %q, %v", name, err)
+	}
+}
+
+// Before schema_version, the metadata columns were added one
+// at a time, a cache.db may have only some of them.
+func TestCacheMigrationsPartialMetadata(t *testing.T) {
+	db := testSchemaDB(t, sqlCreateTableCacheV1+`ALTER TABLE usercache ADD COLUMN itemsize INTEGER;`)
+
+	_, err := db.Exec(`insert into usercache(idpathcrc, iditemcrc, itemwidth, itemheight, itemdata, itemsize) values(1, 2, 120, 75, x'00', 1234)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrateDB(db, "cache", cacheMigrations, cacheDBDetectVersion); err != nil {
+		t.Fatal(err)
+	}
+	testColumns(t, db, "usercache", testCacheColumns)
+	testSchemaVersion(t, db, cacheMigrations)
+
+	var size int64
+	if err = db.QueryRow(`select itemsize from usercache where iditemcrc = 2`).Scan(&size); err != nil || size != 1234 {
+		t.Errorf("itemsize %d, %v, want 1234", size, err)
+	}
+}
+
+func TestAlbumMigrations(t *testing.T) {
+	db := testSchemaDB(t, sqlCreateTableAlbum+sqlCreateTableAlbumItems)
+
+	date := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"Holidays", "Family", "Deleted"} {
+		_, err := db.Exec(`insert into useralbum(albumname, albumdesc, albumdate, albumsize, albumcover) values(?, ?, ?, 0, ?)`,
+			name, "about "+name, date, []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the id of the last album, deleted, must not be given out again
+	if _, err := db.Exec(`delete from useralbum where albumname = 'Deleted'`); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"c.jpg", "a.jpg", "b.jpg"} {
+		_, err := db.Exec(`insert into useralbumitems(idalbum, itemname, itempath, itemw, itemh, itemdata) values(?, ?, ?, ?, ?, ?)`,
+			1, name, `C:\photos`, 4, 3, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.Exec(`insert into useralbumitems(idalbum, itemname, itempath, itemw, itemh) values(2, 'd.jpg', 'C:\photos', 4, 3)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = migrateDB(db, "album", albumMigrations, albumDBDetectVersion); err != nil {
+		t.Fatal(err)
+	}
+	testColumns(t, db, "useralbum", testAlbumColumns)
+	testColumns(t, db, "useralbumitems", testAlbumItemColumns)
+	testSchemaVersion(t, db, albumMigrations)
+	for _, table := range []string{"webuser", "websession", "useralbumshare", "websecret", "userrating", "useralbumrelink"} {
+		if cols, _ := tableColumns(db, table); len(cols) == 0 {
+			t.Errorf("no table %s", table)
+		}
+	}
+
+	// the rebuilt useralbum keeps the ids, data and dates
+	want := map[int]string{1: "Holidays", 2: "Family"}
+	rows, err := db.Query(`select idalbum, idparent, albumname, albumdesc, albumdate, albumcover, visibility, smartrule from useralbum`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for rows.Next() {
+		var id, idParent int
+		var name, desc string
+		var adate time.Time
+		var cover []byte
+		var vis AlbumVisibility
+		var rule sql.NullString
+		if err = rows.Scan(&id, &idParent, &name, &desc, &adate, &cover, &vis, &rule); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if want[id] != name || desc != "about "+name || string(cover) != name || !adate.Equal(date) {
+			t.Errorf("album %d: %q %q %v %q", id, name, desc, adate, cover)
+		}
+		if idParent != 0 || vis != VisibilityPrivate || rule.Valid {
+			t.Errorf("album %d: parent %d, visibility %v, rule %v", id, idParent, vis, rule)
+		}
+	}
+	rows.Close()
+	if n != len(want) {
+		t.Errorf("%d albums, want %d", n, len(want))
+	}
+
+	// the items are numbered in the order they were added
+	for _, v := range []struct {
+		name     string
+		position int
+	}{{"c.jpg", 0}, {"a.jpg", 1}, {"b.jpg", 2}, {"d.jpg", 0}} {
+		var pos int
+		var missing bool
+		if err = db.QueryRow(`select position, missing from useralbumitems where itemname = ?`, v.name).Scan(&pos, &missing); err != nil {
+			t.Fatal(err)
+		}
+		if pos != v.position || missing {
+			t.Errorf("item %s: position %d, missing %v, want %d", v.name, pos, missing, v.position)
+		}
+	}
+
+	// the AUTOINCREMENT sequence came along with the table
+	res, err := db.Exec(`insert into useralbum(albumname, albumdesc) values('New', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := res.LastInsertId(); id != 4 {
+		t.Errorf("new album id %d, want 4", id)
+	}
+
+	// names are unique among the albums of a parent only
+	if _, err = db.Exec(`insert into useralbum(idparent, albumname, albumdesc) values(1, 'Family', 'about Family')`); err != nil {
+		t.Errorf("same name under another parent: %v", err)
+	}
+	if _, err = db.Exec(`insert into useralbum(idparent, albumname, albumdesc) values(0, 'Family', 'about Family')`); err == nil {
+		t.Errorf("same name under the same parent accepted")
+	}
+}
+
+// A database migrated from the first release and a new one end up
+// with the same tables.
+func TestMigrationsMatchNew(t *testing.T) {
+	for _, v := range []struct {
+		name       string
+		fixture    string
+		migrations []migration
+		detect     func(db *sql.DB) (int, error)
+		tables     []string
+	}{
+		{"cache", sqlCreateTableCacheV1, cacheMigrations, cacheDBDetectVersion, []string{"usercache"}},
+		{"album", sqlCreateTableAlbum + sqlCreateTableAlbumItems, albumMigrations, albumDBDetectVersion,
+			[]string{"useralbum", "useralbumitems", "webuser", "websession", "useralbumshare",
+				"websecret", "userrating", "useralbumrelink"}},
+	} {
+		old := testSchemaDB(t, v.fixture)
+		cur := testSchemaDB(t, "")
+		for _, db := range []*sql.DB{old, cur} {
+			if err := migrateDB(db, v.name, v.migrations, v.detect); err != nil {
+				t.Fatal(err)
+			}
+			testSchemaVersion(t, db, v.migrations)
+		}
+		for _, table := range v.tables {
+			a, err := tableColumns(old, table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := tableColumns(cur, table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(a) == 0 || len(a) != len(b) {
+				t.Errorf("%s %s: %d columns migrated, %d new", v.name, table, len(a), len(b))
+			}
+			for k := range a {
+				if !b[k] {
+					t.Errorf("%s %s: column %s only when migrated", v.name, table, k)
+				}
+			}
+		}
+
+		// running it again changes nothing
+		if err := migrateDB(old, v.name, v.migrations, v.detect); err != nil {
+			t.Errorf("%s again: %v", v.name, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// fb_serve.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lutfinasution/filebrowser/thumbnail"
+)
+
+// ServeRoots are the directories the http server lets remote
+// users browse, independent of the folder open in the GUI.
+var ServeRoots []string
+
+const (
+	servePerPage    = 100
+	serveMaxPerPage = 1000
+)
+
+// Images may be kept by the browser, but not by shared caches as
+// they may need a sign in, and are revalidated on every use, which
+// the ETag and Last-Modified sent along keep down to a 304.
+const serveCacheControl = "private, no-cache"
+
+// Content types of the image formats served. They are fixed rather
+// than taken from mime.TypeByExtension, which reads the Windows
+// registry and may come up with image/x-png and the like.
+var serveContentTypes = map[string]string{
+	".bmp":  "image/bmp",
+	".gif":  "image/gif",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".webp": "image/webp",
+}
+
+// One page of a served folder listing. Sub folders are
+// listed in full on every page, image items are paged.
+type servedFolder struct {
+	Path    string
+	Folders []string
+	Items   []*FileInfo
+	Page    int // 1 based
+	PerPage int
+	Total   int // number of items over all pages
+}
+
+func (f *servedFolder) Pages() int {
+	return (f.Total + f.PerPage - 1) / f.PerPage
+}
+
+// Lists page of the image files in dirPath, perPage at a time.
+// The image dimensions are only read for the items on the page.
+func serveListFolder(dirPath string, page, perPage int) (*servedFolder, error) {
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = servePerPage
+	}
+	if perPage > serveMaxPerPage {
+		perPage = serveMaxPerPage
+	}
+
+	infos, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &servedFolder{Path: dirPath, Folders: []string{}, Items: []*FileInfo{}, Page: page, PerPage: perPage}
+
+	var items []os.FileInfo
+	for _, info := range infos {
+		name := info.Name()
+		if shouldExclude(name) {
+			continue
+		}
+		if info.IsDir() {
+			res.Folders = append(res.Folders, name)
+		} else if thumbnail.Supported(filepath.Ext(name)) {
+			items = append(items, info)
+		}
+	}
+	res.Total = len(items)
+
+	first := (page - 1) * perPage
+	if first > len(items) {
+		first = len(items)
+	}
+	last := first + perPage
+	if last > len(items) {
+		last = len(items)
+	}
+	for _, info := range items[first:last] {
+		v := &FileInfo{
+			Name:     info.Name(),
+			URL:      dirPath,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+			Type:     filepath.Ext(info.Name()),
+		}
+		if sz, err := GetImageInfo(filepath.Join(dirPath, v.Name)); err == nil {
+			v.Width, v.Height = sz.Width, sz.Height
+		}
+		res.Items = append(res.Items, v)
+	}
+	return res, nil
+}
+
+// Returns the thumbnail of the image file name of at least the
+// given tier, and when the file was last modified. It comes from
+// cache.db when that is open, or else is made from the file, and
+// stored in cache.db for the next time. The thumbnail view's items
+// aren't looked at, the GUI changes them while this runs.
+func serveThumbnail(name string, tier thumbnail.Tier) (*thumbnail.Thumb, time.Time, error) {
+	if !thumbnail.Supported(filepath.Ext(name)) {
+		return nil, time.Time{}, thumbnail.ErrUnsupported
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// opened by the GUI, at start when caching is on
+	db := cacheDB()
+
+	v := &FileInfo{Name: info.Name(), URL: filepath.Dir(name), Size: info.Size(), Modified: info.ModTime()}
+	if db != nil {
+		if th, _, ok := cacheDBGetTier(db, name, v, tier); ok {
+			return th, v.Modified, nil
+		}
+	}
+
+	opt := thumbnail.DefaultOptions()
+	opt.Width, opt.Height = tier.Size()
+
+	th, err := thumbnail.New(opt).Generate(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if db != nil {
+		if err := cacheDBUpdateFromBuffer(db, name, th.Data, th.Width, th.Height); dbCorrupt(err) {
+			sv := Mw.thumbView
+			sv.canvasView.Synchronize(func() {
+				sv.cacheDBFailed(err)
+			})
+		} else if err != nil {
+			log.Println("serveThumbnail", err)
+		}
+	}
+	return th, v.Modified, nil
+}
+
+// Streams the image file name, which has been through sandboxPath,
+// leaving Range requests and conditional GETs to http.ServeContent.
+// Nothing is written if the file can't be opened.
+func serveImageFile(w http.ResponseWriter, r *http.Request, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	h := w.Header()
+	if ct, ok := serveContentTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		h.Set("Content-Type", ct)
+	}
+	h.Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	h.Set("Cache-Control", serveCacheControl)
+	http.ServeContent(w, r, name, info.ModTime(), f)
+	return nil
+}
+
+// Writes the jpeg thumbnail data of an image last modified at
+// modified, zero if that isn't known. The ETag is taken from the
+// data itself, as the same image may have thumbnails of several
+// sizes and cache.db may replace one with another.
+func serveThumbData(w http.ResponseWriter, r *http.Request, data []byte, modified time.Time) {
+	h := w.Header()
+	h.Set("Content-Type", "image/jpeg")
+	h.Set("ETag", fmt.Sprintf(`"%08x-%x"`, crc32.ChecksumIEEE(data), len(data)))
+	h.Set("Cache-Control", serveCacheControl)
+	http.ServeContent(w, r, "", modified, bytes.NewReader(data))
+}
@@ -0,0 +1,418 @@
+// fb_share.go
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	shareDefaultLifetime = 7 * 24 * time.Hour
+	shareMaxLifetime     = 365 * 24 * time.Hour
+	shareCookie          = "shareunlock"
+)
+
+// ErrShareLifetime is returned for a share that would
+// expire in the past or too far into the future.
+var ErrShareLifetime = errors.New("a share link must expire within a year")
+
+// A share link of an album.
+type albumShare struct {
+	ID       int
+	AlbumID  int
+	Created  time.Time
+	Expires  time.Time
+	Revoked  bool
+	passhash string
+}
+
+func (s *albumShare) HasPassword() bool {
+	return s.passhash != ""
+}
+
+var (
+	shareKeyMu sync.Mutex
+	shareKey   []byte
+)
+
+// Returns the key share tokens are signed with, generating
+// it the first time. Deleting it from websecret invalidates
+// every share link given out so far.
+func shareSecret() ([]byte, error) {
+	shareKeyMu.Lock()
+	defer shareKeyMu.Unlock()
+
+	if shareKey != nil {
+		return shareKey, nil
+	}
+	db, err := albumDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	err = db.QueryRow(`select secret from websecret where name = 'share'`).Scan(&key)
+	if err == sql.ErrNoRows {
+		key = make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		_, err = db.Exec(`insert into websecret(name, secret) values('share', ?)`, key)
+	}
+	if err != nil {
+		return nil, albumDBError(db, "shareSecret", err)
+	}
+	shareKey = key
+	return key, nil
+}
+
+func shareMAC(key []byte, s string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the token of the share s, its id and expiry signed.
+func shareToken(s *albumShare) (string, error) {
+	key, err := shareSecret()
+	if err != nil {
+		return "", err
+	}
+	payload := fmt.Sprintf("%d.%d", s.ID, s.Expires.Unix())
+	return payload + "." + shareMAC(key, payload), nil
+}
+
+// Returns the share of token if it is still good, nil if the
+// token is forged or the share has expired or been revoked.
+func shareLookup(token string) (*albumShare, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil
+	}
+	key, err := shareSecret()
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(shareMAC(key, parts[0]+"."+parts[1]))) {
+		return nil, nil
+	}
+	id, err1 := strconv.Atoi(parts[0])
+	expires, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil || time.Now().Unix() > expires {
+		return nil, nil
+	}
+
+	s, err := shareGet(id)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	if s.Revoked || s.Expires.Unix() != expires {
+		return nil, nil
+	}
+	return s, nil
+}
+
+func shareGet(idShare int) (*albumShare, error) {
+	db, err := albumDB()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &albumShare{}
+	var created, expires int64
+	var passhash sql.NullString
+	err = db.QueryRow(`select idshare, idalbum, passhash, created, expires, revoked
+		from useralbumshare where idshare = ?`, idShare).
+		Scan(&s.ID, &s.AlbumID, &passhash, &created, &expires, &s.Revoked)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, albumDBError(db, "shareGet", err)
+	}
+	s.passhash = passhash.String
+	s.Created, s.Expires = time.Unix(created, 0), time.Unix(expires, 0)
+	return s, nil
+}
+
+// Creates a share link of the album idAlbum that expires at
+// expires, protected by password unless it is empty.
+func (sv *ScrollViewer) AlbumDBNewShare(idAlbum int, expires time.Time, password string) (*albumShare, error) {
+	now := time.Now()
+	if !expires.After(now) || expires.After(now.Add(shareMaxLifetime)) {
+		return nil, ErrShareLifetime
+	}
+	db, err := albumDB()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &albumShare{AlbumID: idAlbum, Created: now, Expires: expires}
+	var passhash sql.NullString
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		s.passhash = string(hash)
+		passhash = sql.NullString{String: s.passhash, Valid: true}
+	}
+
+	res, err := db.Exec(`insert into useralbumshare(idalbum, passhash, created, expires) values(?, ?, ?, ?)`,
+		idAlbum, passhash, now.Unix(), expires.Unix())
+	if err != nil {
+		return nil, albumDBError(db, "AlbumDBNewShare", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, albumDBError(db, "AlbumDBNewShare", err)
+	}
+	s.ID = int(id)
+	return s, nil
+}
+
+// Returns the share links of the album idAlbum, revoked and expired ones included.
+func (sv *ScrollViewer) AlbumDBGetShares(idAlbum int) (res []*albumShare, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`select idshare, passhash, created, expires, revoked
+		from useralbumshare where idalbum = ? order by idshare`, idAlbum)
+	if err != nil {
+		return nil, albumDBError(db, "AlbumDBGetShares", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s := &albumShare{AlbumID: idAlbum}
+		var created, expires int64
+		var passhash sql.NullString
+
+		if err = rows.Scan(&s.ID, &passhash, &created, &expires, &s.Revoked); err != nil {
+			return res, albumDBError(db, "AlbumDBGetShares", err)
+		}
+		s.passhash = passhash.String
+		s.Created, s.Expires = time.Unix(created, 0), time.Unix(expires, 0)
+		res = append(res, s)
+	}
+	err = rows.Err()
+	return res, albumDBError(db, "AlbumDBGetShares", err)
+}
+
+// Revokes the share link idShare of the album idAlbum. The row
+// is kept, so the link reports as revoked rather than unknown.
+func (sv *ScrollViewer) AlbumDBRevokeShare(idAlbum int, idShare int) (rcnt int64, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := db.Exec(`update useralbumshare set revoked = 1 where idalbum = ? and idshare = ?`,
+		idAlbum, idShare)
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBRevokeShare", err)
+	}
+	rcnt, _ = res.RowsAffected()
+	return rcnt, nil
+}
+
+//------------------------------------------------
+// HTTP
+//------------------------------------------------
+
+// Reports whether the request may use the share s, which is
+// when s has no password or the request carries the cookie
+// set once the password was given.
+func shareUnlocked(r *http.Request, s *albumShare, token string) bool {
+	if !s.HasPassword() {
+		return true
+	}
+	c, err := r.Cookie(shareCookie)
+	if err != nil {
+		return false
+	}
+	key, err := shareSecret()
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(c.Value), []byte(shareMAC(key, "unlock."+token)))
+}
+
+// Returns the share of the request's {token}, having
+// written the error response if it isn't good.
+func shareRequest(w http.ResponseWriter, r *http.Request) (*albumShare, string) {
+	token := mux.Vars(r)["token"]
+	s, err := shareLookup(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, ""
+	}
+	if s == nil {
+		http.Error(w, "this link is not valid or has expired", http.StatusNotFound)
+		return nil, ""
+	}
+	return s, token
+}
+
+// GET /share/{token} lists the shared album, POST /share/{token}
+// unlocks a password protected share.
+func HandleShareRequest(w http.ResponseWriter, r *http.Request) {
+	s, token := shareRequest(w, r)
+	if s == nil {
+		return
+	}
+	base := "/share/" + url.PathEscape(token)
+
+	status, msg := http.StatusOK, ""
+	if r.Method == "POST" && s.HasPassword() {
+		if bcrypt.CompareHashAndPassword([]byte(s.passhash), []byte(r.PostFormValue("password"))) == nil {
+			key, err := shareSecret()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     shareCookie,
+				Value:    shareMAC(key, "unlock."+token),
+				Path:     base,
+				Expires:  s.Expires,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, base, http.StatusSeeOther)
+			return
+		}
+		status, msg = http.StatusUnauthorized, "wrong password"
+	}
+
+	if !shareUnlocked(r, s, token) {
+		netRender(w, status, "sharelock", struct {
+			netPage
+			Action  string
+			Message string
+		}{netPage{Title: "Shared album", Share: true}, base, msg})
+		return
+	}
+
+	album, err := Mw.albumView.AlbumDBGetAlbum(s.AlbumID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if album == nil {
+		http.NotFound(w, r)
+		return
+	}
+	items, err := Mw.albumView.AlbumDBEnumItems(s.AlbumID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	pager, first, last := netPaging(page, servePerPage, len(items), func(n int) string {
+		return base + "?page=" + strconv.Itoa(n)
+	})
+	images := make([]netImage, 0, last-first)
+	for _, v := range items[first:last] {
+		images = append(images, netImage{
+			Name:     v.Name,
+			Thumb:    fmt.Sprintf("%s/thumb/%d", base, v.index),
+			View:     fmt.Sprintf("%s/image/%d?%s", base, v.index, netViewSize),
+			Original: fmt.Sprintf("%s/image/%d", base, v.index),
+		})
+	}
+	a := netAlbumOf(album)
+	a.Items = int64(len(items))
+
+	// a share link is for the album alone, not its sub-albums
+	netRender(w, http.StatusOK, "album", struct {
+		netPage
+		Album   netAlbum
+		Albums  []netAlbum
+		Items   []netImage
+		Pager   netPager
+		ZipURL  string
+		Expires time.Time
+	}{netPage{Title: album.Name, Share: true}, a, nil, images, pager, base + "/zip", s.Expires})
+}
+
+// GET /share/{token}/thumb/{item} and /share/{token}/image/{item}
+// serve the thumbnail and the image of an item of the shared album.
+func HandleShareItemRequest(w http.ResponseWriter, r *http.Request) {
+	s, token := shareRequest(w, r)
+	if s == nil {
+		return
+	}
+	if !shareUnlocked(r, s, token) {
+		http.Error(w, "this link needs a password", http.StatusUnauthorized)
+		return
+	}
+
+	idItem, _ := strconv.Atoi(mux.Vars(r)["item"])
+	v, err := Mw.albumView.AlbumDBGetAlbumItem(s.AlbumID, idItem)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if v == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if mux.Vars(r)["kind"] == "thumb" {
+		if !v.HasData() {
+			http.NotFound(w, r)
+			return
+		}
+		serveThumbData(w, r, v.Imagedata, v.Modified)
+		return
+	}
+
+	if albumItemMissing(v) {
+		http.Error(w, errItemMissing.Error(), http.StatusNotFound)
+		return
+	}
+	netServeImage(w, r, filepath.Join(v.URL, v.Name))
+}
+
+// GET /share/{token}/zip?items=&resize= streams the
+// shared album as a ZIP archive.
+func HandleShareZipRequest(w http.ResponseWriter, r *http.Request) {
+	s, token := shareRequest(w, r)
+	if s == nil {
+		return
+	}
+	if !shareUnlocked(r, s, token) {
+		http.Error(w, "this link needs a password", http.StatusUnauthorized)
+		return
+	}
+	album, err := Mw.albumView.AlbumDBGetAlbum(s.AlbumID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if album == nil {
+		http.NotFound(w, r)
+		return
+	}
+	netServeAlbumZip(w, r, album)
+}
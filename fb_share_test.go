@@ -0,0 +1,158 @@
+// fb_share_test
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Opens an empty in-memory album.db with a fresh share key,
+// and an album to share.
+func testShareDB(t *testing.T) (*ScrollViewer, *FileInfo) {
+	sv := testAlbumDB(t)
+	shareKey = nil
+	t.Cleanup(func() {
+		shareKey = nil
+	})
+
+	album := &FileInfo{index: -1, Name: "Shared"}
+	if _, err := sv.AlbumDBUpdateAlbum(album); err != nil {
+		t.Fatal(err)
+	}
+	return sv, album
+}
+
+// Returns a share token signed for the share id and expiry.
+func testShareToken(t *testing.T, id int, expires int64) string {
+	key, err := shareSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := strconv.Itoa(id) + "." + strconv.FormatInt(expires, 10)
+	return payload + "." + shareMAC(key, payload)
+}
+
+func TestShareLookup(t *testing.T) {
+	sv, album := testShareDB(t)
+
+	expires := time.Now().Add(time.Hour)
+	good, err := sv.AlbumDBNewShare(album.index, expires, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := sv.AlbumDBNewShare(album.index, expires, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sv.AlbumDBRevokeShare(album.index, revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := sv.AlbumDBNewShare(album.index, expires, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour).Unix()
+	db, err := albumDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`update useralbumshare set expires = ? where idshare = ?`, past, expired.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := shareToken(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	later := strconv.FormatInt(expires.Add(24*time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"good", token, good.ID},
+		{"empty", "", 0},
+		{"malformed", "not a token", 0},
+		{"no mac", parts[0] + "." + parts[1], 0},
+		{"forged mac", parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2])), 0},
+		{"other share's mac", strconv.Itoa(revoked.ID) + "." + parts[1] + "." + parts[2], 0},
+		{"expiry changed", parts[0] + "." + later + "." + parts[2], 0},
+		{"expiry signed but not the share's", testShareToken(t, good.ID, expires.Add(24*time.Hour).Unix()), 0},
+		{"expired", testShareToken(t, expired.ID, past), 0},
+		{"revoked", testShareToken(t, revoked.ID, expires.Unix()), 0},
+		{"unknown share", testShareToken(t, good.ID+100, expires.Unix()), 0},
+	}
+	for _, tt := range tests {
+		s, err := shareLookup(tt.token)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		switch {
+		case tt.want == 0 && s != nil:
+			t.Errorf("%s: got share %d, want none", tt.name, s.ID)
+		case tt.want != 0 && (s == nil || s.ID != tt.want):
+			t.Errorf("%s: got %v, want share %d", tt.name, s, tt.want)
+		}
+	}
+}
+
+func TestShareUnlocked(t *testing.T) {
+	sv, album := testShareDB(t)
+
+	expires := time.Now().Add(time.Hour)
+	open, err := sv.AlbumDBNewShare(album.index, expires, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, err := sv.AlbumDBNewShare(album.index, expires, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := sv.AlbumDBNewShare(album.index, expires, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := shareSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := map[*albumShare]string{}
+	for _, s := range []*albumShare{open, locked, other} {
+		if tokens[s], err = shareToken(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unlock := func(s *albumShare) string {
+		return shareMAC(key, "unlock."+tokens[s])
+	}
+
+	tests := []struct {
+		name   string
+		share  *albumShare
+		cookie string
+		want   bool
+	}{
+		{"no password", open, "", true},
+		{"no cookie", locked, "", false},
+		{"own cookie", locked, unlock(locked), true},
+		{"other token's cookie", locked, unlock(other), false},
+		{"forged cookie", locked, strings.Repeat("A", len(unlock(locked))), false},
+		{"token as cookie", locked, tokens[locked], false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/share/"+tokens[tt.share], nil)
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: shareCookie, Value: tt.cookie})
+		}
+		if got := shareUnlocked(r, tt.share, tokens[tt.share]); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
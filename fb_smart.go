@@ -0,0 +1,464 @@
+// fb_smart.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lutfinasution/filebrowser/thumbnail"
+)
+
+// A smart album holds the files matching its SmartRule instead of the
+// ones put in it. Its items are kept in useralbumitems like those of
+// any other album, so their links, shares and downloads work the same,
+// and are brought up to date by AlbumDBRefreshSmart: on start, when
+// the rule changes and when the monitors publish changes under its
+// folder. Rules are evaluated against cache.db, so only files that
+// have had a thumbnail made are found.
+type SmartRule struct {
+	Folder         string     `json:"folder,omitempty"` // in or below it, anywhere if empty
+	ModifiedAfter  *time.Time `json:"modified_after,omitempty"`
+	ModifiedBefore *time.Time `json:"modified_before,omitempty"`
+	MinWidth       int        `json:"min_width,omitempty"`
+	MinHeight      int        `json:"min_height,omitempty"`
+	Extensions     []string   `json:"extensions,omitempty"` // ".jpg", any case
+	MinRating      int        `json:"min_rating,omitempty"`
+}
+
+const (
+	ratingMax  = 5
+	smartDelay = 3 * time.Second // for a burst of changes to settle
+)
+
+// ErrSmartAlbum is returned when adding or removing
+// items of a smart album, which follow its rule.
+var ErrSmartAlbum = errors.New("the items of a smart album follow its rule")
+
+var errSmartNoCache = errors.New("smart albums need the thumbnail cache")
+
+// Checks the rule, cleaning its folder and
+// extensions up for evaluation.
+func (r *SmartRule) normalize() error {
+	if r.Folder != "" {
+		r.Folder = filepath.Clean(r.Folder)
+	}
+	if r.MinWidth < 0 || r.MinHeight < 0 {
+		return errors.New("min_width and min_height can't be negative")
+	}
+	if r.MinRating < 0 || r.MinRating > ratingMax {
+		return fmt.Errorf("min_rating must be between 0 and %d", ratingMax)
+	}
+	if r.ModifiedAfter != nil && r.ModifiedBefore != nil && !r.ModifiedAfter.Before(*r.ModifiedBefore) {
+		return errors.New("modified_after must come before modified_before")
+	}
+	for i, v := range r.Extensions {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if !strings.HasPrefix(v, ".") {
+			v = "." + v
+		}
+		if !thumbnail.Supported(v) {
+			return fmt.Errorf("%s is not a supported image type", v)
+		}
+		r.Extensions[i] = v
+	}
+	return nil
+}
+
+// Reports whether changes in the folder dir may change the
+// members of the album, that is dir is in or below r.Folder.
+func (r *SmartRule) covers(dir string) bool {
+	if r.Folder == "" {
+		return true
+	}
+	if strings.EqualFold(dir, r.Folder) {
+		return true
+	}
+	prefix := strings.TrimSuffix(r.Folder, string(filepath.Separator)) + string(filepath.Separator)
+	return len(dir) > len(prefix) && strings.EqualFold(dir[:len(prefix)], prefix)
+}
+
+// Returns the conditions on usercache for the folder and
+// extensions of the rule. The others are checked on the files.
+func (r *SmartRule) where() (string, []interface{}) {
+	conds := []string{"itempath is not null"}
+	var args []interface{}
+
+	if r.Folder != "" {
+		prefix := strings.TrimSuffix(r.Folder, string(filepath.Separator)) + string(filepath.Separator)
+		conds = append(conds, `(dirpath = ? collate nocase or dirpath like ? escape '\')`)
+		args = append(args, r.Folder, likeEscape(prefix)+"%")
+	}
+	if len(r.Extensions) > 0 {
+		var ext []string
+		for _, v := range r.Extensions {
+			ext = append(ext, `itempath like ? escape '\'`)
+			args = append(args, "%"+likeEscape(v))
+		}
+		conds = append(conds, "("+strings.Join(ext, " or ")+")")
+	}
+	return "where " + strings.Join(conds, " and "), args
+}
+
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Reads a rule as stored in useralbum, nil for none.
+func parseSmartRule(s string) (*SmartRule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	r := new(SmartRule)
+	if err := json.Unmarshal([]byte(s), r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Returns the rule as stored in useralbum, NULL for none.
+func smartRuleValue(r *SmartRule) (interface{}, error) {
+	if r == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Returns the files in cache.db matching the rule r, as album items
+// with the thumbnail closest to the medium size that's been made.
+func smartRuleMatch(r *SmartRule) ([]*FileInfo, error) {
+	tv := Mw.thumbView
+	if !tv.doCache {
+		return nil, errSmartNoCache
+	}
+	if err := tv.OpenCacheDB(""); err != nil {
+		return nil, err
+	}
+	db := cacheDB()
+	if db == nil {
+		return nil, errSmartNoCache
+	}
+
+	var ratings map[string]int
+	if r.MinRating > 0 {
+		var err error
+		if ratings, err = albumDBRatings(r.MinRating); err != nil {
+			return nil, err
+		}
+	}
+
+	where, args := r.where()
+	rows, err := db.Query(`select itempath, tier, ifnull(imagewidth,0), ifnull(imageheight,0), itemdata,
+			 ifnull(itemsize,0), ifnull(itemmodtime,0), ifnull(itemhash,'')
+			 from usercache `+where+`
+			 order by itempath, tier`, args...)
+	if err != nil {
+		return nil, dbError("smartRuleMatch", err)
+	}
+	defer rows.Close()
+
+	type cacheRow struct {
+		path      string
+		tier      thumbnail.Tier
+		w, h      int
+		data      []byte
+		size, mod int64
+		hash      string
+	}
+	var found []*cacheRow
+	for rows.Next() {
+		v := new(cacheRow)
+		if err = rows.Scan(&v.path, &v.tier, &v.w, &v.h, &v.data, &v.size, &v.mod, &v.hash); err != nil {
+			return nil, dbError("smartRuleMatch", err)
+		}
+		// the rows of a file come by tier, the
+		// first at or above medium is the one kept.
+		if n := len(found); n > 0 && found[n-1].path == v.path {
+			if found[n-1].tier < thumbnail.TierMedium {
+				found[n-1] = v
+			}
+			continue
+		}
+		found = append(found, v)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, dbError("smartRuleMatch", err)
+	}
+	rows.Close()
+
+	var res []*FileInfo
+	for _, v := range found {
+		if r.MinRating > 0 && ratings[v.path] < r.MinRating {
+			continue
+		}
+		info, err := os.Stat(v.path)
+		if err != nil || info.IsDir() {
+			// gone since, cache.db is pruned later
+			continue
+		}
+		mod := info.ModTime()
+		if (r.ModifiedAfter != nil && mod.Before(*r.ModifiedAfter)) ||
+			(r.ModifiedBefore != nil && !mod.Before(*r.ModifiedBefore)) {
+			continue
+		}
+		// rows from before the image size was kept have none
+		if v.w == 0 && (r.MinWidth > 0 || r.MinHeight > 0) {
+			sz, err := GetImageInfo(v.path)
+			if err != nil {
+				continue
+			}
+			v.w, v.h = sz.Width, sz.Height
+		}
+		if v.w < r.MinWidth || v.h < r.MinHeight {
+			continue
+		}
+
+		item := &FileInfo{
+			Name:      filepath.Base(v.path),
+			URL:       filepath.Dir(v.path),
+			Size:      info.Size(),
+			Modified:  mod,
+			Width:     v.w,
+			Height:    v.h,
+			Imagedata: v.data,
+		}
+		if v.size == info.Size() && v.mod == mod.UnixNano() {
+			item.fingerprint = v.hash
+		}
+		res = append(res, item)
+	}
+	return res, nil
+}
+
+// one refresh at a time, so two can't add the same files
+var smartMu sync.Mutex
+
+// Brings the items of the smart album idAlbum in line with its rule,
+// adding the files now matching it and removing those no longer
+// matching. Items still matching are left as they are.
+func (sv *ScrollViewer) AlbumDBRefreshSmart(idAlbum int) (added int, removed int, err error) {
+	smartMu.Lock()
+	defer smartMu.Unlock()
+
+	album, err := sv.AlbumDBGetAlbum(idAlbum)
+	if err != nil {
+		return 0, 0, err
+	}
+	if album == nil || album.smart == nil {
+		return 0, 0, fmt.Errorf("album %d is not a smart album", idAlbum)
+	}
+	match, err := smartRuleMatch(album.smart)
+	if err != nil {
+		return 0, 0, err
+	}
+	items, err := sv.AlbumDBEnumItems(idAlbum)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	have := make(map[string]bool)
+	for _, v := range items {
+		have[filepath.Join(v.URL, v.Name)] = true
+	}
+	want := make(map[string]bool)
+	var add, remove []*FileInfo
+	for _, v := range match {
+		key := filepath.Join(v.URL, v.Name)
+		want[key] = true
+		if !have[key] {
+			add = append(add, v)
+		}
+	}
+	for _, v := range items {
+		if !want[filepath.Join(v.URL, v.Name)] {
+			remove = append(remove, v)
+		}
+	}
+
+	if len(add) > 0 {
+		if _, err = sv.AlbumDBUpdateItems(idAlbum, add); err != nil {
+			return 0, 0, err
+		}
+	}
+	if len(remove) > 0 {
+		if _, err = sv.AlbumDBDeleteItems(remove); err != nil {
+			return len(add), 0, err
+		}
+	}
+	log.Println("AlbumDBRefreshSmart", idAlbum, len(add), "added,", len(remove), "removed")
+	return len(add), len(remove), nil
+}
+
+// Sets the rule of the album idAlbum, nil making it a plain album
+// again with the items it has. The items are refreshed by the caller.
+func (sv *ScrollViewer) AlbumDBSetSmartRule(idAlbum int, rule *SmartRule) (rcnt int64, err error) {
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
+	}
+	val, err := smartRuleValue(rule)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec(`update useralbum set smartrule = ? where idalbum = ?`, val, idAlbum)
+	if err != nil {
+		return 0, albumDBError(db, "AlbumDBSetSmartRule", err)
+	}
+	rcnt, _ = res.RowsAffected()
+	return rcnt, nil
+}
+
+// Refreshes the smart albums with a rule covering one of dirs,
+// all of them if dirs is nil, and has the album view catch up.
+func RefreshSmartAlbums(dirs map[string]bool) {
+	albums, err := Mw.albumView.AlbumDBGetAlbums()
+	if err != nil {
+		log.Println("RefreshSmartAlbums", err)
+		return
+	}
+	changed := false
+	for _, v := range albums {
+		if v.smart == nil || !smartCovers(v.smart, dirs) {
+			continue
+		}
+		added, removed, err := Mw.albumView.AlbumDBRefreshSmart(v.index)
+		if err != nil {
+			log.Println("RefreshSmartAlbums", v.Name, err)
+			if err == errSmartNoCache {
+				return
+			}
+			continue
+		}
+		changed = changed || added+removed > 0
+	}
+	if changed {
+		apiAlbumsChanged()
+	}
+}
+
+func smartCovers(r *SmartRule, dirs map[string]bool) bool {
+	if dirs == nil {
+		return true
+	}
+	for dir := range dirs {
+		if r.covers(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// The folders changed since the last refresh, which
+// runs once no changes came in for smartDelay.
+var smartPending struct {
+	sync.Mutex
+	dirs  map[string]bool
+	timer *time.Timer
+}
+
+// Schedules a refresh of the smart albums covering dir.
+func smartAlbumsTouch(dir string) {
+	smartPending.Lock()
+	defer smartPending.Unlock()
+
+	if smartPending.dirs == nil {
+		smartPending.dirs = make(map[string]bool)
+	}
+	smartPending.dirs[dir] = true
+	if smartPending.timer == nil {
+		smartPending.timer = time.AfterFunc(smartDelay, func() {
+			smartPending.Lock()
+			dirs := smartPending.dirs
+			smartPending.dirs = nil
+			smartPending.Unlock()
+
+			RefreshSmartAlbums(dirs)
+		})
+	} else {
+		smartPending.timer.Reset(smartDelay)
+	}
+}
+
+// Refreshes all smart albums, as the files may have changed while
+// the application was closed, then follows the library events.
+func StartSmartAlbums() {
+	Events.Watch(func(ev LibraryEvent) {
+		smartAlbumsTouch(ev.Dir)
+	})
+	RefreshSmartAlbums(nil)
+}
+
+//------------------------------------------------
+// RATINGS
+//------------------------------------------------
+
+// Rates the image file path from 1 to ratingMax,
+// 0 clearing its rating.
+func (sv *ScrollViewer) AlbumDBSetRating(path string, rating int) error {
+	if rating < 0 || rating > ratingMax {
+		return fmt.Errorf("rating must be between 0 and %d", ratingMax)
+	}
+	db, err := albumDB()
+	if err != nil {
+		return err
+	}
+	if rating == 0 {
+		_, err = db.Exec(`delete from userrating where itempath = ?`, path)
+	} else {
+		_, err = db.Exec(`INSERT OR REPLACE into userrating(itempath, rating) values(?, ?)`, path, rating)
+	}
+	if err != nil {
+		return albumDBError(db, "AlbumDBSetRating", err)
+	}
+	smartAlbumsTouch(filepath.Dir(path))
+	return nil
+}
+
+// Returns the rating of the image file path, 0 if it has none.
+func (sv *ScrollViewer) AlbumDBGetRating(path string) (int, error) {
+	db, err := albumDB()
+	if err != nil {
+		return 0, err
+	}
+	var rating int
+	err = db.QueryRow(`select rating from userrating where itempath = ?`, path).Scan(&rating)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return rating, albumDBError(db, "AlbumDBGetRating", err)
+}
+
+// Returns the ratings of min and above by file path.
+func albumDBRatings(min int) (map[string]int, error) {
+	db, err := albumDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`select itempath, rating from userrating where rating >= ?`, min)
+	if err != nil {
+		return nil, albumDBError(db, "albumDBRatings", err)
+	}
+	defer rows.Close()
+
+	res := make(map[string]int)
+	for rows.Next() {
+		var path string
+		var rating int
+		if err = rows.Scan(&path, &rating); err != nil {
+			return nil, albumDBError(db, "albumDBRatings", err)
+		}
+		res[path] = rating
+	}
+	return res, albumDBError(db, "albumDBRatings", rows.Err())
+}
@@ -0,0 +1,324 @@
+// fb_templates.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Directory with .html files replacing the built in templates of the
+// same name, layout.html, style.html, album.html and so on. Templates
+// not found there are the built in ones. Set from the WebTemplates
+// setting or -templates.
+var NetTemplateDir string
+
+// Fields every page has. Share is set on the pages of a
+// share link, which show nothing of the rest of the site.
+type netPage struct {
+	Title string
+	User  *webUser
+	Share bool
+}
+
+type netLink struct {
+	Name string
+	URL  string
+}
+
+// An image of a gallery: its thumbnail, the size the lightbox
+// shows and the original file, empty when it isn't offered.
+type netImage struct {
+	Name     string
+	Thumb    string
+	View     string
+	Original string
+}
+
+type netAlbum struct {
+	Name        string
+	Description string
+	Date        time.Time
+	Items       int64
+	Cover       string
+	URL         string
+}
+
+// The links between the pages of a paged list.
+type netPager struct {
+	Page    int // 1 based
+	Pages   int
+	PrevURL string
+	NextURL string
+}
+
+// Returns the pager for page of a list of total entries, perPage to a
+// page, and the range of the entries on it. pageURL makes the link to
+// another page.
+func netPaging(page, perPage, total int, pageURL func(page int) string) (p netPager, first int, last int) {
+	p.Pages = (total + perPage - 1) / perPage
+	if p.Pages < 1 {
+		p.Pages = 1
+	}
+	if page < 1 {
+		page = 1
+	}
+	if page > p.Pages {
+		page = p.Pages
+	}
+	p.Page = page
+	if page > 1 {
+		p.PrevURL = pageURL(page - 1)
+	}
+	if page < p.Pages {
+		p.NextURL = pageURL(page + 1)
+	}
+
+	first = (page - 1) * perPage
+	last = first + perPage
+	if last > total {
+		last = total
+	}
+	return p, first, last
+}
+
+var netTemplateFuncs = template.FuncMap{
+	"add": func(a, b int) int { return a + b },
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2 January 2006")
+	},
+	"datetime": func(t time.Time) string { return t.Format("2 January 2006 15:04") },
+}
+
+// The built in templates. Those in netTemplateParts are shared by
+// all pages, each of the others is a page defining "content".
+var netTemplateSources = map[string]string{
+	"layout": `{{define "layout"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>{{template "style"}}</style>
+</head>
+<body>
+<header>
+{{if not .Share}}<nav>
+<a href="/users/albums">Albums</a>
+{{if .User}}<a href="/users/photos">Folders</a>
+<form class="signout" method="post" action="/logout">{{.User.Name}} <button type="submit">Sign out</button></form>
+{{else}}<a class="signin" href="/login">Sign in</a>{{end}}
+</nav>{{end}}
+<h1>{{.Title}}</h1>
+</header>
+<main>
+{{template "content" .}}
+</main>
+</body>
+</html>
+{{end}}`,
+
+	"style": `{{define "style"}}
+body { margin: 0; font-family: sans-serif; background: #fafafa; color: #222; }
+header { padding: 8px 16px; background: #333; color: #eee; }
+header h1 { margin: 8px 0; font-size: 1.4em; overflow-wrap: anywhere; }
+header a { color: #eee; }
+nav { display: flex; gap: 16px; align-items: center; }
+nav .signin, nav .signout { margin-left: auto; }
+main { padding: 16px; }
+a { color: #06c; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(160px, 1fr)); gap: 8px; }
+.grid img { display: block; width: 100%; aspect-ratio: 1; object-fit: cover; background: #ddd; }
+.album { display: block; text-decoration: none; color: inherit; }
+.album strong, .album span, .album small { display: block; margin-top: 4px; overflow-wrap: anywhere; }
+.album small, .meta { color: #777; }
+.folders { list-style: none; padding: 0; }
+.folders li { padding: 4px 0; }
+.grid.albums { margin-bottom: 16px; }
+.pager { margin: 16px 0; text-align: center; }
+.pager a { margin: 0 8px; }
+.error { color: #c00; }
+form.login label { display: block; margin: 8px 0; }
+.lightbox { display: none; position: fixed; top: 0; left: 0; right: 0; bottom: 0; z-index: 10;
+	background: rgba(0, 0, 0, 0.92); color: #eee; flex-direction: column; align-items: center; justify-content: center; }
+.lightbox:target { display: flex; }
+.lightbox img { max-width: 96vw; max-height: 88vh; }
+.lightbox a { color: #eee; text-decoration: none; }
+.lightbox .close { position: absolute; top: 8px; right: 16px; font-size: 2em; }
+.lightbox .prev, .lightbox .next { position: absolute; top: 45%; font-size: 3em; padding: 0 16px; }
+.lightbox .prev { left: 0; }
+.lightbox .next { right: 0; }
+.lightbox p a { text-decoration: underline; }
+{{end}}`,
+
+	// the lightbox is css only: it shows when its
+	// #img-n is the target of the page address.
+	"gallery": `{{define "gallery"}}<div class="grid">
+{{range $i, $v := .}}<a href="#img-{{$i}}"><img src="{{$v.Thumb}}" alt="{{$v.Name}}" title="{{$v.Name}}" loading="lazy"></a>
+{{end}}</div>
+{{range $i, $v := .}}<div class="lightbox" id="img-{{$i}}">
+<a class="close" href="#_" title="Close">&times;</a>
+{{if gt $i 0}}<a class="prev" href="#img-{{add $i -1}}" title="Previous">&lsaquo;</a>{{end}}
+{{if lt (add $i 1) (len $)}}<a class="next" href="#img-{{add $i 1}}" title="Next">&rsaquo;</a>{{end}}
+<img src="{{$v.View}}" alt="{{$v.Name}}" loading="lazy">
+<p>{{$v.Name}}{{if $v.Original}} &middot; <a href="{{$v.Original}}">Original</a>{{end}}</p>
+</div>
+{{end}}{{end}}`,
+
+	// albums with their covers, the items counting
+	// in those of their sub-albums.
+	"albumgrid": `{{define "albumgrid"}}<div class="grid albums">
+{{range .}}<a class="album" href="{{.URL}}">
+<img src="{{.Cover}}" alt="" loading="lazy">
+<strong>{{.Name}}</strong>
+{{if .Description}}<span>{{.Description}}</span>{{end}}
+<small>{{.Items}} items{{with date .Date}} &middot; {{.}}{{end}}</small>
+</a>
+{{end}}</div>{{end}}`,
+
+	"pager": `{{define "pager"}}{{if gt .Pages 1}}<nav class="pager">
+{{if .PrevURL}}<a href="{{.PrevURL}}">&lsaquo; Previous</a>{{end}}
+Page {{.Page}} of {{.Pages}}
+{{if .NextURL}}<a href="{{.NextURL}}">Next &rsaquo;</a>{{end}}
+</nav>{{end}}{{end}}`,
+
+	"login": `{{define "content"}}{{if .Message}}<p class="error">{{.Message}}</p>{{end}}
+<form class="login" method="post" action="/login">
+<input type="hidden" name="next" value="{{.Next}}">
+<label>User <input type="text" name="username" autocomplete="username" autofocus></label>
+<label>Password <input type="password" name="password" autocomplete="current-password"></label>
+<button type="submit">Sign in</button>
+</form>{{end}}`,
+
+	"folders": `{{define "content"}}<ul class="folders">
+{{range .Folders}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{else}}<li>No folders are served.</li>
+{{end}}</ul>{{end}}`,
+
+	"folder": `{{define "content"}}<ul class="folders">
+<li><a href="{{.Up}}">..</a></li>
+{{range .Folders}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+{{template "gallery" .Items}}
+{{template "pager" .Pager}}{{end}}`,
+
+	"albums": `{{define "content"}}{{if .Albums}}{{template "albumgrid" .Albums}}{{else}}<p>There are no albums to show.</p>{{end}}
+{{template "pager" .Pager}}{{end}}`,
+
+	"album": `{{define "content"}}{{if .Album.Description}}<p>{{.Album.Description}}</p>{{end}}
+<p class="meta">{{.Album.Items}} items{{with date .Album.Date}} &middot; {{.}}{{end}}
+&middot; <a href="{{.ZipURL}}">Download all</a> <a href="{{.ZipURL}}?resize=1600">(resized)</a></p>
+{{if .Albums}}{{template "albumgrid" .Albums}}{{end}}
+{{template "gallery" .Items}}
+{{template "pager" .Pager}}
+{{if not .Expires.IsZero}}<p class="meta">This link expires on {{datetime .Expires}}.</p>{{end}}{{end}}`,
+
+	"sharelock": `{{define "content"}}{{if .Message}}<p class="error">{{.Message}}</p>{{end}}
+<form class="login" method="post" action="{{.Action}}">
+<label>Password <input type="password" name="password" autofocus></label>
+<button type="submit">Open</button>
+</form>{{end}}`,
+}
+
+var netTemplateParts = []string{"layout", "style", "gallery", "albumgrid", "pager"}
+
+var (
+	netTmplMu sync.Mutex
+	netTmpl   map[string]*template.Template
+)
+
+// Parses the pages from the built in templates and those in
+// dir, if not empty, and makes them the ones netRender uses.
+// On error the pages in use are left as they are.
+func LoadTemplates(dir string) error {
+	src := make(map[string]string)
+	for k, v := range netTemplateSources {
+		src[k] = v
+	}
+	if dir != "" {
+		for k := range src {
+			data, err := ioutil.ReadFile(filepath.Join(dir, k+".html"))
+			if err == nil {
+				src[k] = string(data)
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	base := template.New("base").Funcs(netTemplateFuncs)
+	for _, k := range netTemplateParts {
+		if _, err := base.New(k).Parse(src[k]); err != nil {
+			return err
+		}
+	}
+	pages := make(map[string]*template.Template)
+	for k, v := range src {
+		if isTemplatePart(k) {
+			continue
+		}
+		t, err := base.Clone()
+		if err != nil {
+			return err
+		}
+		if _, err = t.New(k).Parse(v); err != nil {
+			return err
+		}
+		pages[k] = t
+	}
+
+	netTmplMu.Lock()
+	netTmpl = pages
+	netTmplMu.Unlock()
+	return nil
+}
+
+func isTemplatePart(name string) bool {
+	for _, v := range netTemplateParts {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the page called name with data and status. The page is
+// rendered in full first, so a template error can still go out as
+// an error.
+func netRender(w http.ResponseWriter, status int, name string, data interface{}) {
+	netTmplMu.Lock()
+	if netTmpl == nil {
+		netTmplMu.Unlock()
+		if err := LoadTemplates(""); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		netTmplMu.Lock()
+	}
+	t := netTmpl[name]
+	netTmplMu.Unlock()
+
+	if t == nil {
+		http.Error(w, fmt.Sprintf("no template %q", name), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, "layout", data); err != nil {
+		log.Println("netRender", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
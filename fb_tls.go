@@ -0,0 +1,105 @@
+// fb_tls.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How long a generated certificate is valid. It is
+// replaced once less than a tenth of that is left.
+const selfSignedLifetime = 365 * 24 * time.Hour
+
+// Returns the certificate and key files of a self signed
+// certificate for the http server, kept next to the databases.
+// The files are generated the first time, and again when
+// they are about to expire or can't be loaded.
+func selfSignedCert() (certFile string, keyFile string, err error) {
+	certFile = dbPath("", "netcert.pem")
+	keyFile = dbPath("", "netkey.pem")
+
+	if selfSignedValid(certFile, keyFile) {
+		return certFile, keyFile, nil
+	}
+	if err = os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return "", "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"GoImageBrowser"}, CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	if host, _, err := net.SplitHostPort(NetAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if ip == nil && host != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return "", "", err
+	}
+	log.Println("self signed certificate generated", certFile)
+	return certFile, keyFile, nil
+}
+
+// Reports whether the key pair in certFile and keyFile
+// loads and is good for a while yet.
+func selfSignedValid(certFile string, keyFile string) bool {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return false
+	}
+	return time.Now().Add(selfSignedLifetime / 10).Before(cert.NotAfter)
+}
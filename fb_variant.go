@@ -0,0 +1,322 @@
+// fb_variant.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/anthonynsimon/bild/transform"
+	"github.com/lutfinasution/filebrowser/thumbnail"
+)
+
+// Resized copies of images, rendered on request and kept on disk in
+// the variants directory next to cache.db, up to VariantBudget bytes.
+var VariantBudget int64 = 512 << 20
+
+const (
+	variantMaxSize        = 4096
+	variantDefaultQuality = 80
+	variantPruneEvery     = 64 // writes
+)
+
+// How an image is to be resized: fitted into Width x Height
+// keeping its aspect ratio (contain), scaled to cover the box and
+// cropped to it (cover), or stretched to it (fill). Images are
+// never enlarged by contain. A zero Width or Height leaves that
+// side unbounded, which only contain allows.
+type variantSpec struct {
+	Width   int
+	Height  int
+	Fit     string // contain, cover or fill
+	Quality int    // jpeg quality, 1-100
+	Format  string // jpeg or png
+}
+
+// Reads a variantSpec from the width, height, fit, quality and
+// format query parameters. ok is false when neither width nor
+// height is given, which asks for the original.
+func parseVariant(q url.Values) (spec variantSpec, ok bool, err error) {
+	spec = variantSpec{Fit: "contain", Quality: variantDefaultQuality, Format: "jpeg"}
+
+	num := func(key string, min, max int) (int, error) {
+		s := q.Get(key)
+		if s == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%s must be between %d and %d", key, min, max)
+		}
+		return n, nil
+	}
+	if spec.Width, err = num("width", 1, variantMaxSize); err != nil {
+		return spec, false, err
+	}
+	if spec.Height, err = num("height", 1, variantMaxSize); err != nil {
+		return spec, false, err
+	}
+	if spec.Width == 0 && spec.Height == 0 {
+		return spec, false, nil
+	}
+	if n, err := num("quality", 1, 100); err != nil {
+		return spec, false, err
+	} else if n != 0 {
+		spec.Quality = n
+	}
+
+	switch s := q.Get("fit"); s {
+	case "", "contain":
+	case "cover", "fill":
+		if spec.Width == 0 || spec.Height == 0 {
+			return spec, false, fmt.Errorf("fit=%s needs both width and height", s)
+		}
+		spec.Fit = s
+	default:
+		return spec, false, fmt.Errorf("fit must be contain, cover or fill")
+	}
+
+	switch s := q.Get("format"); s {
+	case "", "jpeg", "jpg":
+	case "png":
+		spec.Format = "png"
+		spec.Quality = 0
+	default:
+		return spec, false, fmt.Errorf("format must be jpeg or png")
+	}
+	return spec, true, nil
+}
+
+func (s variantSpec) ContentType() string {
+	return serveContentTypes["."+s.Format]
+}
+
+// Returns whether the image file name can go out as it is,
+// being of the right format and fitting without resizing.
+func (s variantSpec) fitsAsIs(name string, srcW, srcH int) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	if serveContentTypes[ext] != s.ContentType() || s.Fit != "contain" {
+		return false
+	}
+	return (s.Width == 0 || srcW <= s.Width) && (s.Height == 0 || srcH <= s.Height)
+}
+
+// Returns the size the image is resized to and, for cover,
+// the size it is then cropped to. All are 0 for an image of
+// no size.
+func (s variantSpec) sizes(srcW, srcH int) (w, h, cropW, cropH int) {
+	if srcW <= 0 || srcH <= 0 {
+		return 0, 0, 0, 0
+	}
+	switch s.Fit {
+	case "fill":
+		return s.Width, s.Height, s.Width, s.Height
+	case "cover":
+		scale := math.Max(float64(s.Width)/float64(srcW), float64(s.Height)/float64(srcH))
+		w = int(math.Ceil(float64(srcW) * scale))
+		h = int(math.Ceil(float64(srcH) * scale))
+		return w, h, s.Width, s.Height
+	}
+
+	dstW, dstH := s.Width, s.Height
+	if dstW == 0 {
+		dstW = variantMaxSize
+	}
+	if dstH == 0 {
+		dstH = variantMaxSize
+	}
+	w, h = getOptimalThumbSize(dstW, dstH, srcW, srcH)
+	if w > srcW || h > srcH {
+		w, h = srcW, srcH
+	}
+	return w, h, w, h
+}
+
+// Returns the cache file name of the variant spec of the image
+// file name, as it is at size and modtime.
+func (s variantSpec) cacheName(name string, size int64, modtime time.Time) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%d|%d|%s|%d|%s",
+		name, size, modtime.UnixNano(), s.Width, s.Height, s.Fit, s.Quality, s.Format)))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(dbPath("", "variants"), key[:2], key+"."+s.Format)
+}
+
+// Returns the file holding the variant spec of the image file
+// name, rendering it into the variant cache if it isn't there.
+// That is name itself when the image fits the spec as it is.
+func variantFile(name string, spec variantSpec) (string, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	sz, err := GetImageInfo(name)
+	if err != nil {
+		return "", err
+	}
+	if spec.fitsAsIs(name, sz.Width, sz.Height) {
+		return name, nil
+	}
+
+	fn := spec.cacheName(name, info.Size(), info.ModTime())
+	if _, err := os.Stat(fn); err == nil {
+		// the mtime tells VariantCachePrune what was used last
+		now := time.Now()
+		os.Chtimes(fn, now, now)
+		return fn, nil
+	}
+
+	data, err := renderVariant(name, spec, sz.Width, sz.Height)
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), "tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if atomic.AddInt64(&variantWrites, 1)%variantPruneEvery == 0 {
+		go func() {
+			if _, err := VariantCachePrune(); err != nil {
+				log.Println("VariantCachePrune", err)
+			}
+		}()
+	}
+	return fn, nil
+}
+
+var variantWrites int64
+
+// Decodes, resizes and encodes the image file name,
+// srcW x srcH in size, as spec asks.
+func renderVariant(name string, spec variantSpec, srcW, srcH int) ([]byte, error) {
+	w, h, cropW, cropH := spec.sizes(srcW, srcH)
+	if w <= 0 || h <= 0 {
+		return nil, thumbnail.ErrTooSmall
+	}
+
+	img, err := thumbnail.DecodeFile(name, w, h)
+	if err != nil {
+		return nil, err
+	}
+	var res image.Image = transform.Resize(img, w, h, transform.MitchellNetravali)
+	if cropW < w || cropH < h {
+		x, y := (w-cropW)/2, (h-cropH)/2
+		res = res.(*image.RGBA).SubImage(image.Rect(x, y, x+cropW, y+cropH))
+	}
+
+	if spec.Format == "png" {
+		buf := new(bytes.Buffer)
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		if err := enc.Encode(buf, res); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	opt := thumbnail.DefaultOptions()
+	opt.Quality = spec.Quality
+	return thumbnail.New(opt).Encode(res)
+}
+
+// Writes the variant spec of the image file name, which has
+// been through sandboxPath. Nothing is written on failure.
+func serveVariant(w http.ResponseWriter, r *http.Request, name string, spec variantSpec) error {
+	fn, err := variantFile(name, spec)
+	if err != nil {
+		return err
+	}
+	if fn == name {
+		return serveImageFile(w, r, name)
+	}
+
+	src, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", spec.ContentType())
+	h.Set("ETag", `"`+strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))+`"`)
+	h.Set("Cache-Control", serveCacheControl)
+	http.ServeContent(w, r, "", src.ModTime(), f)
+	return nil
+}
+
+// Removes the least recently used variants until the
+// cache is down to nine tenths of VariantBudget.
+func VariantCachePrune() (removed int64, err error) {
+	type entry struct {
+		name    string
+		size    int64
+		modtime time.Time
+	}
+	var files []entry
+	var total int64
+
+	root := dbPath("", "variants")
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, entry{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil || total <= VariantBudget {
+		return 0, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modtime.Before(files[j].modtime) })
+
+	target := VariantBudget / 10 * 9
+	for _, v := range files {
+		if total <= target {
+			break
+		}
+		if err := os.Remove(v.name); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		total -= v.size
+		removed++
+	}
+	log.Println("variant cache pruned", removed, "files")
+	return removed, nil
+}
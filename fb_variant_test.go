@@ -0,0 +1,124 @@
+// fb_variant_test
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseVariant(t *testing.T) {
+	tests := []struct {
+		query string
+		want  variantSpec
+		ok    bool
+		err   bool
+	}{
+		{"", variantSpec{}, false, false},
+		{"fit=cover&format=png", variantSpec{}, false, false},
+		{"width=100", variantSpec{100, 0, "contain", 80, "jpeg"}, true, false},
+		{"height=50&quality=90", variantSpec{0, 50, "contain", 90, "jpeg"}, true, false},
+		{"width=100&height=50&fit=contain&format=jpg", variantSpec{100, 50, "contain", 80, "jpeg"}, true, false},
+		{"width=100&height=50&fit=cover", variantSpec{100, 50, "cover", 80, "jpeg"}, true, false},
+		{"width=100&height=50&fit=fill", variantSpec{100, 50, "fill", 80, "jpeg"}, true, false},
+		{"width=4096&height=4096", variantSpec{4096, 4096, "contain", 80, "jpeg"}, true, false},
+
+		// png has no quality, whatever was asked
+		{"width=100&format=png", variantSpec{100, 0, "contain", 0, "png"}, true, false},
+		{"width=100&format=png&quality=50", variantSpec{100, 0, "contain", 0, "png"}, true, false},
+
+		// cover and fill need both sides
+		{"width=100&fit=cover", variantSpec{}, false, true},
+		{"height=100&fit=cover", variantSpec{}, false, true},
+		{"width=100&fit=fill", variantSpec{}, false, true},
+		{"height=100&fit=fill", variantSpec{}, false, true},
+
+		{"width=0", variantSpec{}, false, true},
+		{"width=-1", variantSpec{}, false, true},
+		{"width=4097", variantSpec{}, false, true},
+		{"width=abc", variantSpec{}, false, true},
+		{"width=100&height=1e3", variantSpec{}, false, true},
+		{"width=100&quality=0", variantSpec{}, false, true},
+		{"width=100&quality=101", variantSpec{}, false, true},
+		{"width=100&fit=stretch", variantSpec{}, false, true},
+		{"width=100&format=gif", variantSpec{}, false, true},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec, ok, err := parseVariant(q)
+		if (err != nil) != tt.err || ok != tt.ok {
+			t.Errorf("%q: got ok %v, %v, want ok %v, error %v", tt.query, ok, err, tt.ok, tt.err)
+			continue
+		}
+		if ok && spec != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.query, spec, tt.want)
+		}
+	}
+}
+
+func TestVariantSizes(t *testing.T) {
+	tests := []struct {
+		name       string
+		spec       variantSpec
+		srcW, srcH int
+		want       [4]int
+	}{
+		{"contain", variantSpec{Width: 800, Height: 600, Fit: "contain"}, 4000, 3000, [4]int{800, 600, 800, 600}},
+		{"contain narrower box", variantSpec{Width: 800, Height: 800, Fit: "contain"}, 4000, 2000, [4]int{800, 400, 800, 400}},
+		{"contain portrait", variantSpec{Width: 800, Height: 800, Fit: "contain"}, 2000, 4000, [4]int{400, 800, 400, 800}},
+
+		// a zero side is unbounded
+		{"contain width only", variantSpec{Width: 1000, Fit: "contain"}, 4000, 3000, [4]int{1000, 750, 1000, 750}},
+		{"contain height only", variantSpec{Height: 256, Fit: "contain"}, 2048, 4096, [4]int{128, 256, 128, 256}},
+		{"contain width only, capped", variantSpec{Width: 100, Fit: "contain"}, 100, 8000, [4]int{52, 4096, 52, 4096}},
+
+		// contain never enlarges
+		{"contain small image", variantSpec{Width: 2000, Height: 2000, Fit: "contain"}, 400, 300, [4]int{400, 300, 400, 300}},
+		{"contain small image, width only", variantSpec{Width: 2000, Fit: "contain"}, 400, 300, [4]int{400, 300, 400, 300}},
+
+		{"cover", variantSpec{Width: 400, Height: 100, Fit: "cover"}, 800, 400, [4]int{400, 200, 400, 100}},
+		{"cover enlarges", variantSpec{Width: 400, Height: 400, Fit: "cover"}, 200, 100, [4]int{800, 400, 400, 400}},
+		{"fill", variantSpec{Width: 300, Height: 100, Fit: "fill"}, 800, 600, [4]int{300, 100, 300, 100}},
+
+		{"no width", variantSpec{Width: 100, Height: 100, Fit: "contain"}, 0, 100, [4]int{}},
+		{"no height", variantSpec{Width: 100, Height: 100, Fit: "cover"}, 100, 0, [4]int{}},
+	}
+	for _, tt := range tests {
+		w, h, cw, ch := tt.spec.sizes(tt.srcW, tt.srcH)
+		if got := [4]int{w, h, cw, ch}; got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVariantFitsAsIs(t *testing.T) {
+	jpeg := variantSpec{Width: 1000, Height: 1000, Fit: "contain", Quality: 80, Format: "jpeg"}
+	png := variantSpec{Width: 1000, Height: 1000, Fit: "contain", Format: "png"}
+	wide := variantSpec{Width: 1000, Fit: "contain", Quality: 80, Format: "jpeg"}
+	cover := variantSpec{Width: 1000, Height: 1000, Fit: "cover", Quality: 80, Format: "jpeg"}
+
+	tests := []struct {
+		spec       variantSpec
+		name       string
+		srcW, srcH int
+		want       bool
+	}{
+		{jpeg, "a.jpg", 800, 600, true},
+		{jpeg, "a.JPEG", 1000, 1000, true},
+		{jpeg, "a.jpg", 1001, 600, false},
+		{jpeg, "a.jpg", 800, 1001, false},
+		{jpeg, "a.png", 800, 600, false},
+		{png, "a.png", 800, 600, true},
+		{png, "a.jpg", 800, 600, false},
+		{wide, "a.jpg", 900, 5000, true},
+		{wide, "a.jpg", 1100, 500, false},
+		{cover, "a.jpg", 800, 600, false},
+	}
+	for _, tt := range tests {
+		if got := tt.spec.fitsAsIs(tt.name, tt.srcW, tt.srcH); got != tt.want {
+			t.Errorf("%+v, %s %dx%d: got %v, want %v", tt.spec, tt.name, tt.srcW, tt.srcH, got, tt.want)
+		}
+	}
+}
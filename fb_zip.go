@@ -0,0 +1,180 @@
+// fb_zip.go
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	zipMinResize = 64
+	zipMaxResize = variantMaxSize
+)
+
+// Reads the items and resize query parameters of a ZIP download:
+// the comma separated ids of the album items wanted, all of them
+// when left out, and the bounding box the images are fitted into,
+// 0 for the originals.
+func zipParams(r *http.Request) (ids []int, resize int, err error) {
+	q := r.URL.Query()
+	if s := q.Get("items"); s != "" {
+		for _, v := range strings.Split(s, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid item id %q", v)
+			}
+			ids = append(ids, id)
+		}
+	}
+	if s := q.Get("resize"); s != "" && s != "original" {
+		if resize, err = strconv.Atoi(s); err != nil || resize < zipMinResize || resize > zipMaxResize {
+			return nil, 0, fmt.Errorf("resize must be between %d and %d pixels", zipMinResize, zipMaxResize)
+		}
+	}
+	return ids, resize, nil
+}
+
+// Returns the album items with the given ids, in album
+// order, or all of them if ids is empty.
+func zipSelectItems(items []*FileInfo, ids []int) ([]*FileInfo, error) {
+	if len(ids) == 0 {
+		return items, nil
+	}
+	want := make(map[int]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+	var res []*FileInfo
+	for _, v := range items {
+		if want[v.index] {
+			res = append(res, v)
+			delete(want, v.index)
+		}
+	}
+	for id := range want {
+		return nil, fmt.Errorf("no item %d in the album", id)
+	}
+	return res, nil
+}
+
+// Streams items as the ZIP archive name.zip, built as it is sent.
+// With resize above 0 the images are fitted into resize x resize
+// and sent as jpegs from the variant cache, otherwise the original
+// files go in as they are. Items that can't be read are logged and
+// left out, as the response is under way by then.
+func serveZip(w http.ResponseWriter, r *http.Request, name string, items []*FileInfo, resize int) {
+	h := w.Header()
+	h.Set("Content-Type", "application/zip")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	h.Set("Cache-Control", "private, no-store")
+
+	zw := zip.NewWriter(w)
+	names := make(map[string]int)
+
+	for _, v := range items {
+		fn, err := sandboxAlbumPath(filepath.Join(v.URL, v.Name))
+		if err == nil {
+			err = zipAddFile(zw, names, fn, resize)
+		}
+		if err != nil {
+			if _, ok := err.(zipWriteError); ok {
+				log.Println("serveZip", name, err)
+				return
+			}
+			log.Println("serveZip", name, "skipped", v.Name, err)
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Println("serveZip", name, err)
+	}
+}
+
+// A failure to write to the client, after which
+// nothing more can go into the archive.
+type zipWriteError struct {
+	err error
+}
+
+func (e zipWriteError) Error() string {
+	return "zip write failed: " + e.err.Error()
+}
+
+// Adds the image file fn to zw, under a name not yet in names.
+func zipAddFile(zw *zip.Writer, names map[string]int, fn string, resize int) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.PathError{Op: "open", Path: fn, Err: os.ErrNotExist}
+	}
+
+	var src io.Reader = f
+	base := filepath.Base(fn)
+	if resize > 0 {
+		spec := variantSpec{Width: resize, Height: resize, Fit: "contain", Quality: 85, Format: "jpeg"}
+		vfn, err := variantFile(fn, spec)
+		if err != nil {
+			return err
+		}
+		if vfn != fn {
+			vf, err := os.Open(vfn)
+			if err != nil {
+				return err
+			}
+			defer vf.Close()
+			src = vf
+			base = strings.TrimSuffix(base, filepath.Ext(base)) + ".jpg"
+		}
+	}
+
+	fh := &zip.FileHeader{Name: zipUniqueName(names, base), Method: zip.Store}
+	fh.Modified = info.ModTime()
+	switch strings.ToLower(filepath.Ext(fh.Name)) {
+	case ".bmp", ".tif", ".tiff":
+		// the others are compressed already
+		fh.Method = zip.Deflate
+	}
+
+	zf, err := zw.CreateHeader(fh)
+	if err != nil {
+		return zipWriteError{err}
+	}
+	if _, err = io.Copy(zf, src); err != nil {
+		// a read error halfway leaves a broken entry
+		// just the same, so the archive ends here.
+		return zipWriteError{err}
+	}
+	return nil
+}
+
+// Returns base, or base with a number added if it
+// is in names already, and adds the result to names.
+func zipUniqueName(names map[string]int, base string) string {
+	key := strings.ToLower(base)
+	n := names[key]
+	names[key] = n + 1
+	if n == 0 {
+		return base
+	}
+	ext := filepath.Ext(base)
+	res := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), n+1, ext)
+	return zipUniqueName(names, res)
+}
@@ -0,0 +1,108 @@
+// fb_zip_test
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestZipParams(t *testing.T) {
+	tests := []struct {
+		query  string
+		ids    []int
+		resize int
+		err    bool
+	}{
+		{"", nil, 0, false},
+		{"items=3", []int{3}, 0, false},
+		{"items=3,%205,7", []int{3, 5, 7}, 0, false},
+		{"resize=original", nil, 0, false},
+		{"resize=64", nil, 64, false},
+		{"items=1,2&resize=4096", []int{1, 2}, 4096, false},
+		{"items=3,x", nil, 0, true},
+		{"items=3,,4", nil, 0, true},
+		{"items=1.5", nil, 0, true},
+		{"resize=63", nil, 0, true},
+		{"resize=4097", nil, 0, true},
+		{"resize=0", nil, 0, true},
+		{"resize=big", nil, 0, true},
+	}
+	for _, tt := range tests {
+		ids, resize, err := zipParams(httptest.NewRequest("GET", "/zip?"+tt.query, nil))
+		if (err != nil) != tt.err {
+			t.Errorf("%q: got error %v, want %v", tt.query, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(ids, tt.ids) || resize != tt.resize {
+			t.Errorf("%q: got %v, %d, want %v, %d", tt.query, ids, resize, tt.ids, tt.resize)
+		}
+	}
+}
+
+func TestZipSelectItems(t *testing.T) {
+	var items []*FileInfo
+	for _, id := range []int{4, 1, 3, 2} {
+		items = append(items, &FileInfo{index: id})
+	}
+
+	tests := []struct {
+		name string
+		ids  []int
+		want []int
+		err  bool
+	}{
+		{"all", nil, []int{4, 1, 3, 2}, false},
+		{"in album order", []int{2, 4}, []int{4, 2}, false},
+		{"duplicate ids", []int{3, 3, 1}, []int{1, 3}, false},
+		{"unknown id", []int{1, 9}, nil, true},
+		{"only unknown", []int{9}, nil, true},
+	}
+	for _, tt := range tests {
+		res, err := zipSelectItems(items, tt.ids)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		var got []int
+		for _, v := range res {
+			got = append(got, v.index)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestZipUniqueName(t *testing.T) {
+	tests := []struct {
+		name  string
+		names []string
+		want  []string
+	}{
+		{"distinct", []string{"a.jpg", "b.jpg"}, []string{"a.jpg", "b.jpg"}},
+		{"repeated", []string{"a.jpg", "a.jpg", "a.jpg"}, []string{"a.jpg", "a (2).jpg", "a (3).jpg"}},
+		{"case", []string{"a.jpg", "A.JPG"}, []string{"a.jpg", "A (2).JPG"}},
+		{"no extension", []string{"readme", "readme"}, []string{"readme", "readme (2)"}},
+
+		// a file already called like a renamed copy
+		{"numbered name taken", []string{"a (2).jpg", "a.jpg", "a.jpg"}, []string{"a (2).jpg", "a.jpg", "a (2) (2).jpg"}},
+		{"numbered name taken after", []string{"a.jpg", "a.jpg", "a (2).jpg"}, []string{"a.jpg", "a (2).jpg", "a (2) (2).jpg"}},
+	}
+	for _, tt := range tests {
+		names := make(map[string]int)
+		seen := make(map[string]bool)
+		var got []string
+		for _, v := range tt.names {
+			s := zipUniqueName(names, v)
+			if seen[s] {
+				t.Errorf("%s: %s given twice", tt.name, s)
+			}
+			seen[s] = true
+			got = append(got, s)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
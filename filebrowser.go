@@ -5,14 +5,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"flag"
 	"image"
 	//"image/draw"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	//"reflect"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -40,9 +45,10 @@ type tviews struct {
 	handler *walk.Action
 }
 type albumInfo struct {
-	id   int
-	name string
-	desc string
+	id     int
+	name   string
+	desc   string
+	parent int // of a new sub-album
 }
 
 type MyMainWindow struct {
@@ -80,9 +86,13 @@ type MyMainWindow struct {
 	actionAlbumItem1 *walk.Action
 	actionAlbumItem2 *walk.Action
 	actionAlbumItem3 *walk.Action
+	actionAlbumItem4 *walk.Action
+	actionAlbumItem5 *walk.Action
+	albumCut         int // album to move by albumPaste
 	actionAlbumSort1 *walk.Action
 	actionAlbumSort2 *walk.Action
 	actionAlbumSort3 *walk.Action
+	actionAlbumVis   [3]*walk.Action
 	albuminfo        *albumInfo
 	visibleAlbum     bool
 	visibleFolder    bool
@@ -174,6 +184,32 @@ func (mw *MyMainWindow) onTest3() {
 
 	mw.prevFilePath = dlg.FilePath
 }
+func (mw *MyMainWindow) onCompactCache() {
+	//prune, evict and vacuum the thumbnail cache db
+	if !mw.thumbView.doCache {
+		walk.MsgBox(mw, "Compact thumbnail cache", "The thumbnail cache is not enabled",
+			walk.MsgBoxOK|walk.MsgBoxIconInformation)
+		return
+	}
+	mw.StatusBar().Items().At(4).SetText("  compacting thumbnail cache...")
+
+	go func() {
+		pruned, evicted, err := mw.thumbView.CacheDBMaintain()
+		if n, verr := VariantCachePrune(); verr != nil {
+			log.Println("onCompactCache", verr)
+		} else {
+			evicted += n
+		}
+
+		mw.Synchronize(func() {
+			if err != nil {
+				mw.StatusBar().Items().At(4).SetText("  compacting thumbnail cache failed: " + err.Error())
+				return
+			}
+			mw.StatusBar().Items().At(4).SetText(fmt.Sprintf("  thumbnail cache compacted, %d pruned, %d evicted", pruned, evicted))
+		})
+	}()
+}
 func (mw *MyMainWindow) onMenuActionExplore() {
 	if treeItemPath != "" {
 		NewThumbViewWindow(mw.MainWindow, treeItemPath)
@@ -275,6 +311,157 @@ func (mw *MyMainWindow) albumSelChange() {
 	mw.actionAlbumItem1.SetVisible(false)
 	mw.actionAlbumItem2.SetVisible(true)
 	mw.actionAlbumItem3.SetVisible(true)
+	mw.actionAlbumItem4.SetVisible(true)
+	mw.actionAlbumItem5.SetVisible(true)
+	mw.albumCheckVisibility()
+}
+
+// Checks the visibility menu action of the selected album.
+func (mw *MyMainWindow) albumCheckVisibility() {
+	org := mw.albumView.SelectedItem()
+	for i, v := range mw.actionAlbumVis {
+		v.SetEnabled(org != nil)
+		v.SetChecked(org != nil && AlbumVisibility(i) == org.visibility)
+	}
+}
+
+// Sets who can see the selected album over http.
+func (mw *MyMainWindow) albumSetVisibility(vis AlbumVisibility) {
+	org := mw.albumView.SelectedItem()
+	if org == nil {
+		return
+	}
+	if _, err := mw.albumView.AlbumDBSetVisibility(org.index, vis); err != nil {
+		walk.MsgBox(mw, "Album visibility", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	mw.albumView.RunAlbum()
+	mw.albumCheckVisibility()
+}
+// Creates a share link of the selected album, good for
+// a week, and puts it on the clipboard.
+func (mw *MyMainWindow) albumShareLink() {
+	org := mw.albumView.SelectedItem()
+	if org == nil {
+		walk.MsgBox(mw, "Share Album", "Please select an album first",
+			walk.MsgBoxOK|walk.MsgBoxIconInformation)
+		return
+	}
+	s, err := mw.albumView.AlbumDBNewShare(org.index, time.Now().Add(shareDefaultLifetime), "")
+	if err == nil {
+		var token string
+		if token, err = shareToken(s); err == nil {
+			err = walk.Clipboard().SetText(netBaseURL() + "/share/" + token)
+		}
+	}
+	if err != nil {
+		walk.MsgBox(mw, "Share Album", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	walk.MsgBox(mw, "Share Album", "A link to "+org.Name+" has been copied to the clipboard. It expires on "+
+		s.Expires.Format("2 January 2006 15:04")+".", walk.MsgBoxOK|walk.MsgBoxIconInformation)
+}
+
+// Looks for the files of album items that have gone missing, then
+// offers to relink those found again by name only.
+func (mw *MyMainWindow) albumRelink() {
+	mw.StatusBar().Items().At(4).SetText("  looking for missing album items...")
+
+	go func() {
+		res, err := mw.albumView.AlbumDBRelink()
+		var cands []relinkCandidate
+		if err == nil {
+			cands, err = mw.albumView.AlbumDBGetRelinks()
+		}
+
+		mw.Synchronize(func() {
+			if err != nil {
+				mw.StatusBar().Items().At(4).SetText("  relinking album items failed: " + err.Error())
+				return
+			}
+			mw.StatusBar().Items().At(4).SetText(fmt.Sprintf("  %d album items missing, %d relinked, %d to confirm",
+				res.Missing, res.Relinked, res.Pending))
+
+			// only items with a single candidate are offered here,
+			// the others are left to the web API.
+			count := make(map[int]int)
+			for _, v := range cands {
+				count[v.ItemID]++
+			}
+			var single []relinkCandidate
+			var list string
+			for _, v := range cands {
+				if count[v.ItemID] == 1 {
+					single = append(single, v)
+					if len(single) <= 10 {
+						list += "\n" + v.Path
+					}
+				}
+			}
+			if len(single) > 10 {
+				list += fmt.Sprintf("\n...and %d more", len(single)-10)
+			}
+			if len(single) > 0 && win.IDYES == walk.MsgBox(mw, "Relink Album Items",
+				fmt.Sprintf("%d missing album items have a file of the same name elsewhere:\n%s\n\nRelink them?", len(single), list),
+				walk.MsgBoxYesNo|walk.MsgBoxIconQuestion) {
+				for _, v := range single {
+					if _, err := mw.albumView.AlbumDBRelinkItem(v.ItemID, v.Path); err != nil {
+						log.Println("albumRelink", v.ItemID, err)
+					}
+				}
+			}
+			if res.Relinked > 0 || len(single) > 0 {
+				mw.albumView.RunAlbum()
+			}
+		})
+	}()
+}
+// Creates a smart album of the images in and below the
+// folder shown, named after it, and selects it.
+func (mw *MyMainWindow) albumNewSmart() {
+	dir := mw.thumbView.itemsModel.dirPath
+	if dir == "" {
+		return
+	}
+	info := FileInfo{index: -1, Name: filepath.Base(dir), URL: dir, smart: &SmartRule{Folder: filepath.Clean(dir)}}
+	if _, err := mw.albumView.AlbumDBUpdateAlbum(&info); err != nil {
+		walk.MsgBox(mw, "New Smart Album", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	mw.StatusBar().Items().At(4).SetText("  filling smart album " + info.Name + "...")
+
+	go func() {
+		added, _, err := mw.albumView.AlbumDBRefreshSmart(info.index)
+		mw.Synchronize(func() {
+			if err != nil {
+				mw.StatusBar().Items().At(4).SetText("  filling smart album failed: " + err.Error())
+			} else {
+				mw.StatusBar().Items().At(4).SetText(fmt.Sprintf("  smart album %s has %d items", info.Name, added))
+			}
+			mw.albumShow(true)
+			mw.albumView.RunAlbum()
+		})
+	}()
+}
+
+// Rates the selected images, 0 clearing their rating.
+func (mw *MyMainWindow) thumbSetRating(rating int) {
+	for _, v := range mw.thumbView.selections {
+		if err := mw.albumView.AlbumDBSetRating(filepath.Join(v.URL, v.Name), rating); err != nil {
+			walk.MsgBox(mw, "Rating", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+			return
+		}
+	}
+}
+
+func (mw *MyMainWindow) albumSetPrivate() {
+	mw.albumSetVisibility(VisibilityPrivate)
+}
+func (mw *MyMainWindow) albumSetShared() {
+	mw.albumSetVisibility(VisibilityShared)
+}
+func (mw *MyMainWindow) albumSetPublic() {
+	mw.albumSetVisibility(VisibilityPublic)
 }
 
 func (mw *MyMainWindow) albumEdit() {
@@ -292,6 +479,58 @@ func (mw *MyMainWindow) albumStartEdit(id int, name string, desc string) {
 	albumData1.SetText(name)
 	albumData2.SetText(desc)
 }
+// Opens the album editor for a new album in the selected one.
+func (mw *MyMainWindow) albumNewSub() {
+	org := mw.albumView.SelectedItem()
+	if org == nil {
+		walk.MsgBox(mw, "New Sub-album", "Please select an album first",
+			walk.MsgBoxOK|walk.MsgBoxIconInformation)
+		return
+	}
+	mw.albumEditorShow(true)
+
+	mw.albumView.SetEnabled(false)
+	mw.albuminfo = &albumInfo{id: -1, parent: org.index}
+
+	albumData1.SetText("")
+	albumData2.SetText("")
+}
+
+// Marks the selected album to be moved into
+// another by albumPaste.
+func (mw *MyMainWindow) albumCutAlbum() {
+	if org := mw.albumView.SelectedItem(); org != nil {
+		mw.albumCut = org.index
+		mw.StatusBar().Items().At(4).SetText("  select the album to move " + org.Name + " into, then Paste album")
+	}
+}
+
+// Moves the album marked by albumCutAlbum into the selected one.
+func (mw *MyMainWindow) albumPaste() {
+	org := mw.albumView.SelectedItem()
+	if org == nil || mw.albumCut == 0 {
+		return
+	}
+	mw.albumMoveTo(mw.albumCut, org.index)
+}
+
+// Moves the selected album to the top.
+func (mw *MyMainWindow) albumMoveTop() {
+	if org := mw.albumView.SelectedItem(); org != nil {
+		mw.albumMoveTo(org.index, 0)
+	}
+}
+
+func (mw *MyMainWindow) albumMoveTo(idAlbum int, idParent int) {
+	if _, err := mw.albumView.AlbumDBMoveAlbum(idAlbum, idParent); err != nil {
+		walk.MsgBox(mw, "Move Album", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	mw.albumCut = 0
+	mw.StatusBar().Items().At(4).SetText("")
+	mw.albumView.RunAlbum()
+}
+
 func (mw *MyMainWindow) albumCancel() {
 	mw.albuminfo = nil
 	mw.albumView.SetEnabled(true)
@@ -302,9 +541,14 @@ func (mw *MyMainWindow) albumSaveEdit() bool {
 		info := FileInfo{index: -1, Name: albumData1.Text(), URL: albumData2.Text()}
 		if mw.albuminfo != nil {
 			info.index = mw.albuminfo.id
+			info.indexParent = mw.albuminfo.parent
 		}
 
-		res, _ := mw.albumView.AlbumDBUpdateAlbum(&info)
+		res, err := mw.albumView.AlbumDBUpdateAlbum(&info)
+		if err != nil {
+			walk.MsgBox(mw, "Save Album", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+			return false
+		}
 		if res > 0 {
 			albumData1.SetText("")
 			albumData2.SetText("")
@@ -325,7 +569,10 @@ func (mw *MyMainWindow) AlbumAddItems() {
 
 	mw.albumShow(true)
 
-	if mw.albumView.SelectedIndex != -1 {
+	if org := mw.albumView.SelectedItem(); org != nil && org.smart != nil {
+		walk.MsgBox(mw, "Add to Album", "The items of "+org.Name+" follow its rule, they can't be added by hand",
+			walk.MsgBoxOK|walk.MsgBoxIconInformation)
+	} else if mw.albumView.SelectedIndex != -1 {
 		mw.albumView.AlbumAddItems(mw.thumbView)
 		mw.albumView.RunAlbum()
 	} else {
@@ -334,6 +581,51 @@ func (mw *MyMainWindow) AlbumAddItems() {
 	}
 }
 
+func (mw *MyMainWindow) AlbumMoveItemsFirst() {
+	mw.albumMoveItems(0)
+}
+func (mw *MyMainWindow) AlbumMoveItemsLast() {
+	mw.albumMoveItems(-1)
+}
+
+// Moves the selected items of the album shown to pos, see
+// AlbumDBMoveItems, and shows the album in its custom order.
+func (mw *MyMainWindow) albumMoveItems(pos int) {
+	org := mw.albumView.SelectedItem()
+	if org == nil || len(mw.thumbView.selections) == 0 {
+		return
+	}
+	var ids []int
+	for _, v := range mw.thumbView.selections {
+		ids = append(ids, v.index)
+	}
+	if err := mw.albumView.AlbumDBMoveItems(org.index, ids, pos); err != nil {
+		walk.MsgBox(mw, "Move in Album", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	mw.albumShowOrder()
+}
+
+// Reverses the order of the items of the selected album.
+func (mw *MyMainWindow) albumReverse() {
+	org := mw.albumView.SelectedItem()
+	if org == nil {
+		return
+	}
+	if err := mw.albumView.AlbumDBReverseItems(org.index); err != nil {
+		walk.MsgBox(mw, "Reverse Album", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	mw.albumShowOrder()
+}
+
+// Shows the items of the selected album again, in their custom order.
+func (mw *MyMainWindow) albumShowOrder() {
+	mw.albumView.AlbumEnumItems(mw.thumbView)
+	mw.thumbView.SetSortMode(5, int(walk.SortAscending))
+	mw.thumbView.Invalidate()
+}
+
 // Sets the album cover image for the currently selected
 // album.
 func (mw *MyMainWindow) AlbumSetCover() {
@@ -344,7 +636,11 @@ func (mw *MyMainWindow) AlbumSetCover() {
 
 		info := FileInfo{index: org.index, Name: org.Name, URL: org.URL, Imagedata: val.Imagedata}
 
-		res, _ := mw.albumView.AlbumDBUpdateAlbum(&info)
+		res, err := mw.albumView.AlbumDBUpdateAlbum(&info)
+		if err != nil {
+			walk.MsgBox(mw, "Set Album Cover", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+			return
+		}
 		if res > 0 {
 			mw.albumView.RunAlbum()
 		}
@@ -356,7 +652,10 @@ func (mw *MyMainWindow) AlbumDeleteItems() {
 
 	mw.albumShow(true)
 
-	if mw.albumView.SelectedIndex != -1 {
+	if org := mw.albumView.SelectedItem(); org != nil && org.smart != nil {
+		walk.MsgBox(mw, "Remove from Album", "The items of "+org.Name+" follow its rule, they can't be removed by hand",
+			walk.MsgBoxOK|walk.MsgBoxIconInformation)
+	} else if mw.albumView.SelectedIndex != -1 {
 
 		if win.IDYES == walk.MsgBox(mw, "Remove from Album", "Remove items from album?",
 			walk.MsgBoxYesNo|walk.MsgBoxIconQuestion|walk.MsgBoxDefButton2) {
@@ -530,6 +829,8 @@ func (mw *MyMainWindow) onTreeCurrentItemChanged() {
 	mw.actionAlbumItem1.SetVisible(true)
 	mw.actionAlbumItem2.SetVisible(false)
 	mw.actionAlbumItem3.SetVisible(false)
+	mw.actionAlbumItem4.SetVisible(false)
+	mw.actionAlbumItem5.SetVisible(false)
 }
 
 func (mw *MyMainWindow) onTreeMouseDown(x, y int, button walk.MouseButton) {
@@ -620,6 +921,153 @@ func addMenuActions(wmenu *walk.Menu, text string, onTriggered walk.EventHandler
 func (mw *MyMainWindow) onAppClose(canceled *bool, reason walk.CloseReason) {
 	*canceled = false
 	//mw.MainWindow.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := StopNet(ctx); err != nil {
+		log.Println("onAppClose", err)
+	}
+}
+
+var (
+	cacheDBFlag  = flag.String("cachedb", "", "cache database file, or "+MemoryDB+" to keep it in memory")
+	albumDBFlag  = flag.String("albumdb", "", "album database file, or "+MemoryDB+" to keep it in memory")
+	dbDirFlag    = flag.String("dbdir", "", "directory for cache.db and album.db")
+	portableFlag = flag.Bool("portable", false, "keep the databases next to the executable")
+	rootsFlag    = flag.String("serveroots", "", "directories served over http, separated by "+string(filepath.ListSeparator))
+	addUserFlag  = flag.String("adduser", "", "add a web user or change their password, read from stdin, and exit")
+	adminFlag    = flag.Bool("admin", false, "make the -adduser user an admin")
+	delUserFlag  = flag.String("deluser", "", "remove a web user and exit")
+	addrFlag     = flag.String("addr", "", "address the http server listens on, as host:port")
+	certFlag     = flag.String("tlscert", "", "certificate file for https")
+	keyFlag      = flag.String("tlskey", "", "key file of the -tlscert certificate")
+	selfSignFlag = flag.Bool("selfsigned", false, "serve https with a generated self signed certificate")
+	tmplFlag     = flag.String("templates", "", "directory with web page templates replacing the built in ones")
+)
+
+// Carries out -adduser and -deluser on album.db,
+// reporting whether there was anything to do.
+func runUserFlags() bool {
+	if *addUserFlag != "" {
+		password, err := readPassword(*addUserFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := AuthSetUser(*addUserFlag, password, *adminFlag); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("web user set", *addUserFlag, "admin", *adminFlag)
+	}
+	if *delUserFlag != "" {
+		n, err := AuthDeleteUser(*delUserFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n == 0 {
+			log.Fatal("no web user ", *delUserFlag)
+		}
+		log.Println("web user removed", *delUserFlag)
+	}
+	return *addUserFlag != "" || *delUserFlag != ""
+}
+
+// Reads the password of the -adduser user name from the first
+// line of stdin, so it isn't left in process listings or the
+// shell history as a command line argument would be.
+func readPassword(name string) (string, error) {
+	fmt.Fprintf(os.Stderr, "password for %s: ", name)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("reading the password of %s: %v", name, err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Sets where cache.db and album.db live. The command line wins
+// over the GOIMAGEBROWSER_DBDIR environment variable, which wins
+// over the CacheDBPath and AlbumDBPath settings.
+func setDBLocations() {
+	if s, ok := settings.Get("CacheDBPath"); ok {
+		CacheDBName = s
+	}
+	if s, ok := settings.Get("AlbumDBPath"); ok {
+		AlbumDBName = s
+	}
+	if s := os.Getenv("GOIMAGEBROWSER_DBDIR"); s != "" {
+		DBDir = s
+		CacheDBName, AlbumDBName = "", ""
+	}
+	if *dbDirFlag != "" {
+		DBDir = *dbDirFlag
+		CacheDBName, AlbumDBName = "", ""
+	}
+	if *cacheDBFlag != "" {
+		CacheDBName = *cacheDBFlag
+	}
+	if *albumDBFlag != "" {
+		AlbumDBName = *albumDBFlag
+	}
+	PortableMode = *portableFlag
+}
+
+// Sets the directories served over http, from the command
+// line or else the ServeRoots setting, and the directories
+// searched for moved album items from the RelinkRoots setting.
+func setServeRoots() {
+	s, _ := settings.Get("ServeRoots")
+	if *rootsFlag != "" {
+		s = *rootsFlag
+	}
+	ServeRoots = splitRoots(s)
+
+	s, _ = settings.Get("RelinkRoots")
+	RelinkRoots = splitRoots(s)
+}
+
+// Returns the directories of the list s, made absolute so they
+// match the absolute paths they are compared with and don't depend
+// on the working directory. Those that can't be are left out.
+func splitRoots(s string) (res []string) {
+	for _, v := range filepath.SplitList(s) {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		abs, err := filepath.Abs(v)
+		if err != nil {
+			log.Println("splitRoots", v, err)
+			continue
+		}
+		res = append(res, abs)
+	}
+	return res
+}
+
+// Sets where and how the http server listens, from the command
+// line or else the NetAddr, NetTLSCert, NetTLSKey, NetSelfSigned
+// and WebTemplates settings.
+func setNetConfig() {
+	if s, ok := settings.Get("NetAddr"); ok && s != "" {
+		NetAddr = s
+	}
+	NetCertFile, _ = settings.Get("NetTLSCert")
+	NetKeyFile, _ = settings.Get("NetTLSKey")
+	if s, ok := settings.Get("NetSelfSigned"); ok {
+		NetSelfSigned, _ = strconv.ParseBool(s)
+	}
+	NetTemplateDir, _ = settings.Get("WebTemplates")
+
+	if *addrFlag != "" {
+		NetAddr = *addrFlag
+	}
+	if *certFlag != "" || *keyFlag != "" {
+		NetCertFile, NetKeyFile = *certFlag, *keyFlag
+	}
+	if *selfSignFlag {
+		NetSelfSigned = true
+	}
+	if *tmplFlag != "" {
+		NetTemplateDir = *tmplFlag
+	}
 }
 
 var cmp00, cmp03 *walk.Composite
@@ -630,6 +1078,8 @@ var albumData1, albumData2 *walk.TextEdit
 func main() {
 	var err error
 
+	flag.Parse()
+
 	treeModel, err = NewDirectoryTreeModel()
 	if err != nil {
 		log.Fatal(err)
@@ -649,6 +1099,13 @@ func main() {
 	//apply settings to window
 	app.SetSettings(settings)
 
+	setDBLocations()
+	setServeRoots()
+	setNetConfig()
+	if runUserFlags() {
+		return
+	}
+
 	var lbl1 *walk.Label
 
 	myFont := *new(Font)
@@ -703,6 +1160,11 @@ func main() {
 						Text:        "Dump in memory cache to disk...",
 						OnTriggered: Mw.onTest3,
 					},
+					Separator{},
+					Action{
+						Text:        "Compact thumbnail cache",
+						OnTriggered: Mw.onCompactCache,
+					},
 				},
 			},
 			Menu{
@@ -889,8 +1351,10 @@ func main() {
 											PushButton{
 												Text: "Save",
 												OnClicked: func() {
-													Mw.albumSaveEdit()
-													Mw.albumEditorShow(false)
+													// left open to correct a name that is taken
+													if Mw.albumSaveEdit() {
+														Mw.albumEditorShow(false)
+													}
 												},
 											},
 										},
@@ -993,6 +1457,18 @@ func main() {
 	Mw.actionAlbumItem1 = addMenuActions(menu, "&Add to Album", Mw.AlbumAddItems, false, false, false)
 	Mw.actionAlbumItem2 = addMenuActions(menu, "&Remove from Album", Mw.AlbumDeleteItems, false, false, false)
 	Mw.actionAlbumItem3 = addMenuActions(menu, "&Set as Album cover image", Mw.AlbumSetCover, false, false, false)
+	Mw.actionAlbumItem4 = addMenuActions(menu, "Move to s&tart of Album", Mw.AlbumMoveItemsFirst, false, false, false)
+	Mw.actionAlbumItem5 = addMenuActions(menu, "Move to &end of Album", Mw.AlbumMoveItemsLast, false, false, false)
+
+	ratingMenu, _ := walk.NewMenu()
+	addMenuActions(ratingMenu, "&No rating", func() { Mw.thumbSetRating(0) }, false, false, false)
+	for i := 1; i <= ratingMax; i++ {
+		rating := i
+		addMenuActions(ratingMenu, "&"+strings.Repeat("*", rating), func() { Mw.thumbSetRating(rating) }, false, false, false)
+	}
+	actionRating := walk.NewMenuAction(ratingMenu)
+	actionRating.SetText("Ra&ting")
+	menu.Actions().Add(actionRating)
 
 	addMenuActions(menu, "", nil, true, false, false)
 	addMenuActions(menu, "&Preview", Mw.onMenuActionPreview, false, false, false)
@@ -1015,6 +1491,19 @@ func main() {
 	Mw.actionAlbumSort3 = addMenuActions(menu, "Sort by size", Mw.albumSortSize, false, true, false)
 	addMenuActions(menu, "", nil, true, false, false)
 	addMenuActions(menu, "&Edit Album", Mw.albumEdit, false, false, false)
+	addMenuActions(menu, "New s&ub-album", Mw.albumNewSub, false, false, false)
+	addMenuActions(menu, "Cu&t album", Mw.albumCutAlbum, false, false, false)
+	addMenuActions(menu, "&Paste album into this one", Mw.albumPaste, false, false, false)
+	addMenuActions(menu, "Move to t&op level", Mw.albumMoveTop, false, false, false)
+	addMenuActions(menu, "New s&mart album of this folder", Mw.albumNewSmart, false, false, false)
+	addMenuActions(menu, "Re&verse item order", Mw.albumReverse, false, false, false)
+	addMenuActions(menu, "", nil, true, false, false)
+	Mw.actionAlbumVis[VisibilityPrivate] = addMenuActions(menu, "Private (admins only)", Mw.albumSetPrivate, false, true, false)
+	Mw.actionAlbumVis[VisibilityShared] = addMenuActions(menu, "Shared (signed in users)", Mw.albumSetShared, false, true, false)
+	Mw.actionAlbumVis[VisibilityPublic] = addMenuActions(menu, "Public (everyone)", Mw.albumSetPublic, false, true, false)
+	addMenuActions(menu, "Copy &share link", Mw.albumShareLink, false, false, false)
+	addMenuActions(menu, "", nil, true, false, false)
+	addMenuActions(menu, "&Relink missing items", Mw.albumRelink, false, false, false)
 	addMenuActions(menu, "", nil, true, false, false)
 	addMenuActions(menu, "&Delete Album", nil, false, false, false)
 	Mw.albumMenu = menu
@@ -1048,6 +1537,23 @@ func main() {
 	if s, ok := settings.Get("Cached"); ok {
 		b, _ := strconv.ParseBool(s)
 		Mw.thumbView.SetCacheMode(b)
+
+		// opened up front for the http server, see serveThumbnail
+		if b {
+			if err := Mw.thumbView.OpenCacheDB(""); err != nil {
+				Mw.thumbView.cacheDBFailed(err)
+			}
+		}
+	}
+	if s, ok := settings.Get("CacheBudgetMB"); ok {
+		if mb, err := strconv.ParseInt(s, 10, 64); err == nil {
+			CacheBudget = mb << 20
+		}
+	}
+	if s, ok := settings.Get("VariantBudgetMB"); ok {
+		if mb, err := strconv.ParseInt(s, 10, 64); err == nil {
+			VariantBudget = mb << 20
+		}
 	}
 	w, h := 120, 75
 	if s, ok := settings.Get("ThumbW"); ok {
@@ -1094,8 +1600,15 @@ func main() {
 		}(s)
 	}
 
-	//experimental net server
+	//experimental net server, stopped on close
+	Mw.MainWindow.Closing().Attach(Mw.onAppClose)
+
+	// opened here, before the goroutines below use it
+	if err := OpenAlbumDB(""); err != nil {
+		log.Println("album db", err.Error())
+	}
 	go StartNet()
+	go StartSmartAlbums()
 
 	/*-----------------------------
 	   START THE WINDOW MAIN LOOP
@@ -1110,6 +1623,8 @@ func main() {
 	settings.Put("ThumbW", strconv.Itoa(Mw.thumbView.itemSize.tw))
 	settings.Put("ThumbH", strconv.Itoa(Mw.thumbView.itemSize.th))
 	settings.Put("Cached", strconv.FormatBool(Mw.thumbView.doCache))
+	settings.Put("CacheBudgetMB", strconv.FormatInt(CacheBudget>>20, 10))
+	settings.Put("VariantBudgetMB", strconv.FormatInt(VariantBudget>>20, 10))
 	settings.Put("LayoutMode", strconv.Itoa(Mw.thumbView.GetLayoutMode()))
 	settings.Put("SortMode", strconv.Itoa(Mw.thumbView.GetSortMode()))
 	settings.Put("SortOrder", strconv.Itoa(Mw.thumbView.GetSortOrder()))
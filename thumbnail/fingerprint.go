@@ -0,0 +1,57 @@
+// Copyright 2017 MLN. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package thumbnail
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+// fingerprintChunk is the number of bytes hashed at each end of a file.
+const fingerprintChunk = 64 * 1024
+
+// Fingerprint returns a cheap content fingerprint of the file name:
+// a hex encoded FNV-1a hash of its size and of its first and last
+// 64 KiB. It lets a cache keep a row whose file has the same size
+// but a new modification time, the file having only been touched or
+// copied. The browser's cache doesn't compute it while the size and
+// modification time both match, so an edit that kept both still goes
+// unnoticed. It is not meant to be collision proof.
+func Fingerprint(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, size)
+
+	if _, err = io.CopyN(h, f, fingerprintChunk); err != nil && err != io.EOF {
+		return "", err
+	}
+	if size > 2*fingerprintChunk {
+		if _, err = f.Seek(-fingerprintChunk, io.SeekEnd); err != nil {
+			return "", err
+		}
+		if _, err = io.Copy(h, f); err != nil {
+			return "", err
+		}
+	} else if size > fingerprintChunk {
+		if _, err = io.Copy(h, f); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2017 MLN. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package thumbnail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*fingerprintChunk/16)
+	if err := ioutil.WriteFile(a, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// same size, one byte changed in the last chunk
+	data[len(data)-1] = 'x'
+	if err := ioutil.WriteFile(b, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fa, err := Fingerprint(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := Fingerprint(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fa == fb {
+		t.Errorf("edited file has the same fingerprint %q", fa)
+	}
+	if fa2, _ := Fingerprint(a); fa2 != fa {
+		t.Errorf("fingerprint changed from %q to %q", fa, fa2)
+	}
+	if _, err = Fingerprint(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("missing file: no error")
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2017 MLN. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package thumbnail is the platform neutral thumbnail engine used by
+// the image browser. It decodes the supported image types, computes
+// the fitted thumbnail size, resizes and jpeg encodes the result and
+// consults an optional cache before doing any of that work.
+//
+// Nothing in here depends on walk or win, so the same code runs on
+// the desktop app and on headless build machines.
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anthonynsimon/bild/transform"
+	"github.com/pixiv/go-libjpeg/jpeg"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+var (
+	ErrUnsupported = errors.New("thumbnail: unsupported image type")
+	ErrTooSmall    = errors.New("thumbnail: image too small")
+)
+
+// Options controls the size and quality of generated thumbnails.
+type Options struct {
+	Width    int // bounding box width
+	Height   int // bounding box height
+	Quality  int // jpeg quality, 1-100
+	Filter   transform.ResampleFilter
+	MinWidth int // source images narrower than this are rejected
+}
+
+// DefaultOptions returns the settings the browser uses for its
+// default 120x75 grid.
+func DefaultOptions() Options {
+	return Options{
+		Width:    120,
+		Height:   75,
+		Quality:  75,
+		Filter:   transform.NearestNeighbor,
+		MinWidth: 8,
+	}
+}
+
+// Thumb is an encoded thumbnail.
+type Thumb struct {
+	Data      []byte // jpeg encoded thumbnail
+	Width     int    // thumbnail width
+	Height    int    // thumbnail height
+	SrcWidth  int    // decoded source width, 0 when served from cache
+	SrcHeight int    // decoded source height, 0 when served from cache
+
+	// Fingerprint is the content fingerprint of the source file,
+	// see Fingerprint. It may be empty when served from cache.
+	Fingerprint string
+
+	// Image holds the resized pixels. It is nil when the
+	// thumbnail was served from cache.
+	Image *image.RGBA
+}
+
+// Cache is consulted by Generate before decoding a file.
+type Cache interface {
+	Lookup(key string) (*Thumb, bool)
+}
+
+// Thumbnailer generates thumbnails according to its Options.
+type Thumbnailer struct {
+	Options Options
+	Cache   Cache
+}
+
+// New returns a Thumbnailer using opt, with no cache.
+func New(opt Options) *Thumbnailer {
+	return &Thumbnailer{Options: opt}
+}
+
+// Supported reports whether files with extension ext can be decoded.
+func Supported(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".bmp", ".gif", ".jpg", ".jpeg", ".png", ".tif", ".tiff", ".webp":
+		return true
+	}
+	return false
+}
+
+// OptimalSize returns the largest size with the aspect ratio of
+// srcW x srcH that fits into dstW x dstH. It returns 0, 0 when the
+// source has no size, as a truncated file's header may claim.
+func OptimalSize(dstW, dstH, srcW, srcH int) (int, int) {
+	if srcW <= 0 || srcH <= 0 {
+		return 0, 0
+	}
+	getW := func(h, ws, hs int) int { return int(math.Ceil(float64(h) / float64(hs) * float64(ws))) }
+	getH := func(w, ws, hs int) int { return int(math.Ceil(float64(w) / float64(ws) * float64(hs))) }
+
+	w := 0
+	h := 0
+	if srcW > srcH {
+		w = dstW
+		h = getH(w, srcW, srcH)
+
+		if h > dstH {
+			h = dstH
+			w = getW(h, srcW, srcH)
+		}
+	} else {
+		h = dstH
+		w = getW(h, srcW, srcH)
+		if w > dstW {
+			w = dstW
+			h = getH(w, srcW, srcH)
+		}
+	}
+
+	return w, h
+}
+
+// Decode decodes an image of type ext from r. For jpeg files the
+// decoder is asked to scale down towards scaleW x scaleH while
+// decoding, which is a lot faster than a full decode followed by a
+// resize. Pass 0, 0 for a full size decode.
+func Decode(r io.Reader, ext string, scaleW, scaleH int) (img image.Image, err error) {
+	switch strings.ToLower(ext) {
+	case ".bmp":
+		img, err = bmp.Decode(r)
+	case ".gif":
+		img, err = gif.Decode(r)
+	case ".jpg", ".jpeg":
+		jopt := jpeg.DecoderOptions{ScaleTarget: image.Rect(0, 0, scaleW, scaleH)}
+		img, err = jpeg.Decode(r, &jopt)
+	case ".png":
+		img, err = png.Decode(r)
+	case ".tif", ".tiff":
+		img, err = tiff.Decode(r)
+	case ".webp":
+		img, err = webp.Decode(r)
+	default:
+		return nil, ErrUnsupported
+	}
+	if err == nil && img == nil {
+		err = ErrUnsupported
+	}
+	return img, err
+}
+
+// DecodeConfig returns the dimensions of an image of type ext
+// without decoding the pixels.
+func DecodeConfig(r io.Reader, ext string) (cfg image.Config, err error) {
+	switch strings.ToLower(ext) {
+	case ".bmp":
+		cfg, err = bmp.DecodeConfig(r)
+	case ".gif":
+		cfg, err = gif.DecodeConfig(r)
+	case ".jpg", ".jpeg":
+		cfg, err = jpeg.DecodeConfig(r)
+	case ".png":
+		cfg, err = png.DecodeConfig(r)
+	case ".tif", ".tiff":
+		cfg, err = tiff.DecodeConfig(r)
+	case ".webp":
+		cfg, err = webp.DecodeConfig(r)
+	default:
+		err = ErrUnsupported
+	}
+	return cfg, err
+}
+
+// DecodeFile opens and decodes the image file name.
+func DecodeFile(name string, scaleW, scaleH int) (image.Image, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Decode(file, filepath.Ext(name), scaleW, scaleH)
+}
+
+// Scale decodes the image file name and fits it into w x h using
+// filter. It is used for previews and full size viewing.
+func Scale(name string, w, h int, filter transform.ResampleFilter) (*image.RGBA, error) {
+	img, err := DecodeFile(name, w, h)
+	if err != nil {
+		return nil, err
+	}
+	if img.Bounds().Dx() < 8 || img.Bounds().Empty() {
+		return nil, ErrTooSmall
+	}
+	w, h = OptimalSize(w, h, img.Bounds().Dx(), img.Bounds().Dy())
+
+	return transform.Resize(img, w, h, filter), nil
+}
+
+// Resize fits img into the Thumbnailer's bounding box.
+func (t *Thumbnailer) Resize(img image.Image) *image.RGBA {
+	w, h := OptimalSize(t.Options.Width, t.Options.Height, img.Bounds().Dx(), img.Bounds().Dy())
+
+	return transform.Resize(img, w, h, t.Options.Filter)
+}
+
+// Encode jpeg encodes img using the Thumbnailer's quality.
+func (t *Thumbnailer) Encode(img image.Image) ([]byte, error) {
+	jept := jpeg.EncoderOptions{Quality: t.Options.Quality, OptimizeCoding: false, DCTMethod: jpeg.DCTIFast}
+	buf := new(bytes.Buffer)
+
+	if err := jpeg.Encode(buf, img, &jept); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Generate returns the thumbnail for the image file name, from the
+// cache if there is one and it has the item, otherwise by decoding,
+// resizing and encoding the file.
+func (t *Thumbnailer) Generate(name string) (*Thumb, error) {
+	if t.Cache != nil {
+		if th, ok := t.Cache.Lookup(name); ok {
+			return th, nil
+		}
+	}
+	return t.generate(name)
+}
+
+func (t *Thumbnailer) generate(name string) (*Thumb, error) {
+	img, err := DecodeFile(name, t.Options.Width, t.Options.Height)
+	if err != nil {
+		return nil, err
+	}
+	if img.Bounds().Dx() < t.Options.MinWidth || img.Bounds().Empty() {
+		return nil, ErrTooSmall
+	}
+
+	mt := t.Resize(img)
+
+	buf, err := t.Encode(mt)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := Fingerprint(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Thumb{
+		Data:        buf,
+		Width:       mt.Bounds().Dx(),
+		Height:      mt.Bounds().Dy(),
+		SrcWidth:    img.Bounds().Dx(),
+		SrcHeight:   img.Bounds().Dy(),
+		Fingerprint: fp,
+		Image:       mt,
+	}, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 MLN. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOptimalSize(t *testing.T) {
+	tests := []struct {
+		dstW, dstH, srcW, srcH int
+		w, h                   int
+	}{
+		{120, 75, 1200, 750, 120, 75},  // same aspect
+		{120, 75, 1600, 900, 120, 68},  // wider
+		{120, 75, 1000, 1000, 75, 75},  // square
+		{120, 75, 750, 1200, 47, 75},   // portrait
+		{120, 75, 4000, 100, 120, 3},   // panorama
+		{120, 75, 100, 4000, 2, 75},    // tall strip
+		{120, 75, 60, 30, 120, 60},     // upscaled
+		{320, 200, 640, 400, 320, 200}, // large tier
+		{120, 75, 0, 0, 0, 0},          // truncated header
+		{120, 75, 800, 0, 0, 0},
+		{120, 75, 0, 600, 0, 0},
+		{120, 75, -1, 600, 0, 0},
+	}
+	for _, tt := range tests {
+		w, h := OptimalSize(tt.dstW, tt.dstH, tt.srcW, tt.srcH)
+		if w != tt.w || h != tt.h {
+			t.Errorf("OptimalSize(%d, %d, %d, %d) = %d, %d, want %d, %d",
+				tt.dstW, tt.dstH, tt.srcW, tt.srcH, w, h, tt.w, tt.h)
+		}
+		if w > tt.dstW || h > tt.dstH {
+			t.Errorf("OptimalSize(%d, %d, %d, %d) = %d, %d, doesn't fit",
+				tt.dstW, tt.dstH, tt.srcW, tt.srcH, w, h)
+		}
+	}
+}
+
+// Writes a w x h png with a gradient to dir.
+func writeTestImage(t *testing.T, dir string, w, h int) string {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	name := filepath.Join(dir, "test.png")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+type testCache map[string]*Thumb
+
+func (c testCache) Lookup(key string) (*Thumb, bool) {
+	th, ok := c[key]
+	return th, ok
+}
+
+func TestGenerateDecode(t *testing.T) {
+	name := writeTestImage(t, t.TempDir(), 400, 250)
+
+	tn := New(DefaultOptions())
+	th, err := tn.Generate(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th.Width != 120 || th.Height != 75 {
+		t.Errorf("thumbnail is %dx%d, want 120x75", th.Width, th.Height)
+	}
+	if th.SrcWidth != 400 || th.SrcHeight != 250 {
+		t.Errorf("source is %dx%d, want 400x250", th.SrcWidth, th.SrcHeight)
+	}
+	fp, err := Fingerprint(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th.Fingerprint != fp {
+		t.Errorf("fingerprint %q, want %q", th.Fingerprint, fp)
+	}
+
+	img, err := Decode(bytes.NewReader(th.Data), ".jpg", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != th.Width || b.Dy() != th.Height {
+		t.Errorf("decoded thumbnail is %dx%d, want %dx%d", b.Dx(), b.Dy(), th.Width, th.Height)
+	}
+	cfg, err := DecodeConfig(bytes.NewReader(th.Data), ".jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != th.Width || cfg.Height != th.Height {
+		t.Errorf("thumbnail header says %dx%d, want %dx%d", cfg.Width, cfg.Height, th.Width, th.Height)
+	}
+
+	// a cached thumbnail is returned without decoding
+	tn.Cache = testCache{name: {Data: []byte("cached"), Width: 1, Height: 1}}
+	if th, err = tn.Generate(name); err != nil || string(th.Data) != "cached" {
+		t.Errorf("Generate didn't use the cache: %v", err)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	dir := t.TempDir()
+	tn := New(DefaultOptions())
+
+	if _, err := tn.Generate(writeTestImage(t, dir, 4, 40)); err != ErrTooSmall {
+		t.Errorf("narrow image: got %v, want ErrTooSmall", err)
+	}
+
+	name := filepath.Join(dir, "test.txt")
+	if err := ioutil.WriteFile(name, []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tn.Generate(name); err != ErrUnsupported {
+		t.Errorf("text file: got %v, want ErrUnsupported", err)
+	}
+
+	// a png cut short after its header
+	data, err := ioutil.ReadFile(writeTestImage(t, dir, 400, 250))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name = filepath.Join(dir, "cut.png")
+	if err = ioutil.WriteFile(name, data[:64], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tn.Generate(name); err == nil {
+		t.Errorf("truncated png: no error")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 MLN. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package thumbnail
+
+// Tier is a thumbnail size class. Thumbnails are generated at the
+// bounding box of a tier rather than at the exact display size, so
+// a cached thumbnail stays usable while the display size changes
+// within its tier and for every smaller one.
+type Tier int
+
+const (
+	TierSmall Tier = iota
+	TierMedium
+	TierLarge
+)
+
+// Tiers lists all tiers, smallest first.
+var Tiers = []Tier{TierSmall, TierMedium, TierLarge}
+
+var tierSizes = [...][2]int{
+	TierSmall:  {128, 80},
+	TierMedium: {208, 130},
+	TierLarge:  {320, 200},
+}
+
+// Size returns the bounding box of the tier.
+func (t Tier) Size() (int, int) {
+	if t < TierSmall {
+		t = TierSmall
+	}
+	if t > TierLarge {
+		t = TierLarge
+	}
+	return tierSizes[t][0], tierSizes[t][1]
+}
+
+func (t Tier) String() string {
+	switch t {
+	case TierSmall:
+		return "small"
+	case TierMedium:
+		return "medium"
+	case TierLarge:
+		return "large"
+	}
+	return "unknown"
+}
+
+// TierFor returns the smallest tier whose bounding box holds w x h,
+// or the largest tier if none does.
+func TierFor(w, h int) Tier {
+	for _, t := range Tiers {
+		tw, th := t.Size()
+		if w <= tw && h <= th {
+			return t
+		}
+	}
+	return TierLarge
+}
+
+// Better reports whether a thumbnail of tier t is a better pick
+// than one of tier cur when tier want is needed: the smallest tier
+// at or above want, failing that the largest one below it.
+func (t Tier) Better(cur, want Tier) bool {
+	switch {
+	case t >= want && cur >= want:
+		return t < cur
+	case t >= want:
+		return true
+	case cur >= want:
+		return false
+	}
+	return t > cur
+}
+
+// ParseTier returns the tier named s, as returned by String.
+func ParseTier(s string) (Tier, bool) {
+	for _, t := range Tiers {
+		if t.String() == s {
+			return t, true
+		}
+	}
+	return TierSmall, false
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 MLN. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package thumbnail
+
+import "testing"
+
+func TestTierFor(t *testing.T) {
+	tests := []struct {
+		w, h int
+		tier Tier
+	}{
+		{0, 0, TierSmall},
+		{120, 75, TierSmall},
+		{128, 80, TierSmall},
+		{129, 80, TierMedium},
+		{128, 81, TierMedium},
+		{208, 130, TierMedium},
+		{209, 100, TierLarge},
+		{320, 200, TierLarge},
+		{1920, 1080, TierLarge},
+	}
+	for _, tt := range tests {
+		if tier := TierFor(tt.w, tt.h); tier != tt.tier {
+			t.Errorf("TierFor(%d, %d) = %v, want %v", tt.w, tt.h, tier, tt.tier)
+		}
+	}
+}
+
+func TestTierBetter(t *testing.T) {
+	tests := []struct {
+		t, cur, want Tier
+		better       bool
+	}{
+		{TierMedium, TierLarge, TierMedium, true},  // nearer at or above want
+		{TierLarge, TierMedium, TierMedium, false}, // further above want
+		{TierMedium, TierSmall, TierMedium, true},  // at want beats below it
+		{TierSmall, TierMedium, TierMedium, false},
+		{TierMedium, TierSmall, TierLarge, true}, // both below, the larger one
+		{TierSmall, TierMedium, TierLarge, false},
+	}
+	for _, tt := range tests {
+		if b := tt.t.Better(tt.cur, tt.want); b != tt.better {
+			t.Errorf("%v.Better(%v, %v) = %v, want %v", tt.t, tt.cur, tt.want, b, tt.better)
+		}
+	}
+}
+
+func TestParseTier(t *testing.T) {
+	for _, tier := range Tiers {
+		if got, ok := ParseTier(tier.String()); !ok || got != tier {
+			t.Errorf("ParseTier(%q) = %v, %v", tier.String(), got, ok)
+		}
+	}
+	if _, ok := ParseTier("huge"); ok {
+		t.Errorf("ParseTier(%q) succeeded", "huge")
+	}
+}
@@ -204,6 +204,7 @@ func NewScrollViewer(window *walk.MainWindow, parent walk.Container, viewerMode
 									" Sort by Date",
 									" Sort by Width",
 									" Sort by Height",
+									" Custom order",
 								},
 								OnCurrentIndexChanged: func() {
 									svr.setSortMode(svr.cmbSort.Format() == "", svr.cmbSort.CurrentIndex(), -1)
@@ -418,8 +419,8 @@ func (sv *ScrollViewer) Run00(dirPath string, itemsModel *FileInfoModel, watchTh
 	//	sv.SetItemsCount(len(sv.itemsModel.items))
 
 	//initialize cache database
-	if CacheDB == nil {
-		sv.OpenCacheDB("")
+	if err := sv.OpenCacheDB(""); err != nil {
+		sv.cacheDBFailed(err)
 	}
 	//--------------------------------
 	//run the imageProcessor workers
@@ -496,8 +497,8 @@ func (sv *ScrollViewer) Run(dirPath string, itemsModel *FileInfoModel, watchThis
 	sv.SetItemsCount(len(sv.itemsModel.items))
 
 	//initialize cache database
-	if CacheDB == nil {
-		sv.OpenCacheDB("")
+	if err := sv.OpenCacheDB(""); err != nil {
+		sv.cacheDBFailed(err)
 	}
 	//--------------------------------
 	//run the imageProcessor workers
@@ -511,14 +512,11 @@ func (sv *ScrollViewer) Run(dirPath string, itemsModel *FileInfoModel, watchThis
 }
 
 func (sv *ScrollViewer) RunAlbum() {
-	//initialize album database
-	if AlbumDB == nil {
-		OpenAlbumDB("")
-	}
-
 	// reset items
 	sv.itemsModel.items = []*FileInfo{}
-	sv.AlbumDBEnum("")
+	if _, err := sv.AlbumDBEnum(""); err != nil {
+		log.Println("ScrollViewer.RunAlbum", err.Error())
+	}
 	sv.itemsModel.PublishRowsReset()
 
 	if len(sv.itemsModel.items) == 0 {
@@ -538,8 +536,9 @@ func (sv *ScrollViewer) RunAlbum() {
 	for k, _ := range sv.ItemsMap {
 		delete(sv.ItemsMap, k)
 	}
+	// keyed by id, album names needn't be unique
 	for i, v := range sv.itemsModel.items {
-		sv.ItemsMap[v.Name] = v
+		sv.ItemsMap[strconv.Itoa(v.index)] = v
 		if v.index == lastSelectedID {
 			v.checked = true
 			sv.SelectedIndex = i
@@ -606,8 +605,8 @@ func (sv *ScrollViewer) RunAlbumItems(items []*FileInfo) {
 	sv.SetItemsCount(len(sv.itemsModel.items))
 
 	//initialize cache database
-	if CacheDB == nil {
-		sv.OpenCacheDB("")
+	if err := sv.OpenCacheDB(""); err != nil {
+		sv.cacheDBFailed(err)
 	}
 	//--------------------------------
 	//run the imageProcessor workers
@@ -1053,6 +1052,10 @@ func (sv *ScrollViewer) itemsModelSortLess(i, j int) bool {
 			return d[i].Width < d[j].Width
 		case 4:
 			return d[i].Height < d[j].Height
+		case 5:
+			// the custom order of album items, other
+			// items have none and stay as they are.
+			return d[i].position < d[j].position
 		}
 	} else {
 		switch sv.itemsModel.SortedColumn() {
@@ -1066,6 +1069,8 @@ func (sv *ScrollViewer) itemsModelSortLess(i, j int) bool {
 			return d[i].Width > d[j].Width
 		case 4:
 			return d[i].Height > d[j].Height
+		case 5:
+			return d[i].position > d[j].position
 		}
 	}
 	return false
@@ -1110,6 +1115,8 @@ func (sv *ScrollViewer) setSortMode(doAction bool, idx int, sortOrder int) {
 			flipsort(3, sortOrder)
 		case 4:
 			flipsort(4, sortOrder)
+		case 5:
+			flipsort(5, sortOrder)
 		}
 		sv.Invalidate()
 		sv.currentSortIndex = sv.cmbSort.CurrentIndex()
@@ -1488,6 +1495,11 @@ func (sv *ScrollViewer) SetItemSize(w, h int) {
 		sv.itemWidth = sv.itemSize.twm()
 		sv.itemHeight = sv.itemSize.thm()
 
+		// the thumbnails resized for the old size are of no more use
+		for _, v := range sv.itemsModel.items {
+			v.scaled, v.scaledOf = nil, nil
+		}
+
 		if sv.contentMonitor != nil {
 			sv.contentMonitor.removeChangedItems(sv.contentMonitor.doneMap)
 		}
@@ -1872,7 +1884,10 @@ func (sv *ScrollViewer) AlbumEnumItems(svTarget *ScrollViewer) bool {
 	if svTarget != nil {
 		if sv.SelectedItem() != nil {
 			albumID := sv.SelectedItem().index
-			fi := sv.AlbumDBEnumItems(albumID)
+			fi, err := sv.AlbumDBEnumItems(albumID)
+			if err != nil {
+				log.Println(err.Error())
+			}
 
 			if len(fi) > 0 {
 				svTarget.RunAlbumItems(fi)